@@ -0,0 +1,190 @@
+use anyhow::{anyhow, Result};
+use async_trait::async_trait;
+use std::{collections::BTreeMap, sync::Arc};
+
+use crate::{mqtt_engine::Sample, vm::Engine};
+
+/// Aliases is an engine that resolves friendly names for devices,
+/// i.e. couch-lamp for home/zigbee/0x00158d0001, before forwarding to another engine.
+/// An alias replaces the toplevel of a path, so [couch-lamp/set] is home/zigbee/0x00158d0001/set.
+/// Once any alias is defined, a path of a single level that is not an alias is an error,
+/// since it is most likely a misspelled alias.
+#[derive(Debug, Clone)]
+pub struct Aliases<E: Engine> {
+    engine: E,
+    aliases: Arc<BTreeMap<String, String>>,
+}
+
+impl<E: Engine> Aliases<E> {
+    /// Creates the engine from a map of alias to path.
+    pub fn new(engine: E, aliases: BTreeMap<String, String>) -> Self {
+        Self {
+            engine,
+            aliases: Arc::new(aliases),
+        }
+    }
+    fn resolve(&self, path: &str) -> Result<String> {
+        let (toplevel, rest) = match path.split_once('/') {
+            Some((toplevel, rest)) => (toplevel, Some(rest)),
+            None => (path, None),
+        };
+        match (self.aliases.get(toplevel), rest) {
+            (Some(target), Some(rest)) => Ok(format!("{}/{}", target, rest)),
+            (Some(target), None) => Ok(target.clone()),
+            (None, None) if !self.aliases.is_empty() && !matches!(toplevel, "+" | "#") => {
+                Err(anyhow!("unknown alias {}", toplevel))
+            }
+            (None, _) => Ok(path.to_string()),
+        }
+    }
+}
+
+#[async_trait]
+impl<E: Engine + 'static> Engine for Aliases<E> {
+    async fn get(&self, path: &str) -> Result<Vec<u8>> {
+        self.engine.get(&self.resolve(path)?).await
+    }
+    async fn get_live(&self, path: &str) -> Result<Vec<u8>> {
+        self.engine.get_live(&self.resolve(path)?).await
+    }
+    async fn get_topic(&self, path: &str, live: bool) -> Result<(String, Vec<u8>)> {
+        self.engine.get_topic(&self.resolve(path)?, live).await
+    }
+    async fn subscribe(&self, path: &str) -> Result<()> {
+        self.engine.subscribe(&self.resolve(path)?).await
+    }
+    async fn set(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        self.engine.set(&self.resolve(path)?, value).await
+    }
+    async fn publish(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        self.engine.publish(&self.resolve(path)?, value).await
+    }
+    async fn clear(&self, path: &str) -> Result<()> {
+        self.engine.clear(&self.resolve(path)?).await
+    }
+    async fn find(&self, path: &str) -> Result<Vec<Vec<u8>>> {
+        self.engine.find(&self.resolve(path)?).await
+    }
+    async fn history(&self, path: &str) -> Result<Vec<Sample>> {
+        self.engine.history(&self.resolve(path)?).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{sync::Mutex, time::Duration};
+    use tokio::{sync::broadcast, time};
+
+    use super::*;
+    use crate::{compiler::Interpreter, vm::VM, Compile};
+
+    #[derive(Debug, Clone)]
+    struct TestEngine {
+        calls: Arc<Mutex<Vec<String>>>,
+    }
+    impl TestEngine {
+        fn new() -> Self {
+            Self {
+                calls: Arc::new(Mutex::new(Vec::new())),
+            }
+        }
+        fn calls(&self) -> Vec<String> {
+            self.calls.lock().unwrap().drain(..).collect()
+        }
+    }
+
+    #[async_trait]
+    impl Engine for TestEngine {
+        async fn get(&self, path: &str) -> Result<Vec<u8>> {
+            self.calls.lock().unwrap().push(format!("get {}", path));
+            Ok("1".as_bytes().to_vec())
+        }
+        async fn set(&self, path: &str, value: Vec<u8>) -> Result<()> {
+            self.calls.lock().unwrap().push(format!(
+                "set {} {}",
+                path,
+                String::from_utf8(value).unwrap()
+            ));
+            Ok(())
+        }
+        async fn publish(&self, path: &str, value: Vec<u8>) -> Result<()> {
+            self.calls.lock().unwrap().push(format!(
+                "publish {} {}",
+                path,
+                String::from_utf8(value).unwrap()
+            ));
+            Ok(())
+        }
+        async fn clear(&self, path: &str) -> Result<()> {
+            self.calls.lock().unwrap().push(format!("clear {}", path));
+            Ok(())
+        }
+        async fn find(&self, path: &str) -> Result<Vec<Vec<u8>>> {
+            self.calls.lock().unwrap().push(format!("find {}", path));
+            Ok(Vec::new())
+        }
+        async fn history(&self, path: &str) -> Result<Vec<Sample>> {
+            self.calls.lock().unwrap().push(format!("history {}", path));
+            Ok(Vec::new())
+        }
+    }
+
+    fn aliases(engine: TestEngine) -> Aliases<TestEngine> {
+        Aliases::new(
+            engine,
+            btree_map!["couch-lamp".to_string() => "home/zigbee/0x00158d0001".to_string()],
+        )
+    }
+
+    #[tokio::test]
+    async fn test_alias() {
+        let engine = TestEngine::new();
+        let aliases = aliases(engine.clone());
+
+        aliases.set("couch-lamp", "on".into()).await.unwrap();
+        aliases.get("couch-lamp/power").await.unwrap();
+        aliases.clear("kitchen/light").await.unwrap();
+
+        assert_eq!(
+            vec![
+                "set home/zigbee/0x00158d0001 on".to_string(),
+                "get home/zigbee/0x00158d0001/power".to_string(),
+                "clear kitchen/light".to_string(),
+            ],
+            engine.calls()
+        );
+    }
+    #[tokio::test]
+    async fn test_alias_unknown() {
+        let engine = TestEngine::new();
+        let aliases = aliases(engine.clone());
+
+        let err = aliases.set("couch-lmap", "on".into()).await.unwrap_err();
+        assert_eq!("unknown alias couch-lmap", err.to_string());
+        assert!(engine.calls().is_empty());
+
+        // Without aliases every path is forwarded as is.
+        let aliases = Aliases::new(engine.clone(), BTreeMap::new());
+        aliases.set("couch-lmap", "on".into()).await.unwrap();
+        assert_eq!(vec!["set couch-lmap on".to_string()], engine.calls());
+    }
+    #[tokio::test]
+    async fn test_alias_program() {
+        let engine = TestEngine::new();
+        let code = Interpreter::from_source("set [couch-lamp] <couch-lamp/power>;").unwrap();
+        let vm = VM::new(aliases(engine.clone()));
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        time::timeout(Duration::from_millis(100), vm.run(code, shutdown_rx))
+            .await
+            .unwrap()
+            .unwrap();
+
+        assert_eq!(
+            vec![
+                "get home/zigbee/0x00158d0001/power".to_string(),
+                "set home/zigbee/0x00158d0001 1".to_string(),
+            ],
+            engine.calls()
+        );
+    }
+}
@@ -1,7 +1,10 @@
-use std::fmt::{Debug, Error, Formatter};
+use serde::{Deserialize, Serialize};
+use std::fmt::{Debug, Display, Error, Formatter};
 
 /// The AST node for expressions.
-#[derive(Clone, PartialEq)]
+/// Nodes serialize as JSON objects with the kind of node and its args.
+#[derive(Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "kind", content = "args", rename_all = "snake_case")]
 pub enum Expr {
     Integer(i64),
     Float(f64),
@@ -14,6 +17,20 @@ pub enum Expr {
     Path(String),
     As(Box<Expr>, String, Box<Expr>),
     Index(Box<Expr>, String),
+    Trigger,
+    // TriggerPath is the path of the value that triggered the when.
+    TriggerPath,
+    // Previous is the value the condition of the when read before the trigger.
+    Previous,
+    // Unknown is the value of a device that never published, i.e. the default of a within.
+    Unknown,
+    Aggregate(Aggregate, String),
+    Range(Box<Expr>, Range, Box<Expr>, Box<Expr>),
+    Trend(String, Trend),
+    // Change holds the path, the direction, the amount and the window of the change.
+    Change(String, Trend, Box<Expr>, Box<Expr>),
+    // Within holds the path, the timeout and the value used when the timeout passes.
+    Within(String, Box<Expr>, Option<Box<Expr>>),
 }
 impl Debug for Expr {
     fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
@@ -38,17 +55,109 @@ impl Debug for Expr {
             Expr::Path(p) => write!(fmt, "<{}>", p),
             Expr::As(init, name, cont) => write!(fmt, "{:?} as {} {:?}", init, name, cont),
             Expr::Index(obj, prop) => write!(fmt, "{:?}.{}", obj, prop),
+            Expr::Trigger => write!(fmt, "$value"),
+            Expr::TriggerPath => write!(fmt, "$path"),
+            Expr::Previous => write!(fmt, "$prev"),
+            Expr::Unknown => write!(fmt, "$unknown"),
+            Expr::Aggregate(agg, p) => write!(fmt, "{:?} <{}>", agg, p),
+            Expr::Range(e, r, lo, hi) => write!(fmt, "({:?} is {:?} {:?}..{:?})", e, r, lo, hi),
+            Expr::Trend(p, t) => write!(fmt, "(<{}> {:?})", p, t),
+            Expr::Change(p, t, by, window) => {
+                let change = match t {
+                    Trend::Rising => "increased",
+                    Trend::Falling => "decreased",
+                };
+                write!(fmt, "(<{}> {} by {:?} in {:?})", p, change, by, window)
+            }
+            Expr::Within(p, timeout, None) => write!(fmt, "(<{}> within {:?})", p, timeout),
+            Expr::Within(p, timeout, Some(default)) => {
+                write!(fmt, "(<{}> within {:?} else {:?})", p, timeout, default)
+            }
+        }
+    }
+}
+
+/// The AST node for aggregates computed over the values of every path matching a wildcard.
+#[derive(Copy, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Aggregate {
+    Avg,
+    Min,
+    Max,
+    Sum,
+    Count,
+}
+
+impl Debug for Aggregate {
+    fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
+        match self {
+            Aggregate::Avg => write!(fmt, "avg"),
+            Aggregate::Min => write!(fmt, "min"),
+            Aggregate::Max => write!(fmt, "max"),
+            Aggregate::Sum => write!(fmt, "sum"),
+            Aggregate::Count => write!(fmt, "count"),
+        }
+    }
+}
+
+/// Returns the aggregate of the name, the names are only special before a path,
+/// so they remain usable as variable names.
+pub fn aggregate(name: &str) -> Option<Aggregate> {
+    match name {
+        "avg" => Some(Aggregate::Avg),
+        "min" => Some(Aggregate::Min),
+        "max" => Some(Aggregate::Max),
+        "sum" => Some(Aggregate::Sum),
+        "count" => Some(Aggregate::Count),
+        _ => None,
+    }
+}
+
+/// The AST node for comparing a number to an inclusive range of numbers.
+#[derive(Copy, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Range {
+    Inside,
+    Outside,
+}
+
+impl Debug for Range {
+    fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
+        match self {
+            Range::Inside => write!(fmt, "inside"),
+            Range::Outside => write!(fmt, "outside"),
         }
     }
 }
 
-#[derive(Copy, Clone, PartialEq)]
+/// The AST node for the direction in which the value of a path changes.
+#[derive(Copy, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Trend {
+    Rising,
+    Falling,
+}
+
+impl Debug for Trend {
+    fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
+        match self {
+            Trend::Rising => write!(fmt, "rising"),
+            Trend::Falling => write!(fmt, "falling"),
+        }
+    }
+}
+
+#[derive(Copy, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
 pub enum BinaryOpcode {
     Mul,
     Div,
     Add,
     Sub,
     Eql,
+    Gt,
+    Lt,
+    And,
 }
 
 impl Debug for BinaryOpcode {
@@ -59,27 +168,121 @@ impl Debug for BinaryOpcode {
             BinaryOpcode::Add => write!(fmt, "+"),
             BinaryOpcode::Sub => write!(fmt, "-"),
             BinaryOpcode::Eql => write!(fmt, "is"),
+            BinaryOpcode::Gt => write!(fmt, ">"),
+            BinaryOpcode::Lt => write!(fmt, "<"),
+            BinaryOpcode::And => write!(fmt, "and"),
         }
     }
 }
 
-#[derive(PartialEq)]
+/// Displays the operator as it is written, i.e. + or is.
+impl Display for BinaryOpcode {
+    fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
+        Debug::fmt(self, fmt)
+    }
+}
+
+#[derive(Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "kind", content = "args", rename_all = "snake_case")]
 pub enum Stmt {
     Block(Vec<Stmt>),
-    Set(String, Expr),
+    /// Set is urgent when it is not suppressed during quiet hours.
+    /// The paths of a set, publish or clear are each path its character classes name.
+    Set(Vec<String>, Expr, bool),
+    Publish(Vec<String>, Expr),
+    Clear(Vec<String>),
     Let(String, Expr),
-    When(Expr, Box<Stmt>),
+    When(Expr, Vec<WhenOption>, Box<Stmt>),
     //Once(String, Expr, Box<Stmt>),
     Wait(Expr, Box<Stmt>),
-    At(Expr, Box<Stmt>),
+    WaitUntil(Expr, Expr, Box<Stmt>),
+    // At holds the time, how many times it repeats if limited, and the statement.
+    At(Expr, Option<Expr>, Box<Stmt>),
+    // Guard runs the statement only when the time of day is after or before the time.
+    Guard(Guard, Expr, Box<Stmt>),
     Expr(Expr),
     Print(Expr),
-    Scene(String, Box<Stmt>),
-    Start(String),
-    Stop(String),
+    // Scene, Start, Stop, Arm, Enable and Disable hold the scene and the byte offset of the statement.
+    Scene(String, Vec<SceneOption>, Box<Stmt>, usize),
+    Start(String, usize),
+    Stop(String, usize),
+    // StopWhen holds a path or MQTT topic filter of the whens to stop.
+    StopWhen(String),
+    // StopAt holds the time of the ats to stop.
+    StopAt(Expr),
+    Arm(String, usize),
+    Enable(String, usize),
+    Disable(String, usize),
+    // Include holds the included file and the byte offset of the statement,
+    // it is replaced by the included statements when loading files.
+    Include(String, usize),
+    // Assert holds the condition, the byte offset of the statement
+    // and the file and line of the statement once the program is loaded, see loader.
+    Assert(Expr, usize, Option<String>),
     //Func(String, Vec<String>, Box<Stmt>),
 }
 
+/// The AST node for the side of a time of day a guard runs its statement.
+#[derive(Copy, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Guard {
+    After,
+    Before,
+}
+
+impl Debug for Guard {
+    fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
+        match self {
+            Guard::After => write!(fmt, "after"),
+            Guard::Before => write!(fmt, "before"),
+        }
+    }
+}
+
+/// The AST node for options that modify a scene.
+#[derive(Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "kind", content = "args", rename_all = "snake_case")]
+pub enum SceneOption {
+    Disabled,
+}
+
+impl Debug for SceneOption {
+    fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
+        match self {
+            SceneOption::Disabled => write!(fmt, "disabled"),
+        }
+    }
+}
+
+/// The AST node for options that modify when a when statement fires.
+#[derive(Clone, PartialEq, Serialize, Deserialize)]
+#[serde(tag = "kind", content = "args", rename_all = "snake_case")]
+pub enum WhenOption {
+    Cooldown(Expr),
+    Changed,
+    Hysteresis(Expr),
+    // Live ignores the retained values the broker sends when subscribing.
+    Live,
+    // Debounce runs the statement once the condition stopped firing for the duration.
+    Debounce(Expr),
+    // Breaker stops the when for the last duration once it fired more than the number of times
+    // within the first duration.
+    Breaker(Expr, Expr, Expr),
+}
+
+impl Debug for WhenOption {
+    fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
+        match self {
+            WhenOption::Cooldown(d) => write!(fmt, "cooldown {:?}", d),
+            WhenOption::Changed => write!(fmt, "changed"),
+            WhenOption::Hysteresis(h) => write!(fmt, "hysteresis {:?}", h),
+            WhenOption::Live => write!(fmt, "live"),
+            WhenOption::Debounce(d) => write!(fmt, "debounce {:?}", d),
+            WhenOption::Breaker(n, w, d) => write!(fmt, "breaker {:?} per {:?} for {:?}", n, w, d),
+        }
+    }
+}
+
 impl Debug for Stmt {
     fn fmt(&self, fmt: &mut Formatter) -> Result<(), Error> {
         match self {
@@ -93,16 +296,204 @@ impl Debug for Stmt {
                 }
                 write!(fmt, "]")
             }
-            Stmt::Set(path, expr) => write!(fmt, "set {} {:?}", path, expr),
+            Stmt::Set(path, expr, urgent) => {
+                write!(fmt, "set ")?;
+                if *urgent {
+                    write!(fmt, "urgent ")?;
+                }
+                write!(fmt, "{} {:?}", path.join(" "), expr)
+            }
+            Stmt::Publish(path, expr) => write!(fmt, "publish {} {:?}", path.join(" "), expr),
+            Stmt::Clear(path) => write!(fmt, "clear {}", path.join(" ")),
             Stmt::Expr(expr) => write!(fmt, "{:?}", expr),
             Stmt::Let(id, expr) => write!(fmt, "let {} = {:?}", id, expr),
-            Stmt::When(expr, body) => write!(fmt, "when {:?} {:?}", expr, body),
+            Stmt::When(expr, options, body) => {
+                write!(fmt, "when {:?} ", expr)?;
+                for o in options {
+                    write!(fmt, "{:?} ", o)?;
+                }
+                write!(fmt, "{:?}", body)
+            }
             Stmt::Wait(expr, body) => write!(fmt, "wait {:?} {:?}", expr, body),
-            Stmt::At(expr, body) => write!(fmt, "at {:?} {:?}", expr, body),
+            Stmt::WaitUntil(cond, timeout, body) => {
+                write!(fmt, "wait until {:?} for {:?} {:?}", cond, timeout, body)
+            }
+            Stmt::At(expr, None, body) => write!(fmt, "at {:?} {:?}", expr, body),
+            Stmt::At(expr, Some(count), body) => {
+                write!(fmt, "at {:?} repeat {:?} {:?}", expr, count, body)
+            }
+            Stmt::Guard(guard, expr, body) => write!(fmt, "{:?} {:?} {:?}", guard, expr, body),
             Stmt::Print(expr) => write!(fmt, "print {:?}", expr),
-            Stmt::Scene(id, body) => write!(fmt, "scene {} {:?}", id, body),
-            Stmt::Start(id) => write!(fmt, "start {}", id),
-            Stmt::Stop(id) => write!(fmt, "stop {}", id),
+            Stmt::Scene(id, options, body, _) => {
+                write!(fmt, "scene {} ", id)?;
+                for o in options {
+                    write!(fmt, "{:?} ", o)?;
+                }
+                write!(fmt, "{:?}", body)
+            }
+            Stmt::Start(id, _) => write!(fmt, "start {}", id),
+            Stmt::Stop(id, _) => write!(fmt, "stop {}", id),
+            Stmt::StopWhen(path) => write!(fmt, "stop when <{}>", path),
+            Stmt::StopAt(expr) => write!(fmt, "stop at {:?}", expr),
+            Stmt::Arm(id, _) => write!(fmt, "arm {}", id),
+            Stmt::Enable(id, _) => write!(fmt, "enable {}", id),
+            Stmt::Disable(id, _) => write!(fmt, "disable {}", id),
+            Stmt::Include(file, _) => write!(fmt, "include \"{}\"", file),
+            Stmt::Assert(expr, _, _) => write!(fmt, "assert {:?}", expr),
+        }
+    }
+}
+
+/// Returns the byte offset of the first scene defined within the statement.
+/// Scenes are only defined at the top level, a scene within a scene is an error.
+pub fn nested_scene(stmt: &Stmt) -> Option<usize> {
+    match stmt {
+        Stmt::Block(stmts) => stmts.iter().find_map(nested_scene),
+        Stmt::Scene(_, _, _, offset) => Some(*offset),
+        Stmt::When(_, _, body)
+        | Stmt::Wait(_, body)
+        | Stmt::WaitUntil(_, _, body)
+        | Stmt::At(_, _, body)
+        | Stmt::Guard(_, _, body) => nested_scene(body),
+        _ => None,
+    }
+}
+
+/// Returns the file and byte offset of the first include within the statement.
+pub fn include(stmt: &Stmt) -> Option<(&str, usize)> {
+    match stmt {
+        Stmt::Block(stmts) => stmts.iter().find_map(include),
+        Stmt::Include(file, offset) => Some((file, *offset)),
+        Stmt::Scene(_, _, body, _)
+        | Stmt::When(_, _, body)
+        | Stmt::Wait(_, body)
+        | Stmt::WaitUntil(_, _, body)
+        | Stmt::At(_, _, body)
+        | Stmt::Guard(_, _, body) => include(body),
+        _ => None,
+    }
+}
+
+/// Reports whether the condition of a when compares a number to thresholds,
+/// i.e. <temp> > 25 or <humidity> is outside 40..60, which hysteresis requires.
+pub fn numeric_comparison(expr: &Expr) -> bool {
+    matches!(
+        expr,
+        Expr::Binary(_, BinaryOpcode::Gt | BinaryOpcode::Lt, _) | Expr::Range(_, _, _, _)
+    )
+}
+
+/// Builds the condition of online <toplevel>, which holds while the bridge of the toplevel
+/// is connected to its hardware. By the mqtt-smarthome convention bridges publish
+/// to toplevel/connected 0 when disconnected, 1 when connected to the broker only
+/// and 2 when also connected to the hardware.
+pub fn online(toplevel: String) -> Expr {
+    Expr::Binary(
+        Box::new(Expr::Path(format!("{}/connected", toplevel))),
+        BinaryOpcode::Eql,
+        Box::new(Expr::Integer(2)),
+    )
+}
+
+/// Removes the quotes of the quoted parts of a path, i.e. "Living Room"/light,
+/// which are kept as is so they may contain spaces and dots.
+/// When dotted, a path using . as the separator, i.e. home.livingroom.light,
+/// is converted to a slash path, a . between two digits is part of a decimal number and is kept.
+/// Otherwise a . is part of the topic, as MQTT topics may contain dots.
+pub fn canonical_path(path: &str, dotted: bool) -> String {
+    let chars: Vec<char> = path.chars().collect();
+    let mut quoted = false;
+    chars
+        .iter()
+        .enumerate()
+        .filter_map(|(i, c)| {
+            if *c == '"' {
+                quoted = !quoted;
+                return None;
+            }
+            let decimal = i > 0
+                && chars[i - 1].is_ascii_digit()
+                && chars.get(i + 1).map_or(false, |n| n.is_ascii_digit());
+            if dotted && *c == '.' && !decimal && !quoted {
+                Some('/')
+            } else {
+                Some(*c)
+            }
+        })
+        .collect()
+}
+
+/// How many characters a character class may name, i.e. [a-z0-9] names 36.
+pub const MAX_CLASS_WIDTH: usize = 64;
+
+/// How many paths the character classes of a path may expand to,
+/// since several classes name every combination of their characters.
+pub const MAX_EXPANDED_PATHS: usize = 256;
+
+/// Expands the character classes of a path, i.e. bedroom/light[1-3], to each path it names.
+/// A class lists characters and ranges of characters, i.e. [135] or [a-c0-9],
+/// and several classes name every combination of their characters.
+/// A class naming more than MAX_CLASS_WIDTH characters or classes naming more than
+/// MAX_EXPANDED_PATHS paths are an error, so a single path cannot exhaust the memory.
+/// Quoted parts of the path are kept as is, so they may contain brackets.
+pub fn expand_classes(path: &str) -> Result<Vec<String>, &'static str> {
+    let mut paths = vec![String::new()];
+    let mut quoted = false;
+    let mut chars = path.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '"' => {
+                quoted = !quoted;
+                paths.iter_mut().for_each(|p| p.push(c));
+            }
+            c if quoted => paths.iter_mut().for_each(|p| p.push(c)),
+            '[' => {
+                let mut class = Vec::new();
+                loop {
+                    match chars.next() {
+                        None => return Err("character class is missing ]"),
+                        Some(']') => break,
+                        Some('[' | '/' | '+' | '#' | '"') => {
+                            return Err("character class must only contain characters and ranges")
+                        }
+                        Some(c) => class.push(c),
+                    }
+                }
+                let mut members = Vec::new();
+                let mut i = 0;
+                while i < class.len() {
+                    let range = if i + 2 < class.len() && class[i + 1] == '-' {
+                        if class[i] > class[i + 2] {
+                            return Err("character range is reversed");
+                        }
+                        i += 3;
+                        class[i - 3]..=class[i - 1]
+                    } else {
+                        i += 1;
+                        class[i - 1]..=class[i - 1]
+                    };
+                    // The width is checked before naming the characters of the range,
+                    // a repeated character counts each time.
+                    let width = *range.end() as usize - *range.start() as usize + 1;
+                    if members.len() + width > MAX_CLASS_WIDTH {
+                        return Err("character class names too many characters");
+                    }
+                    members.extend(range.filter(|m| !members.contains(m)).collect::<Vec<_>>());
+                }
+                if members.is_empty() {
+                    return Err("character class is empty");
+                }
+                if paths.len() * members.len() > MAX_EXPANDED_PATHS {
+                    return Err("character classes name too many paths");
+                }
+                paths = paths
+                    .iter()
+                    .flat_map(|p| members.iter().map(move |m| format!("{}{}", p, m)))
+                    .collect();
+            }
+            ']' => return Err("character class is missing ["),
+            c => paths.iter_mut().for_each(|p| p.push(c)),
         }
     }
+    Ok(paths)
 }
@@ -1,18 +1,140 @@
 use anyhow::anyhow;
-use dan::{compiler::Interpreter, mqtt_engine::MQTTEngine, vm::VM, Compile, Result};
+use chrono_tz::Tz;
+use dan::{
+    alias::Aliases,
+    compiler::{parse_duration, parse_time, Interpreter, TimeOfDay},
+    config, help,
+    limiter::Limiter,
+    loader,
+    logging::{self, LogFormat},
+    mqtt_engine::{self, MQTTEngine, Options},
+    router::Router,
+    snapshot::Snapshot,
+    sun::Location,
+    vm::{AssertionFailed, Engine, Output, QuietHours, VM},
+    watch::watch,
+    Compile, Result, SyntaxError,
+};
 use env_logger;
-use std::path::PathBuf;
-use std::{fs, sync::Arc};
+use futures::future;
+use std::ffi::OsString;
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+use std::{
+    collections::BTreeMap,
+    fs,
+    num::NonZeroU32,
+    process::ExitCode,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc,
+    },
+    time::Duration,
+};
 use structopt::StructOpt;
-use tokio::{select, signal, sync::broadcast, task::JoinSet};
+use tokio::{
+    select,
+    signal::{
+        self,
+        unix::{signal as unix_signal, SignalKind},
+    },
+    sync::broadcast,
+    task::JoinSet,
+};
 
 #[derive(Debug, StructOpt)]
 #[structopt(name = "example", about = "An example of StructOpt usage.")]
 struct Opt {
+    /// Read flags from a JSON file of flag to value, i.e. {"mqtt-url": "mqtt://broker"},
+    /// flags given on the command line override the file
+    #[structopt(long, parse(from_os_str), env = "DAN_CONFIG")]
+    config: Option<PathBuf>,
+
     /// URL to MQTT broker
     #[structopt(short, long, default_value = "mqtt://localhost", env = "DAN_MQTT_URL")]
     mqtt_url: String,
 
+    /// MQTT client ID, defaults to one chosen by the client library
+    #[structopt(long, env = "DAN_CLIENT_ID")]
+    client_id: Option<String>,
+
+    /// Append a suffix unique to the process to the client ID,
+    /// so several instances can share a broker at the cost of persistent sessions
+    #[structopt(long)]
+    unique_client_id: bool,
+
+    /// The toplevel of every topic, paths in the programs are relative to it,
+    /// i.e. house1 for several homes sharing a broker
+    #[structopt(long, env = "DAN_PREFIX")]
+    prefix: Option<String>,
+
+    /// Route a toplevel to a different MQTT broker, formatted as toplevel=url
+    #[structopt(name = "route", long = "route", parse(try_from_str = parse_route))]
+    routes: Vec<(String, String)>,
+
+    /// Name a device by an alias used in place of the toplevel of paths,
+    /// formatted as alias=path, i.e. couch-lamp=home/zigbee/0x00158d0001
+    #[structopt(name = "alias", long = "alias", parse(try_from_str = parse_alias))]
+    aliases: Vec<(String, String)>,
+
+    /// IANA time zone of the home, i.e. America/Denver, used to interpret the times of ats,
+    /// befores, afters and the quiet hours. Defaults to the local time zone of the host
+    #[structopt(long, env = "DAN_TIME_ZONE", parse(try_from_str = parse_time_zone))]
+    time_zone: Option<Tz>,
+
+    /// Latitude and longitude of the home in degrees, i.e. 39.74,-104.99,
+    /// used to compute the times of #sunrise and #sunset
+    #[structopt(
+        long,
+        env = "DAN_LOCATION",
+        parse(try_from_str = parse_location),
+        allow_hyphen_values = true
+    )]
+    location: Option<Location>,
+
+    /// Limit how many scenes may run at once, to stop a program starting scenes in a loop
+    #[structopt(long)]
+    max_scenes: Option<usize>,
+
+    /// Publish every value as JSON, so strings are quoted, instead of only objects and lists
+    #[structopt(long)]
+    publish_json: bool,
+
+    /// Drop sets that are not urgent during the hours, formatted as start-end,
+    /// i.e. 10:00PM-6:00AM
+    #[structopt(long, parse(try_from_str = parse_quiet_hours))]
+    quiet_hours: Option<QuietHours>,
+
+    /// How many recent values of each topic to keep at least,
+    /// the values the trends of the files reach back are kept regardless
+    #[structopt(long, default_value = "1")]
+    history_depth: usize,
+
+    /// How long after connecting aggregates and trends are not ready,
+    /// while the retained values are received, i.e. 2s
+    #[structopt(long, default_value = "0s", parse(try_from_str = parse_duration_flag))]
+    sync_window: Duration,
+
+    /// How long to keep trying to reconnect after the connection to a broker is lost,
+    /// i.e. 5m, before exiting with an error. Defaults to trying forever
+    #[structopt(long, parse(try_from_str = parse_duration_flag))]
+    reconnect_grace: Option<Duration>,
+
+    /// Fail a set of a wildcard path that matches no device, i.e. a typo in the toplevel,
+    /// instead of doing nothing
+    #[structopt(long)]
+    strict: bool,
+
+    /// Limit publishes to the brokers to this many per second, at least 1.
+    /// Without a rate publishes are not limited
+    #[structopt(long, parse(try_from_str = parse_publish_rate))]
+    publish_rate: Option<NonZeroU32>,
+
+    /// Limit how many gets wait for a value at once, the others queue.
+    /// Each when keeps a get waiting, so leave room for every when
+    #[structopt(long)]
+    max_get_concurrency: Option<usize>,
+
     /// Input directory
     #[structopt(
         short,
@@ -22,48 +144,423 @@ struct Opt {
         env = "DAN_DIR"
     )]
     dir: PathBuf,
+
+    /// Evaluate the source once instead of the files in the input directory,
+    /// with - the source is read from stdin, i.e. cat evening.dan | dan -e -
+    #[structopt(short, long)]
+    eval: Option<String>,
+
+    /// Print every update of the path, which may have MQTT wildcards, i.e. +/temp,
+    /// until interrupted instead of running the files in the input directory
+    #[structopt(long)]
+    watch: Option<String>,
+
+    /// Simulate the programs against a JSON file of the values of the devices,
+    /// i.e. {"living/lux": 20}, instead of connecting to a broker.
+    /// The sets the programs would make are printed once they finish.
+    #[structopt(long, parse(from_os_str))]
+    state: Option<PathBuf>,
+
+    /// Accept . as a path separator, i.e. [home.livingroom.light] for home/livingroom/light,
+    /// otherwise a . is part of the topic
+    #[structopt(long)]
+    dotted_paths: bool,
+    /// Print values and errors as JSON lines, syntax errors have the line and column of the error
+    #[structopt(long)]
+    json: bool,
+
+    /// Print the syntax of every statement, or the detail of a single statement, and exit
+    #[structopt(long)]
+    syntax: Option<Option<String>>,
+
+    /// Print the syntax tree of each program as JSON and exit
+    #[structopt(long)]
+    ast: bool,
+
+    /// Print the statements of each program using the path, which may have MQTT wildcards,
+    /// i.e. kitchen/light before renaming it, and exit
+    #[structopt(long)]
+    uses: Option<String>,
+
+    /// Run the programs as tests, reporting every failed assert instead of stopping at the first
+    #[structopt(long)]
+    test: bool,
+
+    /// Format of the logs, text or json
+    #[structopt(long, default_value = "text")]
+    log_format: LogFormat,
+
+    /// Log every MQTT subscribe, publish and received message
+    #[structopt(short, long)]
+    verbose: bool,
 }
 
 const DAN_EXT: &str = "dan";
 
-#[tokio::main]
-async fn main() -> Result<()> {
-    env_logger::init();
+fn parse_route(s: &str) -> Result<(String, String)> {
+    let (toplevel, url) = s
+        .split_once('=')
+        .ok_or_else(|| anyhow!("route must be formatted as toplevel=url"))?;
+    Ok((toplevel.to_string(), url.to_string()))
+}
+
+fn parse_alias(s: &str) -> Result<(String, String)> {
+    let (alias, path) = s
+        .split_once('=')
+        .ok_or_else(|| anyhow!("alias must be formatted as alias=path"))?;
+    if alias.is_empty() || alias.contains(['/', '+', '#']) {
+        return Err(anyhow!(
+            "alias {} must be a single level without wildcards",
+            alias
+        ));
+    }
+    Ok((alias.to_string(), path.to_string()))
+}
+
+fn parse_quiet_hours(s: &str) -> Result<QuietHours> {
+    let (start, end) = s
+        .split_once('-')
+        .ok_or_else(|| anyhow!("quiet hours must be formatted as start-end"))?;
+    let hm = |t: &str| match parse_time(t).map_err(|err| anyhow!("{}", err))? {
+        TimeOfDay::HM(h, m) => Ok((h, m)),
+        t => Err(anyhow!("quiet hours cannot start or end at {}", t)),
+    };
+    Ok(QuietHours::new(hm(start)?, hm(end)?))
+}
+
+fn parse_time_zone(s: &str) -> Result<Tz> {
+    s.parse().map_err(|_| {
+        anyhow!(
+            "unknown time zone {}, it must be an IANA name i.e. America/Denver",
+            s
+        )
+    })
+}
 
-    let opt = Opt::from_args();
+fn parse_location(s: &str) -> Result<Location> {
+    let (latitude, longitude) = s
+        .split_once(',')
+        .ok_or_else(|| anyhow!("location must be formatted as latitude,longitude"))?;
+    let degrees = |d: &str, max: f64| match d.trim().parse::<f64>() {
+        Ok(d) if (-max..=max).contains(&d) => Ok(d),
+        _ => Err(anyhow!(
+            "{} must be a number of degrees from -{} to {}",
+            d,
+            max,
+            max
+        )),
+    };
+    Ok(Location {
+        latitude: degrees(latitude, 90.0)?,
+        longitude: degrees(longitude, 180.0)?,
+    })
+}
+
+fn parse_duration_flag(s: &str) -> Result<Duration> {
+    parse_duration(s).map_err(|err| anyhow!("{}", err))
+}
+
+fn parse_publish_rate(s: &str) -> Result<NonZeroU32> {
+    NonZeroU32::new(s.parse()?).ok_or_else(|| {
+        anyhow!("publish rate must be at least 1 per second, leave it out to not limit publishes")
+    })
+}
+
+/// Parses the command line along with the flags of the config file, if any.
+fn options() -> Result<Opt> {
+    let mut args: Vec<OsString> = std::env::args_os().collect();
+    let matches = Opt::clap().get_matches_from(&args);
+    let opt = Opt::from_clap(&matches);
+    let path = match &opt.config {
+        Some(path) => path,
+        None => return Ok(opt),
+    };
+    let config = fs::read_to_string(path)
+        .map_err(|err| anyhow!("reading config {}: {}", path.display(), err))?;
+    let flags = config::args(&config, |flag| matches.occurrences_of(flag) > 0)?;
+    // The flags of the file go before the flags of the command line.
+    args.splice(1..1, flags.into_iter().map(OsString::from));
+    Ok(Opt::from_iter(args))
+}
+
+#[tokio::main]
+async fn main() -> Result<ExitCode> {
+    let opt = options()?;
+    let mut logger = env_logger::Builder::from_default_env();
+    if opt.verbose {
+        logger.filter_module("dan::mqtt_engine", log::LevelFilter::Trace);
+    }
+    if opt.log_format == LogFormat::Json {
+        logger.format(|buf, record| {
+            let mut line = logging::json(record);
+            line["time"] = buf.timestamp().to_string().into();
+            writeln!(buf, "{}", line)
+        });
+    }
+    logging::set_format(opt.log_format);
+    logger.init();
     log::debug!("options {:?}", opt);
 
-    let mqtt = MQTTEngine::new(&opt.mqtt_url)?;
-    let (shutdown_tx, shutdown_rx) = broadcast::channel(1);
+    if let Some(keyword) = &opt.syntax {
+        return print_syntax(keyword.as_deref()).map(|_| ExitCode::SUCCESS);
+    }
 
-    let mut join_set = JoinSet::new();
+    let json = opt.json;
+    match run(opt).await {
+        // The JSON line is the report of the error, so it is not returned to be reported again.
+        Err(err) if json => {
+            println!("{}", error_json(&err));
+            Ok(ExitCode::FAILURE)
+        }
+        res => res.map(|_| ExitCode::SUCCESS),
+    }
+}
 
-    for entry in fs::read_dir(opt.dir)? {
-        let entry = entry?;
-        if entry.path().is_file() {
-            if let Some(ext) = entry.path().extension() {
-                if ext == DAN_EXT {
-                    let source = fs::read_to_string(entry.path())?;
-                    let mqtt = mqtt.clone();
-                    let shutdown_rx = shutdown_rx.resubscribe();
-                    let path = entry.path().clone();
-                    join_set.spawn(async move {
-                        log::debug!("running file: {}", path.display());
-                        let code = Interpreter::from_source(&source)?;
-                        log::debug!("code: {:?}", code);
-                        let vm = VM::new(mqtt);
-                        vm.run(code, shutdown_rx).await?;
-                        log::debug!("finished file: {} ", path.display());
-                        Ok(()) as Result<()>
+/// Formats the error as a JSON object, a syntax error also has the position
+/// of the offending token and the position just after it.
+fn error_json(err: &anyhow::Error) -> serde_json::Value {
+    let mut json = serde_json::json!({ "error": err.to_string() });
+    if let Some(err) = err.downcast_ref::<SyntaxError>() {
+        json["position"] = serde_json::json!(err.start);
+        json["end"] = serde_json::json!(err.end);
+    }
+    json
+}
+
+async fn run(opt: Opt) -> Result<()> {
+    let output = if opt.json { Output::Json } else { Output::Text };
+    let sources = if opt.watch.is_some() {
+        Vec::new()
+    } else if let Some(source) = &opt.eval {
+        vec![(PathBuf::from("-e"), eval_source(source, std::io::stdin())?)]
+    } else {
+        read_sources(&opt.dir)?
+    };
+    if opt.ast {
+        for (path, source) in sources {
+            println!("{}", ast_json(&source, &path, opt.dotted_paths)?);
+        }
+        return Ok(());
+    }
+    if let Some(used) = &opt.uses {
+        for (path, source) in sources {
+            let ast = loader::load_source(&source, &path, opt.dotted_paths)?;
+            for stmt in loader::uses(&ast, used) {
+                println!("{}: {:?}", path.display(), stmt);
+            }
+        }
+        return Ok(());
+    }
+    let failures = Arc::new(AtomicUsize::new(0));
+    let programs = Programs {
+        sources,
+        aliases: opt.aliases.iter().cloned().collect(),
+        output,
+        test: opt.test,
+        max_scenes: opt.max_scenes,
+        publish_json: opt.publish_json,
+        quiet_hours: opt.quiet_hours,
+        time_zone: opt.time_zone,
+        location: opt.location,
+        dotted_paths: opt.dotted_paths,
+        failures: failures.clone(),
+    };
+    if let Some(state) = &opt.state {
+        simulate(programs, state).await?;
+    } else {
+        connect(programs, opt).await?;
+    }
+    let failures = failures.load(Ordering::SeqCst);
+    if failures > 0 {
+        return Err(anyhow!("{} assertions failed", failures));
+    }
+    Ok(())
+}
+
+/// Programs holds the sources to run and how to run them.
+struct Programs {
+    sources: Vec<(PathBuf, String)>,
+    aliases: BTreeMap<String, String>,
+    output: Output,
+    test: bool,
+    max_scenes: Option<usize>,
+    publish_json: bool,
+    quiet_hours: Option<QuietHours>,
+    time_zone: Option<Tz>,
+    location: Option<Location>,
+    dotted_paths: bool,
+    failures: Arc<AtomicUsize>,
+}
+
+impl Programs {
+    /// Returns how far back the trends of the programs reach, see Code::history_window.
+    fn history_window(&self) -> Result<Option<Duration>> {
+        let mut window = None;
+        for (path, source) in &self.sources {
+            let ast = loader::load_source(source, path, self.dotted_paths)?;
+            window = window.max(Interpreter::from_ast(ast).history_window());
+        }
+        Ok(window)
+    }
+    /// Runs each program in a task of the join set.
+    fn spawn<E: Engine + 'static>(
+        self,
+        engine: E,
+        shutdown_rx: &broadcast::Receiver<()>,
+    ) -> JoinSet<Result<()>> {
+        let mut join_set = JoinSet::new();
+        let engine = Aliases::new(engine, self.aliases);
+        for (path, source) in self.sources {
+            let engine = engine.clone();
+            let shutdown_rx = shutdown_rx.resubscribe();
+            let failures = self.failures.clone();
+            let (output, test, max_scenes) = (self.output, self.test, self.max_scenes);
+            let (publish_json, quiet_hours) = (self.publish_json, self.quiet_hours);
+            let (time_zone, location) = (self.time_zone, self.location);
+            let dotted_paths = self.dotted_paths;
+            join_set.spawn(async move {
+                log::debug!("running file: {}", path.display());
+                let ast = loader::load_source(&source, &path, dotted_paths)?;
+                let code = Interpreter::from_ast(ast);
+                log::debug!("code: {:?}", code);
+                let mut vm = VM::with_output(engine, output);
+                if let Some(max) = max_scenes {
+                    vm = vm.with_max_scenes(max);
+                }
+                if publish_json {
+                    vm = vm.with_formatter(|v| Ok(serde_json::to_vec(&v)?));
+                }
+                if let Some(quiet) = quiet_hours {
+                    vm = vm.with_quiet_hours(quiet);
+                }
+                if let Some(tz) = time_zone {
+                    vm = vm.with_time_zone(tz);
+                }
+                if let Some(location) = location {
+                    vm = vm.with_location(location);
+                }
+                if let Err(err) = vm.run(code, shutdown_rx).await {
+                    let failed = match err.downcast_ref::<AssertionFailed>() {
+                        Some(failed) => failed,
+                        None => return Err(err),
+                    };
+                    let location = failed.location.clone().unwrap_or_else(|| {
+                        format!(
+                            "{}:{}",
+                            path.display(),
+                            loader::line(&source, failed.offset)
+                        )
                     });
+                    let msg = format!("{}: {}", location, failed);
+                    if !test {
+                        return Err(anyhow!("{}", msg));
+                    }
+                    println!("{}", msg);
+                    failures.fetch_add(1, Ordering::SeqCst);
                 }
-            }
+                log::debug!("finished file: {} ", path.display());
+                Ok(()) as Result<()>
+            });
         }
+        join_set
     }
+}
 
+/// Runs the programs against the snapshot of the values of the devices in the file,
+/// then prints the sets they made.
+/// Programs with whens keep waiting for values until interrupted.
+async fn simulate(programs: Programs, state: &Path) -> Result<()> {
+    let snapshot = Snapshot::from_json(&fs::read_to_string(state)?)?;
+    let (shutdown_tx, shutdown_rx) = broadcast::channel(1);
+    let mut join_set = programs.spawn(snapshot.clone(), &shutdown_rx);
+    loop {
+        select! {
+            sig = signal::ctrl_c() => {
+                sig?;
+                shutdown_tx.send(())?;
+                break;
+            }
+            res = join_set.join_next() => {
+                if let Some(res) = res {
+                    res??;
+                } else {
+                    break;
+                }
+            }
+        };
+    }
+    while let Some(res) = join_set.join_next().await {
+        res??;
+    }
+    for (path, value) in snapshot.sets() {
+        println!("set {} {}", path, String::from_utf8_lossy(&value));
+    }
+    Ok(())
+}
+
+/// Runs the programs against the MQTT brokers.
+async fn connect(programs: Programs, opt: Opt) -> Result<()> {
+    let client_id = match (opt.client_id, opt.unique_client_id) {
+        (Some(id), true) => Some(mqtt_engine::unique_client_id(&id)),
+        (None, true) => Some(mqtt_engine::unique_client_id("dan")),
+        (id, false) => id,
+    };
+    let options = Options {
+        client_id,
+        history_depth: opt.history_depth,
+        history_window: programs.history_window()?,
+        sync_window: opt.sync_window,
+        prefix: opt.prefix,
+        reconnect_grace: opt.reconnect_grace,
+        strict: opt.strict,
+        ..Default::default()
+    };
+    let mqtt = MQTTEngine::with_options(&opt.mqtt_url, options.clone())?;
+    let mut engines = vec![mqtt.clone()];
+    let mut routes = BTreeMap::new();
+    for (toplevel, url) in opt.routes {
+        let engine = MQTTEngine::with_options(&url, options.clone())?;
+        engines.push(engine.clone());
+        routes.insert(toplevel, engine);
+    }
+    let mut router = Limiter::new(Router::new(routes, Some(mqtt)), opt.publish_rate);
+    if let Some(max) = opt.max_get_concurrency {
+        router = router.with_max_gets(max);
+    }
+    let (shutdown_tx, shutdown_rx) = broadcast::channel(1);
+
+    let mut join_set = programs.spawn(router.clone(), &shutdown_rx);
+    if let Some(path) = opt.watch {
+        let (router, mut shutdown_rx) = (router.clone(), shutdown_rx.resubscribe());
+        let changes = engines.iter().map(|mqtt| mqtt.changes()).collect();
+        join_set.spawn(async move {
+            select! {
+                res = watch(&router, changes, &path) => res,
+                _ = shutdown_rx.recv() => Ok(()),
+            }
+        });
+    }
+
+    // SIGUSR1 disconnects from the brokers and SIGUSR2 reconnects, i.e. for broker maintenance.
+    let mut disconnect = unix_signal(SignalKind::user_defined1())?;
+    let mut reconnect = unix_signal(SignalKind::user_defined2())?;
     // Wait for user supplied signal or for the program to run to completion.
     loop {
         select! {
+            _ = disconnect.recv() => {
+                for mqtt in &engines {
+                    if let Err(err) = mqtt.disconnect().await {
+                        log::warn!("disconnecting failed: {}", err);
+                    }
+                }
+            }
+            _ = reconnect.recv() => {
+                for mqtt in &engines {
+                    if let Err(err) = mqtt.reconnect().await {
+                        log::warn!("reconnecting failed: {}", err);
+                    }
+                }
+            }
             // Wait for shutdown signal
             sig = signal::ctrl_c() => {
                 sig?;
@@ -71,6 +568,11 @@ async fn main() -> Result<()> {
                 shutdown_tx.send(())?;
                 break;
             }
+            // Stop when an engine gives up on its broker, i.e. after the reconnect grace
+            err = failed(&engines) => {
+                shutdown_tx.send(())?;
+                return Err(err);
+            }
             // Wait for task and error it any task encounters an error
             res = join_set.join_next() => {
                 if let Some(res) = res {
@@ -88,10 +590,159 @@ async fn main() -> Result<()> {
     }
 
     // Cleanup mqtt
-    if let Ok(mqtt) = Arc::try_unwrap(mqtt) {
-        mqtt.shutdown().await?;
-        Ok(())
-    } else {
-        Err(anyhow!("not all threads stopped"))
+    drop(router);
+    for mqtt in engines {
+        mqtt.close().await?;
+    }
+    Ok(())
+}
+
+/// Waits until any of the engines stops on its own and returns why.
+async fn failed(engines: &[Arc<MQTTEngine>]) -> anyhow::Error {
+    let failures = engines.iter().map(|mqtt| Box::pin(mqtt.failed()));
+    future::select_all(failures).await.0
+}
+
+/// Prints the syntax of the statement or of all statements.
+fn print_syntax(keyword: Option<&str>) -> Result<()> {
+    match keyword {
+        Some(keyword) => {
+            let s =
+                help::statement(keyword).ok_or_else(|| anyhow!("unknown statement {}", keyword))?;
+            println!("{}\n\n    {}", s.detail, s.example);
+        }
+        None => {
+            for s in help::STATEMENTS {
+                println!("{:<8} {}", s.keyword, s.example);
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Loads the source and serializes its AST as JSON, for --ast.
+fn ast_json(source: &str, path: &Path, dotted: bool) -> Result<String> {
+    let ast = loader::load_source(source, path, dotted)?;
+    Ok(serde_json::to_string(&ast)?)
+}
+
+/// Returns the source to evaluate, reading all of stdin when the source is -.
+fn eval_source(source: &str, mut stdin: impl Read) -> Result<String> {
+    if source != "-" {
+        return Ok(source.to_string());
+    }
+    let mut source = String::new();
+    stdin.read_to_string(&mut source)?;
+    Ok(source)
+}
+
+/// Reads the source of each dan file in the directory.
+fn read_sources(dir: &Path) -> Result<Vec<(PathBuf, String)>> {
+    let mut sources = Vec::new();
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        if entry.path().is_file() {
+            if let Some(ext) = entry.path().extension() {
+                if ext == DAN_EXT {
+                    sources.push((entry.path(), fs::read_to_string(entry.path())?));
+                }
+            }
+        }
+    }
+    Ok(sources)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Evaluates the source like -e against a snapshot of the state, see simulate.
+    async fn eval_with_state(name: &str, state: &str, source: &str) -> Result<()> {
+        let path = std::env::temp_dir().join(format!("dan-cli-{}.json", name));
+        fs::write(&path, state).unwrap();
+        let programs = Programs {
+            sources: vec![(PathBuf::from("-e"), eval_source(source, std::io::empty())?)],
+            aliases: BTreeMap::new(),
+            output: Output::Text,
+            test: false,
+            max_scenes: None,
+            publish_json: false,
+            quiet_hours: None,
+            time_zone: None,
+            location: None,
+            dotted_paths: false,
+            failures: Arc::new(AtomicUsize::new(0)),
+        };
+        simulate(programs, &path).await
+    }
+    #[tokio::test]
+    async fn test_eval() {
+        let state = r#"{"hall/temp": 21}"#;
+        eval_with_state("eval", state, "assert <hall/temp> is 21;")
+            .await
+            .unwrap();
+        let err = eval_with_state("eval-failed", state, "assert <hall/temp> is 20;")
+            .await
+            .unwrap_err();
+        assert_eq!("-e:1: assertion failed", err.to_string());
+    }
+    #[test]
+    fn test_eval_source() {
+        let stdin = "print 1;\nprint 2;\n".as_bytes();
+        assert_eq!("print 1;\nprint 2;\n", eval_source("-", stdin).unwrap());
+        assert_eq!("print 3;", eval_source("print 3;", stdin).unwrap());
+    }
+    #[test]
+    fn test_ast_json() {
+        let source = "when <hall/motion> is \"on\" set [hall/light] \"on\";";
+        let json = ast_json(source, Path::new("-e"), false).unwrap();
+        assert_eq!(
+            dan::parse(source).unwrap(),
+            serde_json::from_str::<dan::ast::Stmt>(&json).unwrap()
+        );
+    }
+    #[test]
+    fn test_error_json() {
+        let err = dan::parse("print 1;\nprint );").unwrap_err();
+        assert_eq!(
+            serde_json::json!({
+                "error": err.to_string(),
+                "position": { "line": 2, "column": 7 },
+                "end": { "line": 2, "column": 8 },
+            }),
+            error_json(&err)
+        );
+        assert_eq!(
+            serde_json::json!({ "error": "no files" }),
+            error_json(&anyhow!("no files"))
+        );
+    }
+    #[test]
+    fn test_parse_time_zone() {
+        assert_eq!(
+            chrono_tz::America::Denver,
+            parse_time_zone("America/Denver").unwrap()
+        );
+        // A typo is an error instead of falling back to UTC.
+        assert!(parse_time_zone("America/Denvr").is_err());
+    }
+    #[test]
+    fn test_parse_location() {
+        assert_eq!(
+            Location {
+                latitude: 39.74,
+                longitude: -104.99
+            },
+            parse_location("39.74,-104.99").unwrap()
+        );
+        assert!(parse_location("39.74").is_err());
+        assert!(parse_location("139.74,-104.99").is_err());
+        assert!(parse_location("north,west").is_err());
+    }
+    #[test]
+    fn test_parse_publish_rate() {
+        assert_eq!(NonZeroU32::new(10), parse_publish_rate("10").ok());
+        assert!(parse_publish_rate("0").is_err());
+        assert!(parse_publish_rate("fast").is_err());
     }
 }
@@ -1,4 +1,6 @@
-use crate::ast::{BinaryOpcode, Expr, Stmt};
+use crate::ast::{
+    Aggregate, BinaryOpcode, Expr, Guard, Range, SceneOption, Stmt, Trend, WhenOption,
+};
 use crate::Compile;
 use anyhow::anyhow;
 use serde::Serialize;
@@ -20,7 +22,11 @@ pub enum Value {
     Integer(i64),
     Bool(bool),
     Object(BTreeMap<String, Value>),
+    List(Vec<Value>),
     Jump(usize),
+    // Unknown is distinct from every value a device publishes,
+    // so a device that never published can be told apart.
+    Unknown,
 }
 
 impl Display for Value {
@@ -34,20 +40,61 @@ impl Display for Value {
             Value::Integer(i) => write!(f, "{}", i),
             Value::Bool(b) => write!(f, "{}", b),
             Value::Jump(ip) => write!(f, "jmp: {:?}", ip),
-            Value::Object(props) => {
-                write!(f, "{{")?;
-                for (i, (k, v)) in props.iter().enumerate() {
-                    if i > 0 {
-                        write!(f, ", ")?;
-                    }
-                    write!(f, "{}: {}", k, v)?;
-                }
-                write!(f, "}}")
+            Value::Unknown => f.write_str("<unknown>"),
+            // Objects and lists are written as compact JSON, keys are sorted by the BTreeMap.
+            Value::Object(_) | Value::List(_) => {
+                f.write_str(&serde_json::to_string(self).map_err(|_| std::fmt::Error)?)
+            }
+        }
+    }
+}
+
+impl Value {
+    /// Reports whether the values are equal.
+    /// Integers and floats are compared numerically
+    /// and a string is compared to a number using the string form of the number,
+    /// since devices may publish numbers either as JSON numbers or strings.
+    /// Likewise a boolean equals the number 1 or 0 and a string naming it, see switch,
+    /// so a device publishing true matches is "on".
+    pub fn equals(&self, other: &Value) -> bool {
+        match (self, other) {
+            (Value::Str(s), Value::Bool(b)) | (Value::Bool(b), Value::Str(s)) => {
+                switch(s) == Some(*b)
+            }
+            (Value::Integer(i), Value::Float(f)) | (Value::Float(f), Value::Integer(i)) => {
+                *i as f64 == *f
             }
+            (Value::Str(s), n @ (Value::Integer(_) | Value::Float(_)))
+            | (n @ (Value::Integer(_) | Value::Float(_)), Value::Str(s)) => *s == n.to_string(),
+            (Value::Bool(b), n @ (Value::Integer(_) | Value::Float(_)))
+            | (n @ (Value::Integer(_) | Value::Float(_)), Value::Bool(b)) => {
+                n.number() == Some(if *b { 1.0 } else { 0.0 })
+            }
+            _ => self == other,
+        }
+    }
+    /// Reports the value as a number,
+    /// strings holding a number are numbers for the same reason as in equals.
+    pub fn number(&self) -> Option<f64> {
+        match self {
+            Value::Integer(i) => Some(*i as f64),
+            Value::Float(f) => Some(*f),
+            Value::Str(s) => s.parse().ok(),
+            _ => None,
         }
     }
 }
 
+/// Reads a string as the state of a switch, ignoring case,
+/// true, on, yes and 1 are true and false, off, no and 0 are false.
+fn switch(s: &str) -> Option<bool> {
+    match s.to_ascii_lowercase().as_str() {
+        "true" | "on" | "yes" | "1" => Some(true),
+        "false" | "off" | "no" | "0" => Some(false),
+        _ => None,
+    }
+}
+
 impl TryFrom<Value> for String {
     type Error = anyhow::Error;
 
@@ -62,29 +109,37 @@ impl TryFrom<Value> for String {
 impl TryFrom<Value> for Vec<u8> {
     type Error = anyhow::Error;
 
+    /// Converts a value to an MQTT payload, durations and times have no payload
+    /// a device would understand so they are an error.
     fn try_from(value: Value) -> std::result::Result<Self, Self::Error> {
         match value {
             Value::Str(s) => Ok(s.as_bytes().to_vec()),
             Value::Path(s) => Ok(s.as_bytes().to_vec()),
-            Value::Duration(_) => todo!(),
-            Value::Time(_) => todo!(),
+            Value::Duration(_) | Value::Time(_) | Value::Jump(_) => {
+                Err(anyhow!("value {} cannot be sent to a device", value))
+            }
             Value::Float(f) => Ok(f.to_string().as_bytes().to_vec()),
             Value::Integer(i) => Ok(i.to_string().as_bytes().to_vec()),
-            Value::Bool(_) => todo!(),
-            Value::Jump(_) => todo!(),
+            Value::Bool(b) => Ok(b.to_string().into_bytes()),
+            Value::Unknown => Ok(value.to_string().into_bytes()),
             Value::Object(props) => {
                 let json = serde_json::to_vec(&props)?;
                 Ok(json)
             }
+            Value::List(items) => Ok(serde_json::to_vec(&items)?),
         }
     }
 }
 impl TryFrom<&[u8]> for Value {
     type Error = anyhow::Error;
 
+    /// Converts an MQTT payload to a value.
+    /// An empty payload, which clears a retained topic, has no value and converts to an empty string,
+    /// the MQTT engine does not deliver empty payloads to gets.
     fn try_from(value: &[u8]) -> Result<Self, Self::Error> {
-        let v: serde_json::Value = serde_json::from_slice(value)?;
-        if let Some(v) = json_to_value(v) {
+        // Payloads that are not JSON, i.e. a bare on, are treated as strings.
+        let v = serde_json::from_slice(value).ok().and_then(json_to_value);
+        if let Some(v) = v {
             Ok(v)
         } else {
             Ok(Value::Str(String::from_utf8(value.to_vec())?))
@@ -105,7 +160,11 @@ fn json_to_value(v: serde_json::Value) -> Option<Value> {
         }
         serde_json::Value::String(s) => Some(Value::Str(s)),
         serde_json::Value::Null => None,
-        serde_json::Value::Array(_) => None,
+        serde_json::Value::Array(jitems) => jitems
+            .into_iter()
+            .map(json_to_value)
+            .collect::<Option<Vec<Value>>>()
+            .map(Value::List),
         serde_json::Value::Object(jprops) => {
             let mut props = BTreeMap::<String, Value>::new();
             for (k, jv) in jprops {
@@ -126,46 +185,12 @@ impl TryFrom<Expr> for Value {
     fn try_from(value: Expr) -> std::result::Result<Self, Self::Error> {
         match value {
             Expr::String(s) => Ok(Self::Str(s)),
-            Expr::Duration(d) => {
-                let s = d.strip_suffix("s").unwrap();
-                let duration = Duration::from_secs(s.parse().unwrap());
-                Ok(Value::Duration(duration))
-            }
-            Expr::Time(t) => match t.as_str() {
-                "sunrise" => Ok(Value::Time(TimeOfDay::Sunrise)),
-                "sunset" => Ok(Value::Time(TimeOfDay::Sunset)),
-                _ => {
-                    let mut hours = 0;
-                    let time = if let Some(time) = t.strip_suffix("PM") {
-                        hours += 12;
-                        time
-                    } else if let Some(time) = t.strip_suffix("PM") {
-                        time
-                    } else {
-                        panic!("parser failed to enforce AM/PM ending to time")
-                    };
-                    let parts: Vec<&str> = time.split(":").collect();
-                    if parts.len() != 2 {
-                        panic!("parser failed to HH:MM time format")
-                    }
-                    let h: u32 = parts
-                        .first()
-                        .unwrap()
-                        .parse()
-                        .expect("parser failed to enforce integer hours");
-                    if h == hours {
-                        // 12PM is noon
-                        hours = 0;
-                    }
-                    let m: u32 = parts
-                        .last()
-                        .unwrap()
-                        .parse()
-                        .expect("parser failed to enforce integer minutes");
-
-                    Ok(Value::Time(TimeOfDay::HM(hours + h, m)))
-                }
-            },
+            Expr::Duration(d) => Ok(Value::Duration(
+                parse_duration(&d).map_err(|err| anyhow!("{}", err))?,
+            )),
+            Expr::Time(t) => Ok(Value::Time(
+                parse_time(&t).map_err(|err| anyhow!("{}", err))?,
+            )),
             Expr::Float(n) => Ok(Value::Float(n)),
             Expr::Integer(n) => Ok(Value::Integer(n)),
             Expr::Object(props) => {
@@ -187,16 +212,88 @@ pub enum TimeOfDay {
     HM(u32, u32),
 }
 
+/// Formats the time as a literal, i.e. 10:05PM, which parses back to the same time.
 impl Display for TimeOfDay {
     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
         match self {
-            TimeOfDay::Sunrise => f.write_str("sunrise"),
-            TimeOfDay::Sunset => f.write_str("sunset"),
-            TimeOfDay::HM(h, m) => write!(f, "{}:{}", h, m),
+            TimeOfDay::Sunrise => f.write_str("#sunrise"),
+            TimeOfDay::Sunset => f.write_str("#sunset"),
+            TimeOfDay::HM(h, m) => {
+                let (h, pm) = clock_hour(*h);
+                write!(f, "{}:{:02}{}", h, m, if pm { "PM" } else { "AM" })
+            }
         }
     }
 }
 
+/// Converts an hour of a 12-hour clock to the hour of the day,
+/// 12AM is midnight and 12PM is noon.
+pub fn hour_of_day(h: u32, pm: bool) -> u32 {
+    h % 12 + if pm { 12 } else { 0 }
+}
+
+/// Converts the hour of the day to an hour of a 12-hour clock and whether it is PM,
+/// the inverse of hour_of_day.
+pub fn clock_hour(h: u32) -> (u32, bool) {
+    let clock = if h % 12 == 0 { 12 } else { h % 12 };
+    (clock, h >= 12)
+}
+
+/// Parses a duration literal, i.e. 30s, 5m or 2h.
+/// The parser uses this to reject durations that are not valid.
+pub fn parse_duration(d: &str) -> Result<Duration, &'static str> {
+    let (n, unit) = d.split_at(d.find(|c: char| !c.is_ascii_digit()).unwrap_or(d.len()));
+    let millis = match unit {
+        "ms" => 1,
+        "s" => 1000,
+        "m" => 60 * 1000,
+        "h" => 60 * 60 * 1000,
+        _ => return Err("duration unit must be ms, s, m or h"),
+    };
+    if n.is_empty() {
+        return Err("duration must start with a number");
+    }
+    n.parse::<u64>()
+        .ok()
+        .and_then(|n| n.checked_mul(millis))
+        .map(Duration::from_millis)
+        .ok_or("duration is too big")
+}
+
+/// Parses a time of day literal, i.e. 10:30PM, #sunrise, #sunset, #noon or #midnight.
+/// The parser uses this to reject times that are not valid.
+pub fn parse_time(t: &str) -> Result<TimeOfDay, &'static str> {
+    match t {
+        "#sunrise" => return Ok(TimeOfDay::Sunrise),
+        "#sunset" => return Ok(TimeOfDay::Sunset),
+        "#noon" => return Ok(TimeOfDay::HM(12, 0)),
+        "#midnight" => return Ok(TimeOfDay::HM(0, 0)),
+        _ => {}
+    }
+    let (time, pm) = if let Some(time) = t.strip_suffix("PM") {
+        (time, true)
+    } else if let Some(time) = t.strip_suffix("AM") {
+        (time, false)
+    } else {
+        return Err("time must end with AM or PM");
+    };
+    let (h, m) = time
+        .split_once(':')
+        .ok_or("time must be formatted as HH:MM")?;
+    // The lexer only allows digits, so a number that does not parse is too big.
+    let h: u32 = h
+        .parse()
+        .ok()
+        .filter(|h| (1..=12).contains(h))
+        .ok_or("time hours must be between 1 and 12")?;
+    let m: u32 = m
+        .parse()
+        .ok()
+        .filter(|m| *m <= 59)
+        .ok_or("time minutes must be between 0 and 59")?;
+    Ok(TimeOfDay::HM(hour_of_day(h, pm), m))
+}
+
 #[derive(Debug, Clone, PartialEq)]
 pub enum Instruction {
     Constant(usize),
@@ -207,17 +304,85 @@ pub enum Instruction {
     Spawn(usize),
     Jump(usize),
     JmpNot(usize),
+    Cooldown(usize),
+    // Breaker pops how long the breaker stays open, the window and the number of firings,
+    // and jumps back to the start of the when while the breaker is open.
+    Breaker(usize),
+    Changed(usize),
+    // Debounce pops a duration and jumps back to wait for the next value of the when,
+    // the when continues with the next instruction once no value fired it for the duration.
+    Debounce(usize),
+    // Assert pops the condition and fails with the offset and location of the statement.
+    Assert(usize, Option<String>),
     Call,
     Return,
     Term,
     Wait,
+    Deadline,
+    ClearDeadline,
     At,
-    Set,
+    // Guard pops a time and pushes whether the time of day is after or before it.
+    Guard(Guard),
+    // Redefine pops the name of a scene and stops it if it is running,
+    // otherwise it jumps past starting the new definition.
+    Redefine(usize),
+    // Schedule pops the time of the next spawned at, so that it can be stopped.
+    Schedule,
+    // Repeat pops how many times an at runs, the first time it runs,
+    // and jumps to the end of the at once it ran that many times.
+    Repeat(usize),
+    // Set pops a value and a path and sets the path,
+    // unless it is quiet hours and the set is not urgent.
+    Set(bool),
+    Publish,
+    Clear,
     Stop,
+    Watch,
+    StopWhen,
+    StopAt,
     SceneContext,
+    Enable,
+    Disable,
+    Disabled(usize),
     Get,
+    GetLive,
+    // GetWithin gives up waiting for a value after a timeout,
+    // using the default value when there is one.
+    GetWithin(bool),
+    Aggregate(Aggregate),
+    Triggered,
+    Trigger,
+    TriggerPath,
+    // Seen keeps the value read by the condition of a when, for $prev.
+    Seen,
+    Previous,
     Equal,
+    Greater,
+    Less,
+    And,
+    // Latest pops the paths of an all-of when and waits for a value of any of them,
+    // the gets of the when then answer with the latest value of each path.
+    Latest(usize, bool),
+    // Edge pops the condition of an all-of when and jumps unless it became true,
+    // the when fires again only once the condition was false.
+    Edge(usize),
+    Range(Range),
+    Trend(Trend),
+    Change(Trend),
+    Hysteresis(usize, Band),
     Index,
+    // Object pops the given number of property names and values and pushes the object.
+    Object(usize),
+}
+
+/// Band describes where the condition of a when with hysteresis is true,
+/// so that the value can be checked to have moved back past the band.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Band {
+    Above,
+    Below,
+    Inside,
+    Outside,
 }
 
 #[derive(Debug, PartialEq)]
@@ -233,6 +398,27 @@ impl Code {
             constants: Vec::new(),
         }
     }
+    /// Returns how far back the history of a path must reach for the trends of the code,
+    /// the longest window of a change or zero when the trends only compare the last two values.
+    /// A window that is not a literal duration is not known until the code runs and counts as zero.
+    /// Without trends the code needs no history.
+    pub fn history_window(&self) -> Option<Duration> {
+        self.instructions
+            .iter()
+            .enumerate()
+            .filter_map(|(i, instruction)| match instruction {
+                Instruction::Trend(_) => Some(Duration::ZERO),
+                Instruction::Change(_) => match &self.instructions[i - 1] {
+                    Instruction::Constant(c) => match self.constants[*c] {
+                        Value::Duration(window) => Some(window),
+                        _ => Some(Duration::ZERO),
+                    },
+                    _ => Some(Duration::ZERO),
+                },
+                _ => None,
+            })
+            .max()
+    }
 }
 
 struct Env<'a> {
@@ -269,19 +455,90 @@ impl<'a> Env<'a> {
 
 pub struct Interpreter {
     code: Code,
+    // Whether the paths of the expression being compiled ignore retained values.
+    live: bool,
 }
 
 impl Compile for Interpreter {
     type Output = Code;
 
     fn from_ast(ast: Stmt) -> Self::Output {
-        let mut interpreter = Interpreter { code: Code::new() };
+        let mut interpreter = Interpreter {
+            code: Code::new(),
+            live: false,
+        };
         interpreter.interpret_stmt(&mut Env::new(), ast);
         interpreter.add_instruction(Instruction::Term);
         interpreter.code
     }
 }
 
+/// Returns only the reactive statements, i.e. when and at rules,
+/// along with any bindings they may depend on.
+/// Statements that act immediately, such as set and print, are removed.
+fn reactive(stmt: Stmt) -> Option<Stmt> {
+    match stmt {
+        Stmt::Block(stmts) => Some(Stmt::Block(
+            stmts.into_iter().filter_map(reactive).collect(),
+        )),
+        Stmt::When(_, _, _) | Stmt::At(_, _, _) | Stmt::Let(_, _) => Some(stmt),
+        _ => None,
+    }
+}
+
+/// Returns the paths read by the expression.
+fn paths(expr: &Expr) -> Vec<String> {
+    match expr {
+        Expr::Path(p)
+        | Expr::Aggregate(_, p)
+        | Expr::Trend(p, _)
+        | Expr::Change(p, _, _, _)
+        | Expr::Within(p, _, _) => vec![p.clone()],
+        Expr::Binary(l, _, r) | Expr::As(l, _, r) => {
+            let mut ps = paths(l);
+            ps.extend(paths(r));
+            ps
+        }
+        Expr::Range(e, _, lo, hi) => [e, lo, hi].iter().flat_map(|e| paths(e)).collect(),
+        Expr::Index(e, _) => paths(e),
+        Expr::Object(props) => props.iter().flat_map(|(_, e)| paths(e)).collect(),
+        _ => Vec::new(),
+    }
+}
+
+/// Moves the reactive statements of a block before the statements that act on the devices,
+/// i.e. set and print, so that a scene has started its when and at rules
+/// before it sets anything that may trigger them.
+/// Other statements stay in place and a reactive statement does not move before them,
+/// since a binding may be used by it and a statement such as stop when or start
+/// controls the rules and scenes in the order they are written.
+fn reactive_first(stmt: Stmt) -> Stmt {
+    match stmt {
+        Stmt::Block(stmts) => {
+            let mut ordered: Vec<Stmt> = Vec::with_capacity(stmts.len());
+            // Where the next reactive statement goes, after the last statement it may not pass.
+            let mut reactive_at = 0;
+            for s in stmts {
+                match s {
+                    Stmt::When(_, _, _) | Stmt::At(_, _, _) => {
+                        ordered.insert(reactive_at, s);
+                        reactive_at += 1;
+                    }
+                    Stmt::Set(_, _, _) | Stmt::Publish(_, _) | Stmt::Clear(_) | Stmt::Print(_) => {
+                        ordered.push(s)
+                    }
+                    _ => {
+                        ordered.push(s);
+                        reactive_at = ordered.len();
+                    }
+                }
+            }
+            Stmt::Block(ordered)
+        }
+        _ => stmt,
+    }
+}
+
 impl Interpreter {
     fn add_constant(&mut self, value: Value) -> usize {
         self.code.constants.push(value);
@@ -314,16 +571,97 @@ impl Interpreter {
                     self.add_instruction(Instruction::Pop);
                 }
             }
-            Stmt::When(expr, stmt) => {
+            Stmt::When(expr, options, stmt) => {
+                // Register the paths the when reads so it can be stopped by path
+                for path in paths(&expr) {
+                    let path = self.add_constant(Value::Path(path));
+                    self.add_instruction(Instruction::Constant(path));
+                    self.add_instruction(Instruction::Watch);
+                }
                 let spawn_ip = self.add_instruction(Instruction::Spawn(usize::MAX));
-                // Add expr
-                self.interpret_expr(env, expr);
-                // Add Conditional Jump
-                self.add_instruction(Instruction::JmpNot(spawn_ip as usize + 1));
+                let start = spawn_ip + 1;
+                // Only the paths of the condition are live, not the paths read by the statement.
+                self.live = options.contains(&WhenOption::Live);
+                let hysteresis = options.iter().find_map(|o| match o {
+                    WhenOption::Hysteresis(width) => Some(width.clone()),
+                    _ => None,
+                });
+                if let Some(width) = hysteresis {
+                    // The condition is checked by the hysteresis instruction,
+                    // since values where it is false may move the value back past the band.
+                    let (band, thresholds) = match &expr {
+                        Expr::Binary(_, BinaryOpcode::Gt, t) => (Band::Above, vec![*t.clone()]),
+                        Expr::Binary(_, BinaryOpcode::Lt, t) => (Band::Below, vec![*t.clone()]),
+                        Expr::Range(_, Range::Inside, lo, hi) => {
+                            (Band::Inside, vec![*lo.clone(), *hi.clone()])
+                        }
+                        Expr::Range(_, Range::Outside, lo, hi) => {
+                            (Band::Outside, vec![*lo.clone(), *hi.clone()])
+                        }
+                        _ => unreachable!("the parser rejects hysteresis without a comparison"),
+                    };
+                    self.interpret_expr(env, expr);
+                    self.live = false;
+                    self.add_instruction(Instruction::Seen);
+                    self.add_instruction(Instruction::Triggered);
+                    for t in thresholds {
+                        self.interpret_expr(env, t);
+                    }
+                    self.interpret_expr(env, width);
+                    self.add_instruction(Instruction::Hysteresis(start, band));
+                } else if matches!(expr, Expr::Binary(_, BinaryOpcode::And, _)) {
+                    // An all-of when keeps the latest value of each of its paths,
+                    // since the devices rarely change at the same time.
+                    let mut ps = paths(&expr);
+                    ps.sort();
+                    ps.dedup();
+                    for path in &ps {
+                        let path = self.add_constant(Value::Path(path.clone()));
+                        self.add_instruction(Instruction::Constant(path));
+                    }
+                    self.add_instruction(Instruction::Latest(ps.len(), self.live));
+                    self.interpret_expr(env, expr);
+                    self.live = false;
+                    self.add_instruction(Instruction::Seen);
+                    self.add_instruction(Instruction::Edge(start));
+                    self.add_instruction(Instruction::Triggered);
+                } else {
+                    // Add expr
+                    self.interpret_expr(env, expr);
+                    self.live = false;
+                    self.add_instruction(Instruction::Seen);
+                    // Add Conditional Jump
+                    self.add_instruction(Instruction::JmpNot(start));
+                    // Keep the value that triggered the when for $value
+                    self.add_instruction(Instruction::Triggered);
+                }
+                // Add options, each may also jump back to the beginning
+                for option in options {
+                    match option {
+                        WhenOption::Hysteresis(_) | WhenOption::Live => {}
+                        WhenOption::Cooldown(expr) => {
+                            self.interpret_expr(env, expr);
+                            self.add_instruction(Instruction::Cooldown(start));
+                        }
+                        WhenOption::Changed => {
+                            self.add_instruction(Instruction::Changed(start));
+                        }
+                        WhenOption::Debounce(expr) => {
+                            self.interpret_expr(env, expr);
+                            self.add_instruction(Instruction::Debounce(start));
+                        }
+                        WhenOption::Breaker(n, window, open) => {
+                            self.interpret_expr(env, n);
+                            self.interpret_expr(env, window);
+                            self.interpret_expr(env, open);
+                            self.add_instruction(Instruction::Breaker(start));
+                        }
+                    }
+                }
                 // Add stmt
                 self.interpret_stmt(env, *stmt);
                 // Loop the spawned thread back to the beginning
-                self.add_instruction(Instruction::Jump(spawn_ip as usize + 1));
+                self.add_instruction(Instruction::Jump(start));
 
                 // backpatch the spawn jump pointer
                 let l = self.code.instructions.len();
@@ -356,50 +694,118 @@ impl Interpreter {
                     panic!("missing spawn instruction")
                 }
             }
-            Stmt::Set(path, expr) => {
-                let const_index = self.add_constant(Value::Path(path));
-                self.add_instruction(Instruction::Constant(const_index));
-                // Add expr
-                self.interpret_expr(env, expr);
-                // Watch, creates a promise
-                self.add_instruction(Instruction::Set);
+            Stmt::WaitUntil(cond, timeout, stmt) => {
+                let spawn_ip = self.add_instruction(Instruction::Spawn(usize::MAX));
+                // Give up waiting once the timeout has passed
+                self.interpret_expr(env, timeout);
+                self.add_instruction(Instruction::Deadline);
+                // Add expr, looping until it is true
+                let cond_ip = self.code.instructions.len();
+                self.interpret_expr(env, cond);
+                self.add_instruction(Instruction::JmpNot(cond_ip));
+                self.add_instruction(Instruction::ClearDeadline);
+                // Add stmt
+                self.interpret_stmt(env, *stmt);
+                // Terminate the spawned thread
+                self.add_instruction(Instruction::Term);
+
+                // backpatch the spawn jump pointer
+                let l = self.code.instructions.len();
+                if let Some(Instruction::Spawn(ip)) =
+                    self.code.instructions.get_mut(spawn_ip as usize)
+                {
+                    *ip = l;
+                } else {
+                    panic!("missing spawn instruction")
+                }
+            }
+            Stmt::Set(paths, expr, urgent) => {
+                self.interpret_update(env, paths, expr, Instruction::Set(urgent))
+            }
+            Stmt::Publish(paths, expr) => {
+                self.interpret_update(env, paths, expr, Instruction::Publish)
+            }
+            Stmt::Clear(paths) => {
+                for path in paths {
+                    let const_index = self.add_constant(Value::Path(path));
+                    self.add_instruction(Instruction::Constant(const_index));
+                    self.add_instruction(Instruction::Clear);
+                }
             }
             Stmt::Expr(expr) => {
                 self.interpret_expr(env, expr);
                 self.add_instruction(Instruction::Pop);
             }
-            Stmt::Scene(id, stmt) => {
-                // Scenes are an implicit definition of two functions:
-                // a start and a stop function.
+            Stmt::Scene(id, options, stmt, _) => {
+                // Scenes are an implicit definition of three functions:
+                // a start, a stop and an arm function.
+                let name_const = self.add_constant(Value::Str(id.clone()));
+                let redefined = env.get_depth(&id) != 0;
                 env.values.insert(id.clone(), env.depth);
                 env.depth += 1;
                 let start_jump_const =
-                    self.add_constant(Value::Jump(self.code.instructions.len() + 3));
+                    self.add_constant(Value::Jump(self.code.instructions.len() + 4));
                 self.add_instruction(Instruction::Constant(start_jump_const));
 
-                env.values.insert(id + " stop", env.depth);
+                env.values.insert(id.clone() + " stop", env.depth);
                 env.depth += 1;
                 let stop_jump_const = self.add_constant(Value::Jump(usize::MAX)); // we need to backpatch this jump location
                 self.add_instruction(Instruction::Constant(stop_jump_const));
 
+                env.values.insert(id.clone() + " arm", env.depth);
+                env.depth += 1;
+                let arm_jump_const = self.add_constant(Value::Jump(usize::MAX)); // we need to backpatch this jump location
+                self.add_instruction(Instruction::Constant(arm_jump_const));
+
                 let continue_jump = self.add_instruction(Instruction::Jump(usize::MAX)); // we need to backpatch this jump location
 
-                // Add scene body
+                // Add scene body, a disabled scene returns immediately
+                let reactive_stmt = reactive(stmt.as_ref().clone());
+                self.add_instruction(Instruction::Constant(name_const));
+                let start_disabled = self.add_instruction(Instruction::Disabled(usize::MAX));
                 self.add_instruction(Instruction::SceneContext);
-                self.interpret_stmt(env, *stmt);
-                self.add_instruction(Instruction::Return);
+                self.interpret_stmt(env, reactive_first(*stmt));
+                let start_return = self.add_instruction(Instruction::Return);
 
                 // Add scene stop body
-                let stop_jump_ip = self.add_instruction(Instruction::Stop);
+                let stop_jump_ip = self.add_instruction(Instruction::Constant(name_const));
+                self.add_instruction(Instruction::Stop);
                 self.add_instruction(Instruction::Return);
 
-                // Backpatch jump constant
+                // Add scene arm body, only the reactive statements of the scene
+                let arm_jump_ip = self.add_instruction(Instruction::Constant(name_const));
+                let arm_disabled = self.add_instruction(Instruction::Disabled(usize::MAX));
+                self.add_instruction(Instruction::SceneContext);
+                if let Some(reactive_stmt) = reactive_stmt {
+                    self.interpret_stmt(env, reactive_stmt);
+                }
+                let arm_return = self.add_instruction(Instruction::Return);
+
+                // Backpatch disabled jumps
+                for (disabled, ret) in [(start_disabled, start_return), (arm_disabled, arm_return)]
+                {
+                    if let Some(Instruction::Disabled(ip)) =
+                        self.code.instructions.get_mut(disabled)
+                    {
+                        *ip = ret;
+                    } else {
+                        panic!("missing disabled instruction")
+                    }
+                }
+
+                // Backpatch jump constants
                 if let Some(Value::Jump(ip)) = self.code.constants.get_mut(stop_jump_const as usize)
                 {
                     *ip = stop_jump_ip as usize;
                 } else {
                     panic!("missing stop jump value")
                 }
+                if let Some(Value::Jump(ip)) = self.code.constants.get_mut(arm_jump_const as usize)
+                {
+                    *ip = arm_jump_ip as usize;
+                } else {
+                    panic!("missing arm jump value")
+                }
 
                 // Backpatch the continue jump pointer
                 let l = self.code.instructions.len();
@@ -408,23 +814,113 @@ impl Interpreter {
                 } else {
                     panic!("missing continue jump instruction")
                 }
+
+                for option in options {
+                    match option {
+                        SceneOption::Disabled => {
+                            self.add_instruction(Instruction::Constant(name_const));
+                            self.add_instruction(Instruction::Disable);
+                        }
+                    }
+                }
+
+                // Redefining a running scene replaces it, the old definition is stopped
+                // so its whens and ats do not keep running and the new one is started.
+                if redefined {
+                    self.add_instruction(Instruction::Constant(name_const));
+                    let redefine = self.add_instruction(Instruction::Redefine(usize::MAX));
+                    self.interpret_stmt(env, Stmt::Start(id, 0));
+                    let l = self.code.instructions.len();
+                    self.code.instructions[redefine] = Instruction::Redefine(l);
+                }
+            }
+            Stmt::Enable(id, _) => {
+                if env.get_depth(&id) == 0 {
+                    // A scene that is not in scope is an error of the loader.
+                    unreachable!(
+                        "undefined scene {}, the loader checks the scenes are in scope",
+                        id
+                    );
+                }
+                let name_const = self.add_constant(Value::Str(id));
+                self.add_instruction(Instruction::Constant(name_const));
+                self.add_instruction(Instruction::Enable);
+            }
+            Stmt::Disable(id, _) => {
+                if env.get_depth(&id) == 0 {
+                    // A scene that is not in scope is an error of the loader.
+                    unreachable!(
+                        "undefined scene {}, the loader checks the scenes are in scope",
+                        id
+                    );
+                }
+                let name_const = self.add_constant(Value::Str(id));
+                self.add_instruction(Instruction::Constant(name_const));
+                self.add_instruction(Instruction::Disable);
             }
-            Stmt::Start(id) => {
+            Stmt::Start(id, _) => {
                 self.interpret_expr(env, Expr::Ident(id));
                 self.add_instruction(Instruction::Call);
             }
-            Stmt::Stop(id) => {
+            Stmt::Stop(id, _) => {
                 self.interpret_expr(env, Expr::Ident(id + " stop"));
                 self.add_instruction(Instruction::Call);
             }
-            Stmt::At(expr, stmt) => {
+            Stmt::StopWhen(path) => {
+                let path = self.add_constant(Value::Path(path));
+                self.add_instruction(Instruction::Constant(path));
+                self.add_instruction(Instruction::StopWhen);
+            }
+            Stmt::StopAt(expr) => {
+                self.interpret_expr(env, expr);
+                self.add_instruction(Instruction::StopAt);
+            }
+            Stmt::Arm(id, _) => {
+                self.interpret_expr(env, Expr::Ident(id + " arm"));
+                self.add_instruction(Instruction::Call);
+            }
+            Stmt::Assert(expr, offset, location) => {
+                self.interpret_expr(env, expr);
+                self.add_instruction(Instruction::Assert(offset, location));
+            }
+            Stmt::Include(file, _) => {
+                panic!("include {} must be resolved by the loader", file)
+            }
+            Stmt::Guard(guard, expr, stmt) => {
+                self.interpret_expr(env, expr);
+                self.add_instruction(Instruction::Guard(guard));
+                let jmp_ip = self.add_instruction(Instruction::JmpNot(usize::MAX));
+                self.interpret_stmt(env, *stmt);
+
+                // backpatch the jump past the statement
+                let l = self.code.instructions.len();
+                if let Some(Instruction::JmpNot(ip)) =
+                    self.code.instructions.get_mut(jmp_ip as usize)
+                {
+                    *ip = l;
+                } else {
+                    panic!("missing jmpnot instruction")
+                }
+            }
+            Stmt::At(expr, count, stmt) => {
+                self.interpret_expr(env, expr.clone());
+                self.add_instruction(Instruction::Schedule);
                 let spawn_ip = self.add_instruction(Instruction::Spawn(usize::MAX));
+                // An at that repeats a number of times ends its thread once it ran that many times.
+                let repeat = count.map(|count| {
+                    self.interpret_expr(env, count);
+                    self.add_instruction(Instruction::Repeat(usize::MAX))
+                });
                 self.interpret_expr(env, expr);
                 self.add_instruction(Instruction::At);
                 self.interpret_stmt(env, *stmt);
 
                 // Loop the spawned thread back to the beginning
                 self.add_instruction(Instruction::Jump(spawn_ip as usize + 1));
+                if let Some(repeat) = repeat {
+                    let term = self.add_instruction(Instruction::Term);
+                    self.code.instructions[repeat] = Instruction::Repeat(term);
+                }
 
                 // backpatch the spawn jump pointer
                 let l = self.code.instructions.len();
@@ -438,12 +934,40 @@ impl Interpreter {
             }
         };
     }
+    // Compiles a set or publish of each of the paths, the value is only computed once.
+    fn interpret_update<'a>(
+        &mut self,
+        env: &mut Env<'a>,
+        paths: Vec<String>,
+        expr: Expr,
+        update: Instruction,
+    ) {
+        if let [path] = paths.as_slice() {
+            let const_index = self.add_constant(Value::Path(path.clone()));
+            self.add_instruction(Instruction::Constant(const_index));
+            self.interpret_expr(env, expr);
+            self.add_instruction(update);
+            return;
+        }
+        self.interpret_expr(env, expr);
+        for path in paths {
+            let const_index = self.add_constant(Value::Path(path));
+            self.add_instruction(Instruction::Constant(const_index)); // path, value
+            self.add_instruction(Instruction::Pick(1)); // value, path, value
+            self.add_instruction(update.clone()); // value
+        }
+        self.add_instruction(Instruction::Pop);
+    }
     fn interpret_expr<'a>(&mut self, env: &mut Env<'a>, expr: Expr) {
         match expr {
             Expr::Ident(id) => {
                 let depth = env.get_depth(&id);
                 if depth == 0 {
-                    panic!("undefined id");
+                    // A scene or variable that is not in scope is an error of the loader.
+                    unreachable!(
+                        "undefined id {}, the loader checks the ids are in scope",
+                        id
+                    );
                 }
                 self.add_instruction(Instruction::Pick(depth - 1));
             }
@@ -452,23 +976,99 @@ impl Interpreter {
                 self.interpret_expr(env, *rhs);
                 match op {
                     BinaryOpcode::Eql => self.add_instruction(Instruction::Equal),
-                    _ => todo!(),
+                    BinaryOpcode::Gt => self.add_instruction(Instruction::Greater),
+                    BinaryOpcode::Lt => self.add_instruction(Instruction::Less),
+                    BinaryOpcode::And => self.add_instruction(Instruction::And),
+                    // The loader rejects the arithmetic operators, see loader::UnsupportedOperator.
+                    BinaryOpcode::Add
+                    | BinaryOpcode::Sub
+                    | BinaryOpcode::Mul
+                    | BinaryOpcode::Div => unreachable!("operator {} is not supported", op),
                 };
             }
             Expr::Path(p) => {
                 let path = self.add_constant(Value::Path(p));
                 self.add_instruction(Instruction::Constant(path));
-                self.add_instruction(Instruction::Get);
+                if self.live {
+                    self.add_instruction(Instruction::GetLive);
+                } else {
+                    self.add_instruction(Instruction::Get);
+                }
+            }
+            Expr::Aggregate(agg, p) => {
+                let path = self.add_constant(Value::Path(p));
+                self.add_instruction(Instruction::Constant(path));
+                self.add_instruction(Instruction::Aggregate(agg));
+            }
+            Expr::Trigger => {
+                self.add_instruction(Instruction::Trigger);
+            }
+            Expr::TriggerPath => {
+                self.add_instruction(Instruction::TriggerPath);
+            }
+            Expr::Previous => {
+                self.add_instruction(Instruction::Previous);
+            }
+            Expr::Unknown => {
+                let unknown = self.add_constant(Value::Unknown);
+                self.add_instruction(Instruction::Constant(unknown));
+            }
+            Expr::Range(e, r, lo, hi) => {
+                self.interpret_expr(env, *e);
+                self.interpret_expr(env, *lo);
+                self.interpret_expr(env, *hi);
+                self.add_instruction(Instruction::Range(r));
+            }
+            Expr::Within(p, timeout, default) => {
+                let path = self.add_constant(Value::Path(p));
+                self.add_instruction(Instruction::Constant(path));
+                self.interpret_expr(env, *timeout);
+                let has_default = default.is_some();
+                if let Some(default) = default {
+                    self.interpret_expr(env, *default);
+                }
+                self.add_instruction(Instruction::GetWithin(has_default));
+            }
+            Expr::Trend(p, t) => {
+                let path = self.add_constant(Value::Path(p));
+                self.add_instruction(Instruction::Constant(path));
+                self.add_instruction(Instruction::Trend(t));
+            }
+            Expr::Change(p, t, by, window) => {
+                let path = self.add_constant(Value::Path(p));
+                self.add_instruction(Instruction::Constant(path));
+                self.interpret_expr(env, *by);
+                self.interpret_expr(env, *window);
+                self.add_instruction(Instruction::Change(t));
             }
             Expr::String(_)
             | Expr::Duration(_)
             | Expr::Time(_)
             | Expr::Float(_)
-            | Expr::Integer(_)
-            | Expr::Object(_) => {
+            | Expr::Integer(_) => {
                 let const_index = self.add_constant(expr.try_into().unwrap());
                 self.add_instruction(Instruction::Constant(const_index));
             }
+            Expr::Object(props) => match Value::try_from(Expr::Object(props.clone())) {
+                Ok(object) => {
+                    let const_index = self.add_constant(object);
+                    self.add_instruction(Instruction::Constant(const_index));
+                }
+                // A property computed at runtime, i.e. {brightness: <lux>},
+                // is placed on the stack after its name.
+                Err(_) => {
+                    let n = props.len();
+                    let mut props_env = env.nest();
+                    for (key, expr) in props {
+                        let const_index = self.add_constant(Value::Str(key));
+                        self.add_instruction(Instruction::Constant(const_index));
+                        props_env.depth += 1;
+                        self.interpret_expr(&mut props_env, expr);
+                        props_env.depth += 1;
+                    }
+                    self.add_instruction(Instruction::Object(n));
+                }
+            },
             Expr::As(init, id, cont) => {
                 // Compute the value and place it on the stack
                 self.interpret_expr(env, *init);
@@ -497,6 +1097,125 @@ mod tests {
 
     use super::*;
 
+    #[test]
+    fn test_value_equals() {
+        let payload = |p: &str| Value::try_from(p.as_bytes()).unwrap();
+        assert!(payload("21").equals(&Value::Integer(21)));
+        assert!(payload("21.0").equals(&Value::Integer(21)));
+        assert!(payload("21.5").equals(&Value::Float(21.5)));
+        assert!(payload(r#""21""#).equals(&Value::Integer(21)));
+        assert!(payload("on").equals(&Value::Str("on".to_string())));
+        assert!(!payload("21").equals(&Value::Integer(22)));
+        assert!(!payload("21").equals(&Value::Str("on".to_string())));
+    }
+    #[test]
+    fn test_value_equals_matrix() {
+        let payload = |p: &str| Value::try_from(p.as_bytes()).unwrap();
+        let s = |s: &str| Value::Str(s.to_string());
+        for (p, v, eq) in [
+            ("true", s("true"), true),
+            (r#""true""#, s("true"), true),
+            ("false", s("false"), true),
+            ("true", s("false"), false),
+            ("true", s("on"), true),
+            ("true", s("ON"), true),
+            ("true", s("yes"), true),
+            ("true", s("1"), true),
+            ("true", s("off"), false),
+            ("false", s("off"), true),
+            ("false", s("no"), true),
+            ("false", s("0"), true),
+            ("false", s("on"), false),
+            ("true", s("open"), false),
+            ("true", Value::Integer(1), true),
+            ("false", Value::Integer(0), true),
+            ("true", Value::Float(1.0), true),
+            ("true", Value::Integer(2), false),
+            ("1", s("1"), true),
+            ("1", Value::Float(1.0), true),
+            (r#""1""#, Value::Float(1.0), true),
+            (r#""1.5""#, Value::Float(1.5), true),
+            ("1", s("on"), false),
+            ("on", s("on"), true),
+            ("on", Value::Integer(1), false),
+        ] {
+            assert_eq!(eq, payload(p).equals(&v), "{} equals {:?}", p, v);
+            assert_eq!(eq, v.equals(&payload(p)), "{:?} equals {}", v, p);
+        }
+    }
+    #[test]
+    fn test_value_display() {
+        let payload = |p: &str| Value::try_from(p.as_bytes()).unwrap();
+        assert_eq!(
+            r#"{"a":"x","b":[1,2.5],"c":{"on":true}}"#,
+            payload(r#"{ "c": {"on": true}, "b": [1, 2.5], "a": "x" }"#).to_string()
+        );
+        assert_eq!("[1,2]", payload("[1, 2]").to_string());
+        assert_eq!("on", payload("on").to_string());
+        assert_eq!("on", payload(r#""on""#).to_string());
+        assert_eq!("21.5", payload("21.5").to_string());
+    }
+    #[test]
+    fn test_value_payload() {
+        let payload = |v: Value| Vec::<u8>::try_from(v).map(|p| String::from_utf8(p).unwrap());
+        assert_eq!("true", payload(Value::Bool(true)).unwrap());
+        assert_eq!("false", payload(Value::Bool(false)).unwrap());
+        assert_eq!("21.5", payload(Value::Float(21.5)).unwrap());
+        assert!(payload(Value::Duration(Duration::from_secs(5))).is_err());
+        assert!(payload(Value::Jump(3)).is_err());
+    }
+    #[test]
+    fn test_parse_duration() {
+        assert_eq!(Ok(Duration::from_secs(30)), parse_duration("30s"));
+        assert_eq!(Ok(Duration::from_secs(5 * 60)), parse_duration("5m"));
+        assert_eq!(Ok(Duration::from_secs(2 * 60 * 60)), parse_duration("2h"));
+        assert!(parse_duration("99999999999999999999s").is_err());
+        assert!(parse_duration("9999999999999999h").is_err());
+        assert!(parse_duration("s").is_err());
+        assert!(parse_duration("").is_err());
+    }
+    #[test]
+    fn test_parse_time() {
+        assert_eq!(Ok(TimeOfDay::HM(0, 25)), parse_time("12:25AM"));
+        assert_eq!(Ok(TimeOfDay::HM(9, 0)), parse_time("9:00AM"));
+        assert_eq!(Ok(TimeOfDay::HM(12, 0)), parse_time("12:00PM"));
+        assert_eq!(Ok(TimeOfDay::HM(22, 30)), parse_time("10:30PM"));
+        assert_eq!(Ok(TimeOfDay::Sunset), parse_time("#sunset"));
+        assert_eq!(Ok(TimeOfDay::HM(12, 0)), parse_time("#noon"));
+        assert_eq!(Ok(TimeOfDay::HM(0, 0)), parse_time("#midnight"));
+        for t in &[
+            "13:00PM",
+            "0:00AM",
+            "10:60AM",
+            "99999999999:00AM",
+            "10:99999999999PM",
+            "10AM",
+            "10:00",
+            "#dusk",
+            "",
+        ] {
+            assert!(parse_time(t).is_err(), "{} must not be a valid time", t);
+        }
+    }
+    #[test]
+    fn test_clock_hour() {
+        assert_eq!((12, false), clock_hour(0));
+        assert_eq!((11, false), clock_hour(11));
+        assert_eq!((12, true), clock_hour(12));
+        assert_eq!((1, true), clock_hour(13));
+        assert_eq!((11, true), clock_hour(23));
+        // Every time of the day formats as a literal that parses back to it.
+        for h in 0..24 {
+            let (clock, pm) = clock_hour(h);
+            assert_eq!(h, hour_of_day(clock, pm));
+            for m in [0, 5, 59] {
+                let t = TimeOfDay::HM(h, m);
+                assert_eq!(Ok(t.clone()), parse_time(&t.to_string()));
+            }
+        }
+        assert_eq!("12:05AM", TimeOfDay::HM(0, 5).to_string());
+        assert_eq!("#sunset", TimeOfDay::Sunset.to_string());
+    }
     #[test]
     fn test_hello_world() {
         let source = r#"print "hello_world";"#;
@@ -515,6 +1234,22 @@ mod tests {
         );
     }
     #[test]
+    fn test_history_window() {
+        let window = |source| Interpreter::from_source(source).unwrap().history_window();
+        assert_eq!(None, window("print <hall/temp>;"));
+        assert_eq!(
+            Some(Duration::ZERO),
+            window("when <hall/temp> rising print 1;")
+        );
+        assert_eq!(
+            Some(Duration::from_secs(10 * 60)),
+            window(
+                "when <hall/temp> increased by 2 in 10m print 1;
+                 when <hall/temp> decreased by 2 in 1m print 2;"
+            )
+        );
+    }
+    #[test]
     fn test_let() {
         let source = r#"
 let x = "x";
@@ -748,18 +1483,23 @@ print x;
         assert_eq!(
             Code {
                 instructions: vec![
-                    Instruction::Spawn(9),
                     Instruction::Constant(0),
-                    Instruction::Get,
+                    Instruction::Watch,
+                    Instruction::Spawn(13),
                     Instruction::Constant(1),
-                    Instruction::Equal,
-                    Instruction::JmpNot(1),
+                    Instruction::Get,
                     Instruction::Constant(2),
+                    Instruction::Equal,
+                    Instruction::Seen,
+                    Instruction::JmpNot(3),
+                    Instruction::Triggered,
+                    Instruction::Constant(3),
                     Instruction::Print,
-                    Instruction::Jump(1),
+                    Instruction::Jump(3),
                     Instruction::Term,
                 ],
                 constants: vec![
+                    Value::Path("path".to_string()),
                     Value::Path("path".to_string()),
                     Value::Str("off".to_string()),
                     Value::Str("off".to_string())
@@ -769,6 +1509,35 @@ print x;
         );
     }
     #[test]
+    fn test_set_class() {
+        let source = r#"
+        set [light[12]] "on";
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0), // on
+                    Instruction::Constant(1), // light1, on
+                    Instruction::Pick(1),     // on, light1, on
+                    Instruction::Set(false),  // on
+                    Instruction::Constant(2), // light2, on
+                    Instruction::Pick(1),     // on, light2, on
+                    Instruction::Set(false),  // on
+                    Instruction::Pop,
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Str("on".to_string()),
+                    Value::Path("light1".to_string()),
+                    Value::Path("light2".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
     fn test_when_as() {
         let source = r#"
         when <path> as x x is "off" print "off";
@@ -801,35 +1570,47 @@ print x;
         );
     }
     #[test]
-    fn test_wait() {
+    fn test_when_cooldown() {
         let source = r#"
-        wait 1s print "done";
+        when <path> is "on" cooldown 30s print "on";
 "#;
         let code = Interpreter::from_source(source).unwrap();
         log::debug!("code:     {:?}", code);
         assert_eq!(
             Code {
                 instructions: vec![
-                    Instruction::Spawn(6),
                     Instruction::Constant(0),
-                    Instruction::Wait,
+                    Instruction::Watch,
+                    Instruction::Spawn(15),
                     Instruction::Constant(1),
+                    Instruction::Get,
+                    Instruction::Constant(2),
+                    Instruction::Equal,
+                    Instruction::Seen,
+                    Instruction::JmpNot(3),
+                    Instruction::Triggered,
+                    Instruction::Constant(3),
+                    Instruction::Cooldown(3),
+                    Instruction::Constant(4),
                     Instruction::Print,
-                    Instruction::Term,
+                    Instruction::Jump(3),
                     Instruction::Term,
                 ],
                 constants: vec![
-                    Value::Duration(Duration::from_secs(1)),
-                    Value::Str("done".to_string()),
+                    Value::Path("path".to_string()),
+                    Value::Path("path".to_string()),
+                    Value::Str("on".to_string()),
+                    Value::Duration(Duration::from_secs(30)),
+                    Value::Str("on".to_string())
                 ],
             },
             code
         );
     }
     #[test]
-    fn test_set() {
+    fn test_when_trigger() {
         let source = r#"
-        set [path/to/value] "on";
+        when <lux> set [light] $value;
 "#;
         let code = Interpreter::from_source(source).unwrap();
         log::debug!("code:     {:?}", code);
@@ -837,56 +1618,203 @@ print x;
             Code {
                 instructions: vec![
                     Instruction::Constant(0),
+                    Instruction::Watch,
+                    Instruction::Spawn(12),
                     Instruction::Constant(1),
-                    Instruction::Set,
+                    Instruction::Get,
+                    Instruction::Seen,
+                    Instruction::JmpNot(3),
+                    Instruction::Triggered,
+                    Instruction::Constant(2),
+                    Instruction::Trigger,
+                    Instruction::Set(false),
+                    Instruction::Jump(3),
                     Instruction::Term,
                 ],
                 constants: vec![
-                    Value::Path("path/to/value".to_string()),
-                    Value::Str("on".to_string()),
+                    Value::Path("lux".to_string()),
+                    Value::Path("lux".to_string()),
+                    Value::Path("light".to_string()),
                 ],
             },
             code
         );
     }
     #[test]
-    fn test_scene() {
-        let source = r#"
-        scene night { print "x"; };
-        start night;
-        stop night;
-"#;
+    fn test_assert() {
+        let source = r#"assert <light> is "on";"#;
         let code = Interpreter::from_source(source).unwrap();
         log::debug!("code:     {:?}", code);
         assert_eq!(
             Code {
                 instructions: vec![
-                    Instruction::Constant(0), // Jump address of scene start code
-                    Instruction::Constant(1), // Jump address of scene stop code
-                    Instruction::Jump(9),
-                    Instruction::SceneContext, // Scene start
-                    Instruction::Constant(2),
-                    Instruction::Print,
-                    Instruction::Return,
-                    Instruction::Stop, // Scene stop
-                    Instruction::Return,
-                    Instruction::Pick(1), // Start
-                    Instruction::Call,
-                    Instruction::Pick(0), // Stop
-                    Instruction::Call,
-                    Instruction::Pop, // pop the scene start out of scope
-                    Instruction::Pop, // pop the scene stop out of scope
-                    Instruction::Term
+                    Instruction::Constant(0),
+                    Instruction::Get,
+                    Instruction::Constant(1),
+                    Instruction::Equal,
+                    Instruction::Assert(0, None),
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("light".to_string()),
+                    Value::Str("on".to_string()),
                 ],
-                constants: vec![Value::Jump(3), Value::Jump(7), Value::Str("x".to_string()),],
             },
             code
         );
     }
     #[test]
-    fn test_at() {
-        let source = r#"
-        at 12:50PM print "x";
+    fn test_aggregate() {
+        let source = r#"print avg <+/temp>;"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Aggregate(Aggregate::Avg),
+                    Instruction::Print,
+                    Instruction::Term,
+                ],
+                constants: vec![Value::Path("+/temp".to_string())],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_range() {
+        let source = r#"print <bath/humidity> is outside 40..60;"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Get,
+                    Instruction::Constant(1),
+                    Instruction::Constant(2),
+                    Instruction::Range(Range::Outside),
+                    Instruction::Print,
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("bath/humidity".to_string()),
+                    Value::Integer(40),
+                    Value::Integer(60),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_when_hysteresis() {
+        let source = r#"when <temp> > 25 hysteresis 1 print "hot";"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Watch,
+                    Instruction::Spawn(15),
+                    Instruction::Constant(1),
+                    Instruction::Get,
+                    Instruction::Constant(2),
+                    Instruction::Greater,
+                    Instruction::Seen,
+                    Instruction::Triggered,
+                    Instruction::Constant(3),
+                    Instruction::Constant(4),
+                    Instruction::Hysteresis(3, Band::Above),
+                    Instruction::Constant(5),
+                    Instruction::Print,
+                    Instruction::Jump(3),
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("temp".to_string()),
+                    Value::Path("temp".to_string()),
+                    Value::Integer(25),
+                    Value::Integer(25),
+                    Value::Integer(1),
+                    Value::Str("hot".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_when_changed() {
+        let source = r#"
+        when <setpoint> changed print $value;
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Watch,
+                    Instruction::Spawn(12),
+                    Instruction::Constant(1),
+                    Instruction::Get,
+                    Instruction::Seen,
+                    Instruction::JmpNot(3),
+                    Instruction::Triggered,
+                    Instruction::Changed(3),
+                    Instruction::Trigger,
+                    Instruction::Print,
+                    Instruction::Jump(3),
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("setpoint".to_string()),
+                    Value::Path("setpoint".to_string())
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_when_live() {
+        let source = r#"
+        when <door> is "open" live print <door>;
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Watch,
+                    Instruction::Spawn(14),
+                    Instruction::Constant(1),
+                    Instruction::GetLive,
+                    Instruction::Constant(2),
+                    Instruction::Equal,
+                    Instruction::Seen,
+                    Instruction::JmpNot(3),
+                    Instruction::Triggered,
+                    Instruction::Constant(3),
+                    Instruction::Get,
+                    Instruction::Print,
+                    Instruction::Jump(3),
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("door".to_string()),
+                    Value::Path("door".to_string()),
+                    Value::Str("open".to_string()),
+                    Value::Path("door".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_wait() {
+        let source = r#"
+        wait 1s print "done";
 "#;
         let code = Interpreter::from_source(source).unwrap();
         log::debug!("code:     {:?}", code);
@@ -895,15 +1823,374 @@ print x;
                 instructions: vec![
                     Instruction::Spawn(6),
                     Instruction::Constant(0),
-                    Instruction::At,
+                    Instruction::Wait,
                     Instruction::Constant(1),
                     Instruction::Print,
-                    Instruction::Jump(1),
+                    Instruction::Term,
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Duration(Duration::from_secs(1)),
+                    Value::Str("done".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_wait_until() {
+        let source = r#"
+        wait until <ready> is "on" for 1s print "done";
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Spawn(12),
+                    Instruction::Constant(0),
+                    Instruction::Deadline,
+                    Instruction::Constant(1),
+                    Instruction::Get,
+                    Instruction::Constant(2),
+                    Instruction::Equal,
+                    Instruction::JmpNot(3),
+                    Instruction::ClearDeadline,
+                    Instruction::Constant(3),
+                    Instruction::Print,
+                    Instruction::Term,
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Duration(Duration::from_secs(1)),
+                    Value::Path("ready".to_string()),
+                    Value::Str("on".to_string()),
+                    Value::Str("done".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_set() {
+        let source = r#"
+        set [path/to/value] "on";
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Constant(1),
+                    Instruction::Set(false),
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("path/to/value".to_string()),
+                    Value::Str("on".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_stop_when() {
+        let source = r#"
+        when <kitchen/light> is <kitchen/switch> print "match";
+        stop when <kitchen/#>;
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Watch,
+                    Instruction::Constant(1),
+                    Instruction::Watch,
+                    Instruction::Spawn(16),
+                    Instruction::Constant(2),
+                    Instruction::Get,
+                    Instruction::Constant(3),
+                    Instruction::Get,
+                    Instruction::Equal,
+                    Instruction::Seen,
+                    Instruction::JmpNot(5),
+                    Instruction::Triggered,
+                    Instruction::Constant(4),
+                    Instruction::Print,
+                    Instruction::Jump(5),
+                    Instruction::Constant(5),
+                    Instruction::StopWhen,
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("kitchen/light".to_string()),
+                    Value::Path("kitchen/switch".to_string()),
+                    Value::Path("kitchen/light".to_string()),
+                    Value::Path("kitchen/switch".to_string()),
+                    Value::Str("match".to_string()),
+                    Value::Path("kitchen/#".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_publish() {
+        let source = r#"
+        publish [dan/comfort] "ok";
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Constant(1),
+                    Instruction::Publish,
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("dan/comfort".to_string()),
+                    Value::Str("ok".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_clear() {
+        let source = r#"
+        clear [path/to/value];
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Clear,
+                    Instruction::Term,
+                ],
+                constants: vec![Value::Path("path/to/value".to_string())],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_scene() {
+        let source = r#"
+        scene night { print "x"; };
+        start night;
+        stop night;
+        arm night;
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(1), // Jump address of scene start code
+                    Instruction::Constant(2), // Jump address of scene stop code
+                    Instruction::Constant(3), // Jump address of scene arm code
+                    Instruction::Jump(17),
+                    Instruction::Constant(0), // Scene start
+                    Instruction::Disabled(9),
+                    Instruction::SceneContext,
+                    Instruction::Constant(4),
+                    Instruction::Print,
+                    Instruction::Return,
+                    Instruction::Constant(0), // Scene stop
+                    Instruction::Stop,
+                    Instruction::Return,
+                    Instruction::Constant(0), // Scene arm
+                    Instruction::Disabled(16),
+                    Instruction::SceneContext,
+                    Instruction::Return,
+                    Instruction::Pick(2), // Start
+                    Instruction::Call,
+                    Instruction::Pick(1), // Stop
+                    Instruction::Call,
+                    Instruction::Pick(0), // Arm
+                    Instruction::Call,
+                    Instruction::Pop, // pop the scene start out of scope
+                    Instruction::Pop, // pop the scene stop out of scope
+                    Instruction::Pop, // pop the scene arm out of scope
+                    Instruction::Term
+                ],
+                constants: vec![
+                    Value::Str("night".to_string()),
+                    Value::Jump(4),
+                    Value::Jump(10),
+                    Value::Jump(13),
+                    Value::Str("x".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_scene_reactive_first() {
+        for (source, want) in [
+            (
+                r#"scene s { set [light] "on"; when <light> is "on" print 1; print "done"; };"#,
+                r#"[when (<light> is "on") print 1; set light "on"; print "done";]"#,
+            ),
+            // Bindings stay in place and reactive statements do not move before them.
+            (
+                r#"scene s { set [light] "on"; let x = <light>; print x; when <fan> is "on" print x; };"#,
+                r#"[set light "on"; let x = <light>; when (<fan> is "on") print x; print x;]"#,
+            ),
+            // Statements controlling the rules keep their order with the rules.
+            (
+                r#"scene s { set [k/fan] "on"; stop when <k/#>; when <k/light> is 1 print 1; };"#,
+                r#"[set k/fan "on"; stop when <k/#>; when (<k/light> is 1) print 1;]"#,
+            ),
+        ] {
+            let body = match crate::parse(source).unwrap() {
+                Stmt::Block(mut stmts) => match stmts.remove(0) {
+                    Stmt::Scene(_, _, body, _) => body,
+                    _ => panic!("expected a scene"),
+                },
+                _ => panic!("expected a block"),
+            };
+            assert_eq!(want, format!("{:?}", reactive_first(*body)));
+        }
+    }
+    #[test]
+    fn test_at() {
+        let source = r#"
+        at 12:50PM print "x";
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        log::debug!("code:     {:?}", code);
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Schedule,
+                    Instruction::Spawn(8),
+                    Instruction::Constant(1),
+                    Instruction::At,
+                    Instruction::Constant(2),
+                    Instruction::Print,
+                    Instruction::Jump(3),
                     Instruction::Term,
                 ],
                 constants: vec![
                     Value::Time(TimeOfDay::HM(12, 50)),
+                    Value::Time(TimeOfDay::HM(12, 50)),
+                    Value::Str("x".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_at_repeat() {
+        let source = r#"
+        at 8:00AM repeat 3 print "pill";
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Schedule,
+                    Instruction::Spawn(11),
+                    Instruction::Constant(1),
+                    Instruction::Repeat(10),
+                    Instruction::Constant(2),
+                    Instruction::At,
+                    Instruction::Constant(3),
+                    Instruction::Print,
+                    Instruction::Jump(3),
+                    Instruction::Term,
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Time(TimeOfDay::HM(8, 0)),
+                    Value::Integer(3),
+                    Value::Time(TimeOfDay::HM(8, 0)),
+                    Value::Str("pill".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_guard() {
+        let source = r#"
+        after 6:00PM print "x";
+        print "y";
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Guard(Guard::After),
+                    Instruction::JmpNot(5),
+                    Instruction::Constant(1),
+                    Instruction::Print,
+                    Instruction::Constant(2),
+                    Instruction::Print,
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Time(TimeOfDay::HM(18, 0)),
                     Value::Str("x".to_string()),
+                    Value::Str("y".to_string()),
+                ],
+            },
+            code
+        );
+    }
+    #[test]
+    fn test_when_all() {
+        let source = r#"
+        when <a> is 1 and <b> is 2 print 1;
+"#;
+        let code = Interpreter::from_source(source).unwrap();
+        assert_eq!(
+            Code {
+                instructions: vec![
+                    Instruction::Constant(0),
+                    Instruction::Watch,
+                    Instruction::Constant(1),
+                    Instruction::Watch,
+                    Instruction::Spawn(23),
+                    Instruction::Constant(2),
+                    Instruction::Constant(3),
+                    Instruction::Latest(2, false),
+                    Instruction::Constant(4),
+                    Instruction::Get,
+                    Instruction::Constant(5),
+                    Instruction::Equal,
+                    Instruction::Constant(6),
+                    Instruction::Get,
+                    Instruction::Constant(7),
+                    Instruction::Equal,
+                    Instruction::And,
+                    Instruction::Seen,
+                    Instruction::Edge(5),
+                    Instruction::Triggered,
+                    Instruction::Constant(8),
+                    Instruction::Print,
+                    Instruction::Jump(5),
+                    Instruction::Term,
+                ],
+                constants: vec![
+                    Value::Path("a".to_string()),
+                    Value::Path("b".to_string()),
+                    Value::Path("a".to_string()),
+                    Value::Path("b".to_string()),
+                    Value::Path("a".to_string()),
+                    Value::Integer(1),
+                    Value::Path("b".to_string()),
+                    Value::Integer(2),
+                    Value::Integer(1),
                 ],
             },
             code
@@ -0,0 +1,75 @@
+use anyhow::{anyhow, Result};
+use serde_json::Value;
+
+/// Converts a JSON config file of flag to value into the command line flags it stands for,
+/// i.e. {"mqtt-url": "mqtt://broker", "alias": ["lamp=home/0x01"], "json": true}.
+/// A list repeats the flag for each value, true passes a flag without a value and false omits it.
+/// Flags that were given are skipped, so that the command line overrides the file.
+pub fn args(json: &str, given: impl Fn(&str) -> bool) -> Result<Vec<String>> {
+    let object = match serde_json::from_str(json)? {
+        Value::Object(object) => object,
+        _ => return Err(anyhow!("config must be a JSON object of flag to value")),
+    };
+    let mut args = Vec::new();
+    for (flag, value) in object {
+        if flag == "config" {
+            return Err(anyhow!("config cannot include another config"));
+        }
+        if given(&flag) {
+            continue;
+        }
+        let values = match value {
+            Value::Array(values) => values,
+            value => vec![value],
+        };
+        for value in values {
+            match value {
+                Value::Bool(true) => args.push(format!("--{}", flag)),
+                Value::Bool(false) | Value::Null => {}
+                Value::String(s) => args.push(format!("--{}={}", flag, s)),
+                Value::Number(n) => args.push(format!("--{}={}", flag, n)),
+                _ => return Err(anyhow!("config {} must be a string, number or bool", flag)),
+            }
+        }
+    }
+    Ok(args)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_args() {
+        let config = r#"{
+            "mqtt-url": "mqtt://broker",
+            "client-id": "dan",
+            "history-depth": 10,
+            "alias": ["lamp=home/0x01", "fan=home/0x02"],
+            "json": true,
+            "test": false
+        }"#;
+        assert_eq!(
+            vec![
+                "--alias=lamp=home/0x01",
+                "--alias=fan=home/0x02",
+                "--client-id=dan",
+                "--history-depth=10",
+                "--json",
+                "--mqtt-url=mqtt://broker",
+            ],
+            args(config, |_| false).unwrap()
+        );
+        // The flags given on the command line override the file.
+        assert_eq!(
+            vec!["--alias=lamp=home/0x01", "--alias=fan=home/0x02", "--json"],
+            args(config, |flag| flag != "alias" && flag != "json").unwrap()
+        );
+    }
+    #[test]
+    fn test_args_invalid() {
+        assert!(args("[]", |_| false).is_err());
+        assert!(args(r#"{"config": "dan.json"}"#, |_| false).is_err());
+        assert!(args(r#"{"alias": {"lamp": "home/0x01"}}"#, |_| false).is_err());
+    }
+}
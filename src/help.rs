@@ -0,0 +1,223 @@
+/// Statement describes the syntax of a single dan statement.
+#[derive(Debug)]
+pub struct Statement {
+    pub keyword: &'static str,
+    pub example: &'static str,
+    pub detail: &'static str,
+}
+
+/// STATEMENTS lists every statement of the language, in the order they are documented.
+pub const STATEMENTS: &[Statement] = &[
+    Statement {
+        keyword: "set",
+        example: r#"set [kitchen/light] "on""#,
+        detail: "Publishes the value of the expression to the path. A path with wildcards publishes to every topic matching it that has a value. During quiet hours only `set urgent` publishes.",
+    },
+    Statement {
+        keyword: "publish",
+        example: r#"publish [dan/comfort] "ok""#,
+        detail: "Publishes the value of the expression to the path as a retained status, which clients subscribing later receive.",
+    },
+    Statement {
+        keyword: "clear",
+        example: "clear [kitchen/light]",
+        detail: "Deletes the value the broker retains for the path.",
+    },
+    Statement {
+        keyword: "let",
+        example: "let x = <kitchen/temp>",
+        detail: "Binds the value of the expression to an identifier.",
+    },
+    Statement {
+        keyword: "when",
+        example: r#"when <front/door> is "open" cooldown 60s print "door opened""#,
+        detail: "Runs the statement each time the condition is true, at most once per optional cooldown, or only when the value changed. A live when ignores the retained values sent when it subscribes. With debounce it runs once after the condition stopped firing for the duration. With breaker 5 per 1m for 10m a when firing more than 5 times in a minute is stopped for 10 minutes. With hysteresis a comparison fires again only after the value moved back past the threshold by the width. A condition <path> rising or falling compares a value to the previous one, <path> increased by 2 in 10m to the value 10m earlier. Conditions joined with and fire once all of them hold, using the latest value of each path, and again once one of them did not. $value is the value that triggered it and $path its path, which differs from a path with wildcards. $prev is the value read before $value, empty for the first value.",
+    },
+    Statement {
+        keyword: "wait",
+        example: r#"wait until <garage/door> is "closed" for 30s print "closed""#,
+        detail: "Waits for a duration, or until a condition is true for at most a duration, then runs the statement.",
+    },
+    Statement {
+        keyword: "at",
+        example: "at 10:00PM start night",
+        detail: "Runs the statement each day at a time of day, #noon or #midnight, or at #sunrise or #sunset of the --location. \
+                 With repeat, i.e. at 8:00AM repeat 3, it runs on that many days and stops.",
+    },
+    Statement {
+        keyword: "after",
+        example: r#"after 6:00PM set [porch/light] "on""#,
+        detail: "Runs the statement now if the time of day is after the time, until midnight.",
+    },
+    Statement {
+        keyword: "before",
+        example: r#"before 6:00AM set [porch/light] "on""#,
+        detail: "Runs the statement now if the time of day is before the time, since midnight.",
+    },
+    Statement {
+        keyword: "print",
+        example: r#"print "hello""#,
+        detail: "Prints the value of the expression.",
+    },
+    Statement {
+        keyword: "scene",
+        example: r#"scene night { set [kitchen/light] "off"; }"#,
+        detail: "Defines a named scene that is run with start and stopped with stop. Its when and at rules start before its other statements run, but after the lets before them. A scene defined as disabled does not start until it is enabled.",
+    },
+    Statement {
+        keyword: "start",
+        example: "start night",
+        detail: "Runs a scene.",
+    },
+    Statement {
+        keyword: "stop",
+        example: "stop night",
+        detail: "Stops a scene and any of its reactive statements.",
+    },
+    Statement {
+        keyword: "stop when",
+        example: "stop when <+/light>",
+        detail: "Stops every when reading a path matching the path or MQTT topic filter.",
+    },
+    Statement {
+        keyword: "stop at",
+        example: "stop at 7:00AM",
+        detail: "Stops every at waiting for the time of day.",
+    },
+    Statement {
+        keyword: "arm",
+        example: "arm night",
+        detail: "Registers the reactive statements of a scene without running it.",
+    },
+    Statement {
+        keyword: "enable",
+        example: "enable vacation",
+        detail: "Allows a disabled scene to start and arm.",
+    },
+    Statement {
+        keyword: "disable",
+        example: "disable vacation",
+        detail: "Prevents a scene from starting or arming, a running scene keeps running until it is stopped.",
+    },
+    Statement {
+        keyword: "assert",
+        example: r#"assert <bedroom/light> is "on""#,
+        detail: "Fails the program when the condition is false, run programs with --test to report every failure.",
+    },
+    Statement {
+        keyword: "include",
+        example: r#"include "scenes/common.dan""#,
+        detail: "Inlines the statements of a file, relative to the including file, when loading.",
+    },
+];
+
+/// Finds the statement with the keyword.
+pub fn statement(keyword: &str) -> Option<&'static Statement> {
+    STATEMENTS.iter().find(|s| s.keyword == keyword)
+}
+
+/// Suggests the keyword closest to the word, when the word is a near miss of a keyword.
+pub fn suggest(word: &str) -> Option<&'static str> {
+    let max = (word.chars().count() / 3).max(1);
+    let keywords = STATEMENTS
+        .iter()
+        .map(|s| s.keyword.split(' ').next().unwrap_or(s.keyword));
+    if keywords.clone().any(|k| k == word) {
+        return None;
+    }
+    keywords
+        .map(|k| (distance(word, k), k))
+        .filter(|(d, _)| *d <= max)
+        .min_by_key(|(d, _)| *d)
+        .map(|(_, k)| k)
+}
+
+/// Computes the edit distance of the words, a transposition of adjacent characters counts as one edit.
+fn distance(a: &str, b: &str) -> usize {
+    let a: Vec<char> = a.chars().collect();
+    let b: Vec<char> = b.chars().collect();
+    let mut d = vec![vec![0; b.len() + 1]; a.len() + 1];
+    for (i, row) in d.iter_mut().enumerate() {
+        row[0] = i;
+    }
+    for j in 0..=b.len() {
+        d[0][j] = j;
+    }
+    for i in 1..=a.len() {
+        for j in 1..=b.len() {
+            let cost = if a[i - 1] == b[j - 1] { 0 } else { 1 };
+            d[i][j] = (d[i - 1][j] + 1)
+                .min(d[i][j - 1] + 1)
+                .min(d[i - 1][j - 1] + cost);
+            if i > 1 && j > 1 && a[i - 1] == b[j - 2] && a[i - 2] == b[j - 1] {
+                d[i][j] = d[i][j].min(d[i - 2][j - 2] + 1);
+            }
+        }
+    }
+    d[a.len()][b.len()]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{
+        ast::{Guard, Stmt},
+        parse,
+    };
+
+    /// Reports the keyword of the statement.
+    /// The match is exhaustive so that new statements are added to STATEMENTS.
+    fn keyword(stmt: &Stmt) -> Option<&'static str> {
+        match stmt {
+            Stmt::Block(_) | Stmt::Expr(_) => None,
+            Stmt::Set(_, _, _) => Some("set"),
+            Stmt::Publish(_, _) => Some("publish"),
+            Stmt::Clear(_) => Some("clear"),
+            Stmt::Let(_, _) => Some("let"),
+            Stmt::When(_, _, _) => Some("when"),
+            Stmt::Wait(_, _) | Stmt::WaitUntil(_, _, _) => Some("wait"),
+            Stmt::At(_, _, _) => Some("at"),
+            Stmt::Print(_) => Some("print"),
+            Stmt::Scene(..) => Some("scene"),
+            Stmt::Start(_, _) => Some("start"),
+            Stmt::Stop(_, _) => Some("stop"),
+            Stmt::StopWhen(_) => Some("stop when"),
+            Stmt::StopAt(_) => Some("stop at"),
+            Stmt::Guard(Guard::After, _, _) => Some("after"),
+            Stmt::Guard(Guard::Before, _, _) => Some("before"),
+            Stmt::Arm(_, _) => Some("arm"),
+            Stmt::Enable(_, _) => Some("enable"),
+            Stmt::Disable(_, _) => Some("disable"),
+            Stmt::Assert(_, _, _) => Some("assert"),
+            Stmt::Include(_, _) => Some("include"),
+        }
+    }
+
+    #[test]
+    fn test_statements() {
+        for s in STATEMENTS {
+            let ast = parse(&format!("{};", s.example))
+                .unwrap_or_else(|err| panic!("example of {} does not parse: {}", s.keyword, err));
+            if let Stmt::Block(stmts) = ast {
+                assert_eq!(Some(s.keyword), keyword(&stmts[0]));
+            } else {
+                panic!("file must be a block")
+            }
+        }
+    }
+    #[test]
+    fn test_statement() {
+        assert_eq!("scene", statement("scene").unwrap().keyword);
+        assert!(statement("func").is_none());
+    }
+    #[test]
+    fn test_suggest() {
+        assert_eq!(Some("set"), suggest("ste"));
+        assert_eq!(Some("print"), suggest("prnit"));
+        assert_eq!(Some("scene"), suggest("sceen"));
+        assert_eq!(Some("when"), suggest("whn"));
+        assert_eq!(None, suggest("set"));
+        assert_eq!(None, suggest("x"));
+        assert_eq!(None, suggest("lights"));
+    }
+}
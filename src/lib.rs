@@ -1,89 +1,232 @@
+pub mod alias;
 pub mod ast;
 pub mod compiler;
+pub mod config;
+pub mod help;
+pub mod limiter;
+pub mod loader;
+pub mod logging;
 pub mod mqtt_engine;
+pub mod router;
+pub mod snapshot;
+pub mod sun;
 pub mod vm;
+pub mod watch;
 
 #[macro_use(btree_map)]
 extern crate macro_map;
 
-//pub mod sun;
-
 pub type Result<T> = anyhow::Result<T>;
 
+/// The file name of a source compiled without a file, in the errors and warnings of its checks.
+pub const SOURCE: &str = "<source>";
+
 pub trait Compile {
     type Output;
 
+    /// Compiles the AST, whose includes must have been resolved, see loader::load.
     fn from_ast(ast: ast::Stmt) -> Self::Output;
 
+    /// Compiles the source, which cannot include files since there is no file
+    /// to resolve them against, an include is a SyntaxError.
+    /// The scenes and variables are checked as when loading a file, see loader::load_source.
     fn from_source(source: &str) -> Result<Self::Output> {
-        let ast = dan::FileParser::new()
-            .parse(source)
-            // Map the err tokens to an owned value since otherwise the
-            // input would have to live as long as the error which has a static lifetime.
-            .map_err(|err| err.map_token(|tok| tok.to_string()))?;
+        let ast = parse(source)?;
+        if let Some((_, offset)) = ast::include(&ast) {
+            return Err(SyntaxError {
+                start: Position::of(source, offset),
+                end: Position::of(source, offset + "include".len()),
+                message: "include requires loading the program from a file".to_string(),
+            }
+            .into());
+        }
+        let ast = loader::check(ast, source, std::path::Path::new(SOURCE), false)?;
         Ok(Self::from_ast(ast))
     }
 }
 
+/// Position is a line and column within a source, both start at 1.
+#[derive(Debug, Clone, Copy, PartialEq, serde::Serialize)]
+pub struct Position {
+    pub line: usize,
+    /// The column counts characters, not bytes.
+    pub column: usize,
+}
+
+impl Position {
+    /// Computes the position of the byte offset within the source.
+    pub fn of(source: &str, offset: usize) -> Self {
+        let before = &source[..offset.min(source.len())];
+        let line_start = before.rfind('\n').map_or(0, |i| i + 1);
+        Self {
+            line: before.matches('\n').count() + 1,
+            column: before[line_start..].chars().count() + 1,
+        }
+    }
+}
+
+/// SyntaxError is an error parsing a source along with the span of the offending token,
+/// so that tools can highlight it. The end is the position just after the token.
+#[derive(Debug, Clone, PartialEq)]
+pub struct SyntaxError {
+    pub start: Position,
+    pub end: Position,
+    pub message: String,
+}
+
+impl std::fmt::Display for SyntaxError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(
+            f,
+            "{}:{}: {}",
+            self.start.line, self.start.column, self.message
+        )
+    }
+}
+
+impl std::error::Error for SyntaxError {}
+
+/// InvalidLiteral is the error of the parser for a number, duration, time or path
+/// that is lexed but not valid, or for a nested scene, along with its byte offsets.
+#[derive(Debug, Clone, PartialEq)]
+pub struct InvalidLiteral {
+    pub start: usize,
+    pub end: usize,
+    pub message: &'static str,
+}
+
+impl std::fmt::Display for InvalidLiteral {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}", self.message)
+    }
+}
+
+/// Parses the source into an AST.
+/// Errors at a token, including invalid literals, are a SyntaxError.
+/// When the statement with the error starts with a near miss of a keyword the error suggests the keyword.
+pub fn parse(source: &str) -> Result<ast::Stmt> {
+    parse_with(source, false)
+}
+
+/// Parses the source like parse, when dotted the paths may use . as the separator,
+/// i.e. [home.livingroom.light], see ast::canonical_path.
+pub fn parse_with(source: &str, dotted: bool) -> Result<ast::Stmt> {
+    dan::FileParser::new().parse(dotted, source).map_err(|err| {
+        let span = match &err {
+            ParseError::InvalidToken { location }
+            | ParseError::UnrecognizedEOF { location, .. } => Some((*location, *location)),
+            ParseError::UnrecognizedToken {
+                token: (l, _, r), ..
+            }
+            | ParseError::ExtraToken { token: (l, _, r) } => Some((*l, *r)),
+            ParseError::User { error } => Some((error.start, error.end)),
+        };
+        // Map the err tokens to an owned value since otherwise the
+        // input would have to live as long as the error which has a static lifetime.
+        let err = err.map_token(|tok| tok.to_string());
+        let (l, r) = match span {
+            Some(span) => span,
+            None => return err.into(),
+        };
+        let mut message = err.to_string();
+        if let Some(keyword) = help::suggest(statement_word(source, l)) {
+            message = format!("{}, did you mean '{}'?", message, keyword);
+        }
+        SyntaxError {
+            start: Position::of(source, l),
+            end: Position::of(source, r),
+            message,
+        }
+        .into()
+    })
+}
+
+/// Finds the first word of the statement containing the location.
+fn statement_word(source: &str, location: usize) -> &str {
+    let start = source[..location.min(source.len())]
+        .rfind(|c| c == ';' || c == '{' || c == '}')
+        .map_or(0, |i| i + 1);
+    source[start..]
+        .trim_start()
+        .split(|c: char| !(c.is_alphanumeric() || c == '_'))
+        .next()
+        .unwrap_or("")
+}
+
 #[macro_use]
 extern crate lalrpop_util;
+use lalrpop_util::ParseError;
 
 lalrpop_mod!(pub dan);
 
 #[cfg(test)]
 mod parser {
     use super::*;
+    use proptest::prelude::*;
     #[test]
     fn test_ident() {
-        let expr = dan::FileParser::new().parse("print a;").unwrap();
+        let expr = dan::FileParser::new().parse(false, "print a;").unwrap();
         assert_eq!(&format!("{:?}", expr), "[print a;]");
 
-        let expr = dan::FileParser::new().parse("print _a;").unwrap();
+        let expr = dan::FileParser::new().parse(false, "print _a;").unwrap();
         assert_eq!(&format!("{:?}", expr), "[print _a;]");
 
-        let expr = dan::FileParser::new().parse("print _a; print b0;").unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, "print _a; print b0;")
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), "[print _a; print b0;]");
     }
     #[test]
     fn test_string() {
-        let expr = dan::FileParser::new().parse(r#"print "string";"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print "string";"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print "string";]"#);
 
         let expr = dan::FileParser::new()
-            .parse(r#"print "string with spaces";"#)
+            .parse(false, r#"print "string with spaces";"#)
             .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print "string with spaces";]"#);
     }
     #[test]
     fn test_int() {
-        let expr = dan::FileParser::new().parse(r#"print 42;"#).unwrap();
+        let expr = dan::FileParser::new().parse(false, r#"print 42;"#).unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 42;]"#);
 
-        let expr = dan::FileParser::new().parse(r#"print 0;"#).unwrap();
+        let expr = dan::FileParser::new().parse(false, r#"print 0;"#).unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 0;]"#);
     }
 
     #[test]
     fn test_float() {
-        let expr = dan::FileParser::new().parse(r#"print 42.0;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print 42.0;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 42.0;]"#);
 
-        let expr = dan::FileParser::new().parse(r#"print 0.0;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print 0.0;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 0.0;]"#);
 
-        let expr = dan::FileParser::new().parse(r#"print 0.1;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print 0.1;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 0.1;]"#);
     }
 
     #[test]
     fn test_object() {
         let expr = dan::FileParser::new()
-            .parse(r#"print {value: 42.0};"#)
+            .parse(false, r#"print {value: 42.0};"#)
             .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print {value: 42.0};]"#);
 
         let expr = dan::FileParser::new()
-            .parse(r#"print {answer: 42.0, question: "how many roads?"};"#)
+            .parse(
+                false,
+                r#"print {answer: 42.0, question: "how many roads?"};"#,
+            )
             .unwrap();
         assert_eq!(
             &format!("{:?}", expr),
@@ -93,54 +236,231 @@ mod parser {
 
     #[test]
     fn test_duration() {
-        let expr = dan::FileParser::new().parse(r#"print 5h;"#).unwrap();
+        let expr = dan::FileParser::new().parse(false, r#"print 5h;"#).unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 5h;]"#);
 
         let expr = dan::FileParser::new()
-            .parse(r#"print 1h;print  2m;print  3s;"#)
+            .parse(false, r#"print 1h;print  2m;print  3s;"#)
             .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 1h; print 2m; print 3s;]"#);
+
+        let expr = dan::FileParser::new()
+            .parse(false, r#"wait 500ms print 1;"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[wait 500ms print 1;]"#);
+    }
+    #[test]
+    fn test_scientific() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print 1e3; print 1.5e-2; print 2E+2;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[print 1000.0; print 0.015; print 200.0;]"#
+        );
+
+        let err = parse("print 1e999;").unwrap_err();
+        assert_eq!("1:7: float is too big", err.to_string());
+        // An exponent needs digits, the letters are an invalid duration unit.
+        let err = parse("print 1e;").unwrap_err();
+        assert_eq!("1:7: duration unit must be ms, s, m or h", err.to_string());
+    }
+    #[test]
+    fn test_invalid_time() {
+        let err = parse("at 99999999999:00PM print 1;").unwrap_err();
+        assert_eq!("1:4: time hours must be between 1 and 12", err.to_string());
+        let err = parse("at 10:99999999999AM print 1;").unwrap_err();
+        assert_eq!(
+            "1:4: time minutes must be between 0 and 59",
+            err.to_string()
+        );
+    }
+    #[test]
+    fn test_invalid_duration() {
+        for (source, message) in [
+            (
+                "wait 5u print 1;",
+                "1:6: duration unit must be ms, s, m or h",
+            ),
+            (
+                "wait 5sec print 1;",
+                "1:6: duration unit must be ms, s, m or h",
+            ),
+            (
+                "wait 5us print 1;",
+                "1:6: duration unit must be ms, s, m or h",
+            ),
+            (
+                "print 1;\nwait 99999999999999999h print 1;",
+                "2:6: duration is too big",
+            ),
+        ] {
+            let err = parse(source).unwrap_err();
+            assert_eq!(message, err.to_string(), "{}", source);
+            assert!(err.is::<SyntaxError>());
+        }
+        let err = parse("print 13:00PM;").unwrap_err();
+        let err = err.downcast_ref::<SyntaxError>().unwrap();
+        assert_eq!(Position { line: 1, column: 7 }, err.start);
+        assert_eq!(
+            Position {
+                line: 1,
+                column: 14
+            },
+            err.end
+        );
     }
     #[test]
     fn test_time() {
-        let expr = dan::FileParser::new().parse(r#"print 10:05PM;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print 10:05PM;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 10:05PM;]"#);
 
         let expr = dan::FileParser::new()
-            .parse(r#"print #sunrise; print #sunset; print 12:25AM;"#)
+            .parse(
+                false,
+                r#"print #sunrise; print #sunset; print 12:25AM; at #noon print "lunch";"#,
+            )
             .unwrap();
         assert_eq!(
             &format!("{:?}", expr),
-            r#"[print #sunrise; print #sunset; print 12:25AM;]"#
+            r#"[print #sunrise; print #sunset; print 12:25AM; at #noon print "lunch";]"#
         );
     }
     #[test]
     fn test_set() {
-        let expr = dan::FileParser::new().parse(r#"set [path] 0;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"set [path] 0;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[set path 0;]"#);
     }
     #[test]
+    fn test_set_urgent() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"set urgent [alarm/siren] "on";"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[set urgent alarm/siren "on";]"#);
+    }
+    #[test]
+    fn test_at_repeat() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"at 8:00AM repeat 3 { print "pill"; };"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[at 8:00AM repeat 3 [print "pill";];]"#
+        );
+    }
+    #[test]
+    fn test_set_class() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"set [bedroom/light[1-3]] on;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[set bedroom/light1 bedroom/light2 bedroom/light3 on;]"#
+        );
+        assert_eq!(
+            vec!["fan/a1", "fan/a2", "fan/b1", "fan/b2", "fan/c1", "fan/c2"],
+            ast::expand_classes("fan/[a-bc][12]").unwrap()
+        );
+        assert_eq!(
+            ast::MAX_EXPANDED_PATHS,
+            ast::expand_classes("[0-9a-f][0-9a-f]").unwrap().len()
+        );
+        // Brackets of quoted parts and of gets are not classes.
+        let expr = dan::FileParser::new()
+            .parse(false, r#"clear ["Room [1]"/light]; print <light[1]>;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[clear Room [1]/light; print <light[1]>;]"#
+        );
+        for (source, message) in [
+            ("set [light[1-3] on;", "1:5: character class is missing ]"),
+            ("set [light[]] on;", "1:5: character class is empty"),
+            ("set [light[3-1]] on;", "1:5: character range is reversed"),
+            (
+                "set [light[a/b]] on;",
+                "1:5: character class must only contain characters and ranges",
+            ),
+            (
+                "set [a/[!-~][!-~][!-~][!-~]] on;",
+                "1:5: character class names too many characters",
+            ),
+            (
+                "set [a/[\u{0}-\u{10FFFF}]] on;",
+                "1:5: character class names too many characters",
+            ),
+            (
+                "set [a/[0-9][0-9][0-9]] on;",
+                "1:5: character classes name too many paths",
+            ),
+        ] {
+            let err = parse(source).unwrap_err();
+            assert_eq!(message, err.to_string(), "{}", source);
+        }
+    }
+    #[test]
     fn test_let() {
-        let expr = dan::FileParser::new().parse(r#"let x = 0;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"let x = 0;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[let x = 0;]"#);
     }
     #[test]
     fn test_when() {
         let expr = dan::FileParser::new()
-            .parse(r#"when <path> is 0 print 5;"#)
+            .parse(false, r#"when <path> is 0 print 5;"#)
             .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[when (<path> is 0) print 5;]"#);
     }
     #[test]
+    fn test_when_cooldown() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when <path> is "detected" cooldown 30s print 5;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when (<path> is "detected") cooldown 30s print 5;]"#
+        );
+    }
+    #[test]
+    fn test_online() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when online <zwave> print 5;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when (<zwave/connected> is 2) print 5;]"#
+        );
+    }
+    #[test]
+    fn test_when_breaker() {
+        let expr = dan::FileParser::new()
+            .parse(
+                false,
+                r#"when <door> changed breaker 5 per 1m for 10m print 5;"#,
+            )
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when <door> changed breaker 5 per 1m for 10m print 5;]"#
+        );
+    }
+    #[test]
     fn test_as() {
-        let expr = dan::FileParser::new().parse(r#"print x as y y;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print x as y y;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print x as y y;]"#);
         let expr = dan::FileParser::new()
-            .parse(r#"print x as a y as b b + c;"#)
+            .parse(false, r#"print x as a y as b b + c;"#)
             .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print x as a y as b (b + c);]"#);
         let expr = dan::FileParser::new()
-            .parse(r#"print 1 + 2 * 3 as a a / 4;"#)
+            .parse(false, r#"print 1 + 2 * 3 as a a / 4;"#)
             .unwrap();
         assert_eq!(
             &format!("{:?}", expr),
@@ -149,49 +469,517 @@ mod parser {
     }
     #[test]
     fn test_wait() {
-        let expr = dan::FileParser::new().parse(r#"wait 1s print 0;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"wait 1s print 0;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[wait 1s print 0;]"#);
     }
     #[test]
+    fn test_wait_until() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"wait until <ready> is "on" for 1m print 0;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[wait until (<ready> is "on") for 1m print 0;]"#
+        );
+    }
+    #[test]
     fn test_at() {
-        let expr = dan::FileParser::new().parse(r#"at x print 0;"#).unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, r#"at x print 0;"#)
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[at x print 0;]"#);
     }
     #[test]
     fn test_print() {
-        let expr = dan::FileParser::new().parse(r#"print 0;"#).unwrap();
+        let expr = dan::FileParser::new().parse(false, r#"print 0;"#).unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[print 0;]"#);
     }
     #[test]
     fn test_scene() {
         let expr = dan::FileParser::new()
-            .parse(r#"scene a { print 0;};"#)
+            .parse(false, r#"scene a { print 0;};"#)
             .unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[scene a [print 0;];]"#);
     }
     #[test]
+    fn test_nested_scene() {
+        let err = parse("scene a {\n    at 10:00PM {\n        scene b { print 0; };\n    };\n};")
+            .unwrap_err();
+        assert_eq!("3:9: scenes cannot be nested", err.to_string());
+    }
+    #[test]
     fn test_start() {
-        let expr = dan::FileParser::new().parse(r#"start a;"#).unwrap();
+        let expr = dan::FileParser::new().parse(false, r#"start a;"#).unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[start a;]"#);
     }
     #[test]
     fn test_stop() {
-        let expr = dan::FileParser::new().parse(r#"stop a;"#).unwrap();
+        let expr = dan::FileParser::new().parse(false, r#"stop a;"#).unwrap();
         assert_eq!(&format!("{:?}", expr), r#"[stop a;]"#);
+
+        let expr = dan::FileParser::new()
+            .parse(true, r#"stop when <kitchen.+>;"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[stop when <kitchen/+>;]"#);
+
+        let expr = dan::FileParser::new()
+            .parse(false, r#"stop at 7:00AM;"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[stop at 7:00AM;]"#);
+    }
+    #[test]
+    fn test_guard() {
+        let expr = dan::FileParser::new()
+            .parse(
+                false,
+                r#"after 6:00PM set [porch/light] "on"; before #noon { print "morning"; };"#,
+            )
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[after 6:00PM set porch/light "on"; before #noon [print "morning";];]"#
+        );
+    }
+    #[test]
+    fn test_and() {
+        let expr = dan::FileParser::new()
+            .parse(
+                false,
+                r#"when <front/lock> is "locked" and <back/lock> is "locked" print 1 and 0;"#,
+            )
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when ((<front/lock> is "locked") and (<back/lock> is "locked")) print (1 and 0);]"#
+        );
+    }
+    #[test]
+    fn test_trigger_path() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when <home/+/motion> is "detected" print $path;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when (<home/+/motion> is "detected") print $path;]"#
+        );
+    }
+    #[test]
+    fn test_debounce() {
+        let expr = dan::FileParser::new()
+            .parse(
+                false,
+                r#"when <motion> is "detected" debounce 5m set [hall/light] "off";"#,
+            )
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when (<motion> is "detected") debounce 5m set hall/light "off";]"#
+        );
+    }
+    #[test]
+    fn test_prev() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when <dimmer> changed print $prev;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when <dimmer> changed print $prev;]"#
+        );
+    }
+    #[test]
+    fn test_arm() {
+        let expr = dan::FileParser::new().parse(false, r#"arm a;"#).unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[arm a;]"#);
+    }
+    #[test]
+    fn test_trigger() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when <lux> set [light] $value;"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[when <lux> set light $value;]"#);
+    }
+    #[test]
+    fn test_dotted_path() {
+        let expr = dan::FileParser::new()
+            .parse(true, r#"set [home.livingroom.light] <home.kitchen.light>;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[set home/livingroom/light <home/kitchen/light>;]"#
+        );
+
+        let expr = dan::FileParser::new().parse(true, r#"print 1.5;"#).unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[print 1.5;]"#);
+
+        let expr = dan::FileParser::new()
+            .parse(true, r#"print <sensor.v1.5.temp>;"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[print <sensor/v1.5/temp>;]"#);
+
+        // Unless dotted, a . is part of the topic.
+        let expr = dan::FileParser::new()
+            .parse(false, r#"set [zigbee/0x00.light] <sensor.v1/temp>;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[set zigbee/0x00.light <sensor.v1/temp>;]"#
+        );
+    }
+    #[test]
+    fn test_within() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print <room/temp> within 5s else 20; when <room/temp> within 1m > 25 print 1; print <a> within 1s else (<b> within 1s else x);"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[print (<room/temp> within 5s else 20); when ((<room/temp> within 1m) > 25) print 1; print (<a> within 1s else (<b> within 1s else x));]"#
+        );
+        assert!(dan::FileParser::new()
+            .parse(false, "print <a> within 5 else 20;")
+            .is_err());
+        assert!(dan::FileParser::new()
+            .parse(false, "print <a> within 5s else;")
+            .is_err());
+    }
+    #[test]
+    fn test_quoted_path() {
+        let expr = dan::FileParser::new()
+            .parse(true, r#"set ["Living Room"/light/set] "off"; when <home."Living Room.2".light> is "on" print 1;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[set Living Room/light/set "off"; when (<home/Living Room.2/light> is "on") print 1;]"#
+        );
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print avg <+/"Temp Sensor"/temp> < 20;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[print (avg <+/Temp Sensor/temp> < 20);]"#
+        );
+        assert!(dan::FileParser::new()
+            .parse(false, r#"set [Living Room/light] "off";"#)
+            .is_err());
+    }
+    #[test]
+    fn test_assert() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"assert <bedroom/light> is "on";"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[assert (<bedroom/light> is "on");]"#
+        );
+    }
+    #[test]
+    fn test_aggregate() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"print avg <+/temp>; print max <+/temp> is 30;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[print avg <+/temp>; print (max <+/temp> is 30);]"#
+        );
+        // The aggregates are only special before a path.
+        let expr = dan::FileParser::new()
+            .parse(false, r#"let count = 2; print count * sum <+/power>;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[let count = 2; print (count * sum <+/power>);]"#
+        );
+        let err = parse("print total <+/power>;").unwrap_err();
+        assert_eq!(
+            "1:7: aggregate must be avg, min, max, sum or count",
+            err.to_string()
+        );
+    }
+    #[test]
+    fn test_trend() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when <hall/temp> rising print "up"; when <hall/temp> decreased by 2 in 10m print "down";"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when (<hall/temp> rising) print "up"; when (<hall/temp> decreased by 2 in 10m) print "down";]"#
+        );
+        let expr = dan::FileParser::new()
+            .parse(
+                false,
+                "print <a> falling; print <a> increased by 0.5 + x in 1h;",
+            )
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            "[print (<a> falling); print (<a> increased by (0.5 + x) in 1h);]"
+        );
+        assert!(dan::FileParser::new()
+            .parse(false, "print <a> increased 2 in 10m;")
+            .is_err());
+        assert!(dan::FileParser::new()
+            .parse(false, "print 1 rising;")
+            .is_err());
+    }
+    #[test]
+    fn test_range() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when <bath/humidity> is outside 40..60 print "alert"; print 5 is inside 1.5..x + 1;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when (<bath/humidity> is outside 40..60) print "alert"; print (5 is inside 1.5..(x + 1));]"#
+        );
+        assert!(dan::FileParser::new()
+            .parse(false, "print 5 is inside 1..;")
+            .is_err());
+    }
+    #[test]
+    fn test_hysteresis() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when <temp> > 25 hysteresis 1 set [fan] "on"; when <temp> < 24 set [fan] "off";"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when (<temp> > 25) hysteresis 1 set fan "on"; when (<temp> < 24) set fan "off";]"#
+        );
+    }
+    #[test]
+    fn test_hysteresis_without_comparison() {
+        let err = parse("print 0;\nwhen <temp> is \"hot\" hysteresis 1 print 1;").unwrap_err();
+        let err = err.downcast_ref::<SyntaxError>().unwrap();
+        assert_eq!("hysteresis requires a numeric comparison", err.message);
+        assert_eq!(Position { line: 2, column: 6 }, err.start);
+        assert_eq!(
+            Position {
+                line: 2,
+                column: 21
+            },
+            err.end
+        );
+    }
+    #[test]
+    fn test_when_changed() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"when <thermostat/setpoint> changed print $value;"#)
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when <thermostat/setpoint> changed print $value;]"#
+        );
+    }
+    #[test]
+    fn test_when_live() {
+        let expr = dan::FileParser::new()
+            .parse(
+                false,
+                r#"when <front/door> is "open" live changed print $value;"#,
+            )
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[when (<front/door> is "open") live changed print $value;]"#
+        );
+    }
+    #[test]
+    fn test_malformed_literals() {
+        for source in &[
+            "print 99999999999999999999;",
+            "print 99999999999999999999s;",
+            "wait 9999999999999999h print 1;",
+            "at 13:00PM print 1;",
+            "at 10:75AM print 1;",
+            "at 99999999999:00AM print 1;",
+        ] {
+            assert!(
+                dan::FileParser::new().parse(false, source).is_err(),
+                "{} must not parse",
+                source
+            );
+        }
+    }
+    #[test]
+    fn test_scene_disabled() {
+        let expr = dan::FileParser::new()
+            .parse(
+                false,
+                r#"scene vacation disabled { print "away"; }; enable vacation; disable vacation;"#,
+            )
+            .unwrap();
+        assert_eq!(
+            &format!("{:?}", expr),
+            r#"[scene vacation disabled [print "away";]; enable vacation; disable vacation;]"#
+        );
+    }
+    #[test]
+    fn test_publish() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"publish [dan/comfort] "ok";"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[publish dan/comfort "ok";]"#);
+    }
+    #[test]
+    fn test_clear() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"clear [path/to/value];"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[clear path/to/value;]"#);
+    }
+    #[test]
+    fn test_include() {
+        let expr = dan::FileParser::new()
+            .parse(false, r#"include "scenes/common.dan";"#)
+            .unwrap();
+        assert_eq!(&format!("{:?}", expr), r#"[include "scenes/common.dan";]"#);
+    }
+    #[test]
+    fn test_compile_include() {
+        // Without a file the include cannot be resolved.
+        let err = crate::compiler::Interpreter::from_source(
+            "print 1;\nscene s { include \"common.dan\"; };",
+        )
+        .unwrap_err();
+        let err = err.downcast_ref::<SyntaxError>().unwrap();
+        assert_eq!(
+            Position {
+                line: 2,
+                column: 11
+            },
+            err.start
+        );
+        assert_eq!(
+            "include requires loading the program from a file",
+            err.message
+        );
+    }
+    #[test]
+    fn test_compile_undefined() {
+        let err = crate::compiler::Interpreter::from_source("print x;").unwrap_err();
+        assert_eq!(
+            Some(&loader::UndefinedVariable {
+                name: "x".to_string(),
+                location: SOURCE.to_string(),
+            }),
+            err.downcast_ref::<loader::UndefinedVariable>()
+        );
+        let err = crate::compiler::Interpreter::from_source("print 1;\nstart night;").unwrap_err();
+        assert_eq!(
+            Some(&loader::UndefinedScene {
+                name: "night".to_string(),
+                file: SOURCE.to_string(),
+                position: Position { line: 2, column: 1 },
+            }),
+            err.downcast_ref::<loader::UndefinedScene>()
+        );
+    }
+    #[test]
+    fn test_suggestion() {
+        let err = parse("print 1;\nste [a/b] \"on\";").unwrap_err();
+        assert!(err.to_string().ends_with("did you mean 'set'?"), "{}", err);
+        let err = parse("scene s { prnit 1; }").unwrap_err();
+        assert!(
+            err.to_string().ends_with("did you mean 'print'?"),
+            "{}",
+            err
+        );
+        let err = parse("set [a/b] \"on\"").unwrap_err();
+        assert!(!err.to_string().contains("did you mean"), "{}", err);
+    }
+    #[test]
+    fn test_syntax_error() {
+        let err = parse("print 1;\nprint 1 \"multi\nline\";").unwrap_err();
+        let err = err.downcast_ref::<SyntaxError>().unwrap();
+        assert_eq!(Position { line: 2, column: 9 }, err.start);
+        assert_eq!(Position { line: 3, column: 6 }, err.end);
+        assert!(err.to_string().starts_with("2:9: "), "{}", err);
+
+        let err = parse("print \"é\" x;").unwrap_err();
+        let err = err.downcast_ref::<SyntaxError>().unwrap();
+        assert_eq!(
+            Position {
+                line: 1,
+                column: 11
+            },
+            err.start
+        );
+        assert_eq!(
+            Position {
+                line: 1,
+                column: 12
+            },
+            err.end
+        );
+
+        let err = parse("print").unwrap_err();
+        let err = err.downcast_ref::<SyntaxError>().unwrap();
+        assert_eq!(err.start, err.end);
+    }
+    #[test]
+    fn test_json() {
+        let ast = parse(r#"when <door> is "open" cooldown 5s set [light] {on: 1};"#).unwrap();
+        let json = serde_json::to_value(&ast).unwrap();
+        assert_eq!(
+            json,
+            serde_json::json!({"kind": "block", "args": [{
+                "kind": "when",
+                "args": [
+                    {"kind": "binary", "args": [
+                        {"kind": "path", "args": "door"},
+                        "eql",
+                        {"kind": "string", "args": "open"},
+                    ]},
+                    [{"kind": "cooldown", "args": {"kind": "duration", "args": "5s"}}],
+                    {"kind": "set", "args": [
+                        ["light"],
+                        {"kind": "object", "args": [["on", {"kind": "integer", "args": 1}]]},
+                        false,
+                    ]},
+                ],
+            }]})
+        );
+        let json = serde_json::to_value(&parse("print $value;").unwrap()).unwrap();
+        assert_eq!(
+            json["args"][0]["args"],
+            serde_json::json!({"kind": "trigger"})
+        );
+    }
+    #[test]
+    fn test_json_round_trip() {
+        let ast = parse(
+            r#"
+            let limit = 2.5;
+            scene evening disabled {
+                set urgent [hall/light[12]] {on: 1, level: limit * 2};
+                when <hall/temp> increased by 2 in 10m cooldown 5m print $prev;
+                at 10:00PM repeat 3 stop evening;
+            };
+            when <+/motion> is "on" live debounce 1s print $path;
+            after 6:00AM publish [dan/mode] $unknown;
+            assert avg <+/temp> is outside 18..24;
+        "#,
+        )
+        .unwrap();
+        let json = serde_json::to_string(&ast).unwrap();
+        assert_eq!(ast, serde_json::from_str::<ast::Stmt>(&json).unwrap());
     }
     #[test]
     fn test_binary_expr() {
-        let expr = dan::FileParser::new().parse("").unwrap();
+        let expr = dan::FileParser::new().parse(false, "").unwrap();
         assert_eq!(&format!("{:?}", expr), "[]");
 
-        let expr = dan::FileParser::new().parse("print 22 * 44 + 66;").unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, "print 22 * 44 + 66;")
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), "[print ((22 * 44) + 66);]");
 
-        let expr = dan::FileParser::new().parse("print 22 * 44 + 66;").unwrap();
+        let expr = dan::FileParser::new()
+            .parse(false, "print 22 * 44 + 66;")
+            .unwrap();
         assert_eq!(&format!("{:?}", expr), "[print ((22 * 44) + 66);]");
 
         let expr = dan::FileParser::new()
-            .parse("print 22 * 44 + 66;print 13*3;")
+            .parse(false, "print 22 * 44 + 66;print 13*3;")
             .unwrap();
         assert_eq!(
             &format!("{:?}", expr),
@@ -199,7 +987,7 @@ mod parser {
         );
 
         let expr = dan::FileParser::new()
-            .parse("print 22 * 44 + 66; print 13*3;")
+            .parse(false, "print 22 * 44 + 66; print 13*3;")
             .unwrap();
         assert_eq!(
             &format!("{:?}", expr),
@@ -209,6 +997,61 @@ mod parser {
 
     #[test]
     fn test_fail() {
-        assert!(dan::FileParser::new().parse("@").is_err());
+        assert!(dan::FileParser::new().parse(false, "@").is_err());
+    }
+
+    /// Sources the fuzz test mutates, taken from the tests of the parser, compiler and vm.
+    const FUZZ_SEEDS: &[&str] = &[
+        r#"print "string with spaces";"#,
+        "print 22 * 44 + 66; print 13*3;",
+        "print {a: 1, b: {c: 2.5}};",
+        "let x = 1; print {a: <a/b>, b: {c: x}};",
+        "let o = {x: 1}; print o.x; print 1 as x x;",
+        r#"scene night { set [kitchen/light] "off"; };"#,
+        r#"scene vacation disabled { print "away"; }; start vacation; enable vacation; disable vacation; stop vacation; arm vacation;"#,
+        r#"when <front/door> is "open" cooldown 60s changed print $value;"#,
+        "when <dimmer> > 15 { set [dimmer/from] $prev; set [dimmer/to] $value; };",
+        r#"when <motion> is "detected" debounce 50ms print $value;"#,
+        r#"when <motion> breaker 2 per 1m for 10m set [porch/light] "on";"#,
+        "when <bath/humidity> is outside 40..60 print $value;",
+        r#"wait until <garage/door> is "closed" for 5m print "closed";"#,
+        r#"wait 1s print "done";"#,
+        "at 10:00PM start night; at #sunrise stop night;",
+        r#"at 8:00AM repeat 3 print "pill";"#,
+        r#"include "scenes/common.dan"; assert max <+/temp> is 30;"#,
+        "set [home.livingroom.light] <home.kitchen.light>.brightness;",
+        "print <temp> within 50ms else 20; print online <zwave>;",
+    ];
+    /// Tokens the fuzz test inserts, so that the mutations are often valid enough to compile.
+    const FUZZ_TOKENS: &[&str] = &[
+        ";", "{", "}", "(", ")", ".", ",", "print", "let", "x", "as", "set", "[a/b]", "<a/b>",
+        "when", "is", "and", "at", "repeat", "wait", "until", "for", "scene", "s", "start", "stop",
+        "arm", "enable", "disable", "1", "0", "2.5", "\"on\"", "10s", "7:00AM", "#sunset", "+",
+        "-", "*", "/", ">", "<", ":", "$value", "$prev", "inside", "1..2",
+    ];
+
+    proptest! {
+        #![proptest_config(ProptestConfig::with_cases(1000))]
+        #[test]
+        fn test_fuzz(
+            seed in prop::sample::select(FUZZ_SEEDS),
+            edits in prop::collection::vec(
+                (any::<prop::sample::Index>(), 0..3u8, prop::sample::select(FUZZ_TOKENS)),
+                1..5,
+            ),
+        ) {
+            let mut source: Vec<char> = seed.chars().collect();
+            for (i, edit, token) in edits {
+                let i = i.index(source.len() + 1);
+                match edit {
+                    0 => source.splice(i..i, format!(" {} ", token).chars()).for_each(drop),
+                    1 => source.drain(i..(i + token.len()).min(source.len())).for_each(drop),
+                    _ => source.truncate(i),
+                }
+            }
+            let source: String = source.into_iter().collect();
+            // Only a panic fails the test, most mutations are expected to be errors.
+            let _ = compiler::Interpreter::from_source(&source);
+        }
     }
 }
@@ -0,0 +1,184 @@
+use anyhow::Result;
+use async_trait::async_trait;
+use std::{num::NonZeroU32, sync::Arc, time::Duration};
+use tokio::{
+    sync::{Mutex, Semaphore},
+    time,
+};
+
+use crate::{mqtt_engine::Sample, vm::Engine};
+
+/// Limiter is an engine that throttles the sets and clears of another engine
+/// so that a scene setting many devices at once does not overwhelm the broker.
+/// Publishes over the rate wait for their turn instead of being dropped.
+/// It may also bound how many gets wait for a value at once, the others queue.
+#[derive(Debug, Clone)]
+pub struct Limiter<E: Engine> {
+    engine: E,
+    interval: Option<Duration>,
+    // The earliest time the next publish may happen.
+    next: Arc<Mutex<time::Instant>>,
+    gets: Option<Arc<Semaphore>>,
+}
+
+impl<E: Engine> Limiter<E> {
+    /// Creates a limiter allowing rate publishes per second,
+    /// without a rate publishes are not limited.
+    pub fn new(engine: E, rate: Option<NonZeroU32>) -> Self {
+        Self {
+            engine,
+            interval: rate.map(|rate| Duration::from_secs(1) / rate.get()),
+            next: Arc::new(Mutex::new(time::Instant::now())),
+            gets: None,
+        }
+    }
+    /// Allows at most max gets to wait for a value at once, later gets wait for their turn.
+    /// A when keeps a get waiting until its path changes,
+    /// so the limit must leave room for every when of the programs.
+    pub fn with_max_gets(mut self, max: usize) -> Self {
+        self.gets = Some(Arc::new(Semaphore::new(max.max(1))));
+        self
+    }
+    async fn wait(&self) {
+        if let Some(interval) = self.interval {
+            let mut next = self.next.lock().await;
+            let now = time::Instant::now();
+            if *next > now {
+                time::sleep_until(*next).await;
+                *next += interval;
+            } else {
+                *next = now + interval;
+            }
+        }
+    }
+    /// Waits for a turn to get a value, the turn ends once the permit is dropped.
+    async fn permit(&self) -> Result<Option<tokio::sync::SemaphorePermit<'_>>> {
+        match &self.gets {
+            Some(gets) => Ok(Some(gets.acquire().await?)),
+            None => Ok(None),
+        }
+    }
+}
+
+#[async_trait]
+impl<E: Engine + 'static> Engine for Limiter<E> {
+    async fn get(&self, path: &str) -> Result<Vec<u8>> {
+        let _permit = self.permit().await?;
+        self.engine.get(path).await
+    }
+    async fn get_live(&self, path: &str) -> Result<Vec<u8>> {
+        let _permit = self.permit().await?;
+        self.engine.get_live(path).await
+    }
+    async fn get_topic(&self, path: &str, live: bool) -> Result<(String, Vec<u8>)> {
+        let _permit = self.permit().await?;
+        self.engine.get_topic(path, live).await
+    }
+    async fn subscribe(&self, path: &str) -> Result<()> {
+        self.engine.subscribe(path).await
+    }
+    async fn set(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        self.wait().await;
+        self.engine.set(path, value).await
+    }
+    async fn publish(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        self.wait().await;
+        self.engine.publish(path, value).await
+    }
+    async fn clear(&self, path: &str) -> Result<()> {
+        self.wait().await;
+        self.engine.clear(path).await
+    }
+    async fn find(&self, path: &str) -> Result<Vec<Vec<u8>>> {
+        self.engine.find(path).await
+    }
+    async fn history(&self, path: &str) -> Result<Vec<Sample>> {
+        self.engine.history(path).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::atomic::{AtomicUsize, Ordering};
+
+    use super::*;
+
+    #[derive(Debug, Clone)]
+    struct TestEngine {
+        sets: Arc<AtomicUsize>,
+        // The gets waiting for a value and the most that ever waited at once.
+        gets: Arc<AtomicUsize>,
+        max_gets: Arc<AtomicUsize>,
+    }
+
+    impl TestEngine {
+        fn new() -> Self {
+            Self {
+                sets: Arc::new(AtomicUsize::new(0)),
+                gets: Arc::new(AtomicUsize::new(0)),
+                max_gets: Arc::new(AtomicUsize::new(0)),
+            }
+        }
+    }
+
+    #[async_trait]
+    impl Engine for TestEngine {
+        async fn get(&self, _path: &str) -> Result<Vec<u8>> {
+            let gets = self.gets.fetch_add(1, Ordering::SeqCst) + 1;
+            self.max_gets.fetch_max(gets, Ordering::SeqCst);
+            time::sleep(Duration::from_millis(10)).await;
+            self.gets.fetch_sub(1, Ordering::SeqCst);
+            Ok(Vec::new())
+        }
+        async fn set(&self, _path: &str, _value: Vec<u8>) -> Result<()> {
+            self.sets.fetch_add(1, Ordering::SeqCst);
+            Ok(())
+        }
+        async fn publish(&self, _path: &str, _value: Vec<u8>) -> Result<()> {
+            self.sets.fetch_add(1, Ordering::SeqCst);
+            Ok(())
+        }
+        async fn clear(&self, _path: &str) -> Result<()> {
+            self.sets.fetch_add(1, Ordering::SeqCst);
+            Ok(())
+        }
+    }
+
+    #[tokio::test]
+    async fn test_limit() {
+        let te = TestEngine::new();
+        let limiter = Limiter::new(te.clone(), NonZeroU32::new(50));
+
+        let start = time::Instant::now();
+        for _ in 0..5 {
+            limiter.set("light", "on".into()).await.unwrap();
+        }
+        // The first publish is immediate, the other four wait 20ms each.
+        assert!(start.elapsed() >= Duration::from_millis(80));
+        assert_eq!(5, te.sets.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_no_limit() {
+        let te = TestEngine::new();
+        let limiter = Limiter::new(te.clone(), None);
+
+        let start = time::Instant::now();
+        for _ in 0..100 {
+            limiter.set("light", "on".into()).await.unwrap();
+        }
+        assert!(start.elapsed() < Duration::from_millis(80));
+        assert_eq!(100, te.sets.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_max_gets() {
+        let te = TestEngine::new();
+        let limiter = Limiter::new(te.clone(), None).with_max_gets(2);
+
+        let gets = (0..6).map(|_| limiter.get("light"));
+        for get in futures::future::join_all(gets).await {
+            get.unwrap();
+        }
+        // Every get completed while at most two waited at once.
+        assert_eq!(2, te.max_gets.load(Ordering::SeqCst));
+    }
+}
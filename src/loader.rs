@@ -0,0 +1,821 @@
+use anyhow::anyhow;
+use std::{
+    collections::BTreeSet,
+    fmt, fs,
+    path::{Path, PathBuf},
+};
+
+use crate::{
+    ast::{nested_scene, BinaryOpcode, Expr, Stmt, WhenOption},
+    mqtt_engine::topic_matches,
+    parse_with, Position, Result,
+};
+
+/// UndefinedScene is the error of a statement using a scene that is not in scope where it is used,
+/// i.e. misspelled, not defined yet or defined within another block,
+/// along with the file and position of the statement.
+#[derive(Debug, Clone, PartialEq)]
+pub struct UndefinedScene {
+    pub name: String,
+    pub file: String,
+    pub position: Position,
+}
+
+impl fmt::Display for UndefinedScene {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}:{}:{}: undefined scene {}",
+            self.file, self.position.line, self.position.column, self.name
+        )
+    }
+}
+
+impl std::error::Error for UndefinedScene {}
+
+/// UndefinedVariable is the error of an expression using a variable that is not in scope,
+/// along with the file of the program.
+#[derive(Debug, Clone, PartialEq)]
+pub struct UndefinedVariable {
+    pub name: String,
+    pub location: String,
+}
+
+impl fmt::Display for UndefinedVariable {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: undefined variable {}", self.location, self.name)
+    }
+}
+
+impl std::error::Error for UndefinedVariable {}
+
+/// UnsupportedOperator is the error of an expression using an operator the compiler
+/// does not support yet, i.e. the arithmetic operators, along with the file of the program.
+#[derive(Debug, Clone, PartialEq)]
+pub struct UnsupportedOperator {
+    pub operator: BinaryOpcode,
+    pub location: String,
+}
+
+impl fmt::Display for UnsupportedOperator {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "{}: operator {} is not supported",
+            self.location, self.operator
+        )
+    }
+}
+
+impl std::error::Error for UnsupportedOperator {}
+
+/// Loads the dan file at path, inlining the statements of any included files.
+/// When dotted the paths may use . as the separator, see ast::canonical_path.
+pub fn load(path: &Path, dotted: bool) -> Result<Stmt> {
+    let source = fs::read_to_string(path)?;
+    load_source(&source, path, dotted)
+}
+
+/// Parses the source, inlining the statements of any included files.
+/// Included files are resolved relative to the directory of path.
+/// A statement using a scene that is not in scope, the same scope a variable defined
+/// in its place would have, is an UndefinedScene error
+/// and using a variable that is not in scope is an UndefinedVariable error.
+/// Using an arithmetic operator is an UnsupportedOperator error.
+pub fn load_source(source: &str, path: &Path, dotted: bool) -> Result<Stmt> {
+    check(parse_with(source, dotted)?, source, path, dotted)
+}
+
+/// Resolves the includes of the statement parsed from the source at path
+/// and checks the scenes and variables it uses, see load_source.
+pub fn check(stmt: Stmt, source: &str, path: &Path, dotted: bool) -> Result<Stmt> {
+    let mut stack = vec![path.canonicalize().unwrap_or_else(|_| path.to_path_buf())];
+    let mut scenes = Scenes::default();
+    let stmt = resolve(stmt, path, source, &mut stack, &mut scenes, dotted)?;
+    if let Some(name) = undefined_variable(&stmt, &mut vec![BTreeSet::new()]) {
+        return Err(UndefinedVariable {
+            name,
+            location: path.display().to_string(),
+        }
+        .into());
+    }
+    if let Some(operator) = unsupported_operator(&stmt) {
+        return Err(UnsupportedOperator {
+            operator,
+            location: path.display().to_string(),
+        }
+        .into());
+    }
+    Ok(stmt)
+}
+
+/// Returns the first variable used by the statement that is not in scope,
+/// the scopes hold the variables defined by each enclosing block so far.
+fn undefined_variable(stmt: &Stmt, scopes: &mut Vec<BTreeSet<String>>) -> Option<String> {
+    match stmt {
+        Stmt::Block(stmts) => {
+            scopes.push(BTreeSet::new());
+            let undefined = stmts.iter().find_map(|s| undefined_variable(s, scopes));
+            scopes.pop();
+            undefined
+        }
+        Stmt::Let(id, expr) => {
+            let undefined = undefined_in(expr, scopes);
+            define(scopes, id);
+            undefined
+        }
+        Stmt::Scene(id, _, body, _) => {
+            define(scopes, id);
+            undefined_variable(body, scopes)
+        }
+        Stmt::When(cond, options, body) => undefined_in(cond, scopes)
+            .or_else(|| {
+                options.iter().find_map(|o| match o {
+                    WhenOption::Cooldown(e)
+                    | WhenOption::Hysteresis(e)
+                    | WhenOption::Debounce(e) => undefined_in(e, scopes),
+                    WhenOption::Breaker(n, w, d) => {
+                        [n, w, d].iter().find_map(|e| undefined_in(e, scopes))
+                    }
+                    WhenOption::Changed | WhenOption::Live => None,
+                })
+            })
+            .or_else(|| undefined_variable(body, scopes)),
+        Stmt::At(e, None, body) | Stmt::Wait(e, body) | Stmt::Guard(_, e, body) => {
+            undefined_in(e, scopes).or_else(|| undefined_variable(body, scopes))
+        }
+        Stmt::At(e, Some(other), body) | Stmt::WaitUntil(e, other, body) => undefined_in(e, scopes)
+            .or_else(|| undefined_in(other, scopes))
+            .or_else(|| undefined_variable(body, scopes)),
+        Stmt::Expr(e)
+        | Stmt::Print(e)
+        | Stmt::Set(_, e, _)
+        | Stmt::Publish(_, e)
+        | Stmt::StopAt(e)
+        | Stmt::Assert(e, _, _) => undefined_in(e, scopes),
+        _ => None,
+    }
+}
+
+/// Returns the first variable used by the expression that is not in scope.
+fn undefined_in(expr: &Expr, scopes: &mut Vec<BTreeSet<String>>) -> Option<String> {
+    match expr {
+        Expr::Ident(id) if !scopes.iter().any(|s| s.contains(id)) => Some(id.clone()),
+        Expr::As(init, id, cont) => undefined_in(init, scopes).or_else(|| {
+            scopes.push(BTreeSet::new());
+            define(scopes, id);
+            let undefined = undefined_in(cont, scopes);
+            scopes.pop();
+            undefined
+        }),
+        Expr::Binary(l, _, r) => undefined_in(l, scopes).or_else(|| undefined_in(r, scopes)),
+        Expr::Object(props) => props.iter().find_map(|(_, e)| undefined_in(e, scopes)),
+        Expr::Index(e, _) => undefined_in(e, scopes),
+        Expr::Range(e, _, lo, hi) => [e, lo, hi].iter().find_map(|e| undefined_in(e, scopes)),
+        Expr::Change(_, _, by, window) => {
+            undefined_in(by, scopes).or_else(|| undefined_in(window, scopes))
+        }
+        Expr::Within(_, timeout, default) => undefined_in(timeout, scopes)
+            .or_else(|| default.as_ref().and_then(|d| undefined_in(d, scopes))),
+        _ => None,
+    }
+}
+
+/// Returns the first operator used by the statement that the compiler does not support.
+fn unsupported_operator(stmt: &Stmt) -> Option<BinaryOpcode> {
+    match stmt {
+        Stmt::Block(stmts) => stmts.iter().find_map(unsupported_operator),
+        Stmt::Scene(_, _, body, _) => unsupported_operator(body),
+        Stmt::When(cond, options, body) => unsupported_in(cond)
+            .or_else(|| {
+                options.iter().find_map(|o| match o {
+                    WhenOption::Cooldown(e)
+                    | WhenOption::Hysteresis(e)
+                    | WhenOption::Debounce(e) => unsupported_in(e),
+                    WhenOption::Breaker(n, w, d) => {
+                        [n, w, d].iter().find_map(|e| unsupported_in(e))
+                    }
+                    WhenOption::Changed | WhenOption::Live => None,
+                })
+            })
+            .or_else(|| unsupported_operator(body)),
+        Stmt::At(e, None, body) | Stmt::Wait(e, body) | Stmt::Guard(_, e, body) => {
+            unsupported_in(e).or_else(|| unsupported_operator(body))
+        }
+        Stmt::At(e, Some(other), body) | Stmt::WaitUntil(e, other, body) => unsupported_in(e)
+            .or_else(|| unsupported_in(other))
+            .or_else(|| unsupported_operator(body)),
+        Stmt::Let(_, e)
+        | Stmt::Expr(e)
+        | Stmt::Print(e)
+        | Stmt::Set(_, e, _)
+        | Stmt::Publish(_, e)
+        | Stmt::StopAt(e)
+        | Stmt::Assert(e, _, _) => unsupported_in(e),
+        _ => None,
+    }
+}
+
+/// Returns the first operator used by the expression that the compiler does not support,
+/// the arithmetic operators are parsed but not compiled yet.
+fn unsupported_in(expr: &Expr) -> Option<BinaryOpcode> {
+    match expr {
+        Expr::Binary(
+            _,
+            op @ (BinaryOpcode::Add | BinaryOpcode::Sub | BinaryOpcode::Mul | BinaryOpcode::Div),
+            _,
+        ) => Some(*op),
+        Expr::Binary(l, _, r) | Expr::As(l, _, r) => {
+            unsupported_in(l).or_else(|| unsupported_in(r))
+        }
+        Expr::Object(props) => props.iter().find_map(|(_, e)| unsupported_in(e)),
+        Expr::Index(e, _) => unsupported_in(e),
+        Expr::Range(e, _, lo, hi) => [e, lo, hi].iter().find_map(|e| unsupported_in(e)),
+        Expr::Change(_, _, by, window) => unsupported_in(by).or_else(|| unsupported_in(window)),
+        Expr::Within(_, timeout, default) => {
+            unsupported_in(timeout).or_else(|| default.as_ref().and_then(|d| unsupported_in(d)))
+        }
+        _ => None,
+    }
+}
+
+fn define(scopes: &mut [BTreeSet<String>], id: &str) {
+    if let Some(scope) = scopes.last_mut() {
+        scope.insert(id.to_string());
+    }
+}
+
+/// Returns the statements reading or writing a path matching the path,
+/// either may have MQTT wildcards, i.e. kitchen/# finds every statement using the kitchen.
+/// A statement with a body is returned when its own expressions use the path,
+/// the statements of its body are returned on their own.
+pub fn uses<'a>(stmt: &'a Stmt, path: &str) -> Vec<&'a Stmt> {
+    let mut found = Vec::new();
+    find_uses(stmt, path, &mut found);
+    found
+}
+
+fn find_uses<'a>(stmt: &'a Stmt, path: &str, found: &mut Vec<&'a Stmt>) {
+    let mut paths = Vec::new();
+    let body = match stmt {
+        Stmt::Block(stmts) => {
+            stmts.iter().for_each(|s| find_uses(s, path, found));
+            None
+        }
+        Stmt::Scene(_, _, body, _) => Some(body),
+        Stmt::When(e, _, body)
+        | Stmt::Wait(e, body)
+        | Stmt::At(e, None, body)
+        | Stmt::Guard(_, e, body) => {
+            read_paths(e, &mut paths);
+            Some(body)
+        }
+        Stmt::At(e, Some(other), body) | Stmt::WaitUntil(e, other, body) => {
+            read_paths(e, &mut paths);
+            read_paths(other, &mut paths);
+            Some(body)
+        }
+        Stmt::Set(ps, e, _) | Stmt::Publish(ps, e) => {
+            paths.extend(ps.iter().map(String::as_str));
+            read_paths(e, &mut paths);
+            None
+        }
+        Stmt::Clear(ps) => {
+            paths.extend(ps.iter().map(String::as_str));
+            None
+        }
+        Stmt::StopWhen(p) => {
+            paths.push(p.as_str());
+            None
+        }
+        Stmt::Let(_, e)
+        | Stmt::Expr(e)
+        | Stmt::Print(e)
+        | Stmt::StopAt(e)
+        | Stmt::Assert(e, _, _) => {
+            read_paths(e, &mut paths);
+            None
+        }
+        _ => None,
+    };
+    if paths.iter().any(|p| path_matches(p, path)) {
+        found.push(stmt);
+    }
+    if let Some(body) = body {
+        find_uses(body, path, found);
+    }
+}
+
+/// Collects the paths read by the expression.
+fn read_paths<'a>(expr: &'a Expr, paths: &mut Vec<&'a str>) {
+    match expr {
+        Expr::Path(p) | Expr::Aggregate(_, p) | Expr::Trend(p, _) => paths.push(p),
+        Expr::Change(p, _, by, window) => {
+            paths.push(p);
+            read_paths(by, paths);
+            read_paths(window, paths);
+        }
+        Expr::Within(p, timeout, default) => {
+            paths.push(p);
+            read_paths(timeout, paths);
+            if let Some(default) = default {
+                read_paths(default, paths);
+            }
+        }
+        Expr::Binary(l, _, r) | Expr::As(l, _, r) => {
+            read_paths(l, paths);
+            read_paths(r, paths);
+        }
+        Expr::Object(props) => props.iter().for_each(|(_, e)| read_paths(e, paths)),
+        Expr::Index(e, _) => read_paths(e, paths),
+        Expr::Range(e, _, lo, hi) => [e, lo, hi].iter().for_each(|e| read_paths(e, paths)),
+        _ => {}
+    }
+}
+
+/// Reports whether a path of a statement, which may have wildcards,
+/// and the path looked for name any of the same topics.
+fn path_matches(used: &str, path: &str) -> bool {
+    topic_matches(path, used) || topic_matches(used, path)
+}
+
+/// Scenes holds the scenes defined by each enclosing block so far while resolving.
+#[derive(Default)]
+struct Scenes {
+    scopes: Vec<BTreeSet<String>>,
+}
+
+impl Scenes {
+    fn define(&mut self, name: &str) {
+        define(&mut self.scopes, name)
+    }
+    fn contains(&self, name: &str) -> bool {
+        self.scopes.iter().any(|s| s.contains(name))
+    }
+}
+
+/// Replaces each include statement with the statements of the included file.
+/// The stack holds the files currently being included and is used to detect cycles.
+fn resolve(
+    stmt: Stmt,
+    path: &Path,
+    source: &str,
+    stack: &mut Vec<PathBuf>,
+    scenes: &mut Scenes,
+    dotted: bool,
+) -> Result<Stmt> {
+    match stmt {
+        Stmt::Block(stmts) => {
+            scenes.scopes.push(BTreeSet::new());
+            let resolved = resolve_block(stmts, path, source, stack, scenes, dotted);
+            scenes.scopes.pop();
+            Ok(Stmt::Block(resolved?))
+        }
+        Stmt::Include(file, offset) => include(&file, offset, path, source, stack, scenes, dotted),
+        Stmt::When(expr, options, body) => Ok(Stmt::When(
+            expr,
+            options,
+            Box::new(resolve_body(*body, path, source, stack, scenes, dotted)?),
+        )),
+        Stmt::Wait(expr, body) => Ok(Stmt::Wait(
+            expr,
+            Box::new(resolve_body(*body, path, source, stack, scenes, dotted)?),
+        )),
+        Stmt::WaitUntil(cond, timeout, body) => Ok(Stmt::WaitUntil(
+            cond,
+            timeout,
+            Box::new(resolve_body(*body, path, source, stack, scenes, dotted)?),
+        )),
+        Stmt::At(expr, count, body) => Ok(Stmt::At(
+            expr,
+            count,
+            Box::new(resolve_body(*body, path, source, stack, scenes, dotted)?),
+        )),
+        Stmt::Guard(guard, expr, body) => Ok(Stmt::Guard(
+            guard,
+            expr,
+            Box::new(resolve_body(*body, path, source, stack, scenes, dotted)?),
+        )),
+        Stmt::Scene(id, options, body, offset) => {
+            // The scene is in scope of its own body, so it can stop itself.
+            scenes.define(&id);
+            let body = resolve(*body, path, source, stack, scenes, dotted)?;
+            // The parser rejects nested scenes, but an included file may still define one.
+            if nested_scene(&body).is_some() {
+                return Err(anyhow!(
+                    "{}:{}: scenes cannot be nested",
+                    path.display(),
+                    line(source, offset)
+                ));
+            }
+            Ok(Stmt::Scene(id, options, Box::new(body), offset))
+        }
+        Stmt::Start(ref id, offset)
+        | Stmt::Stop(ref id, offset)
+        | Stmt::Arm(ref id, offset)
+        | Stmt::Enable(ref id, offset)
+        | Stmt::Disable(ref id, offset)
+            if !scenes.contains(id) =>
+        {
+            Err(UndefinedScene {
+                name: id.clone(),
+                file: path.display().to_string(),
+                position: Position::of(source, offset),
+            }
+            .into())
+        }
+        // The offset alone does not tell which file a failed assert is in once includes are inlined.
+        Stmt::Assert(expr, offset, _) => {
+            let location = format!("{}:{}", path.display(), line(source, offset));
+            Ok(Stmt::Assert(expr, offset, Some(location)))
+        }
+        _ => Ok(stmt),
+    }
+}
+
+/// Resolves the statements of a block within the current scope.
+fn resolve_block(
+    stmts: Vec<Stmt>,
+    path: &Path,
+    source: &str,
+    stack: &mut Vec<PathBuf>,
+    scenes: &mut Scenes,
+    dotted: bool,
+) -> Result<Vec<Stmt>> {
+    let mut resolved = Vec::with_capacity(stmts.len());
+    for s in stmts {
+        match s {
+            // Splice included statements directly into the block so that
+            // the scenes and lets they define are in scope for the including file.
+            Stmt::Include(file, offset) => {
+                match include(&file, offset, path, source, stack, scenes, dotted)? {
+                    Stmt::Block(included) => resolved.extend(included),
+                    s => resolved.push(s),
+                }
+            }
+            s => resolved.push(resolve(s, path, source, stack, scenes, dotted)?),
+        }
+    }
+    Ok(resolved)
+}
+
+/// Resolves the body of a when, wait, at or guard in a scope of its own,
+/// a scene it defines runs on another thread so it cannot be used after it.
+fn resolve_body(
+    body: Stmt,
+    path: &Path,
+    source: &str,
+    stack: &mut Vec<PathBuf>,
+    scenes: &mut Scenes,
+    dotted: bool,
+) -> Result<Stmt> {
+    scenes.scopes.push(BTreeSet::new());
+    let resolved = resolve(body, path, source, stack, scenes, dotted);
+    scenes.scopes.pop();
+    resolved
+}
+
+fn include(
+    file: &str,
+    offset: usize,
+    path: &Path,
+    source: &str,
+    stack: &mut Vec<PathBuf>,
+    scenes: &mut Scenes,
+    dotted: bool,
+) -> Result<Stmt> {
+    let location = || format!("{}:{}", path.display(), line(source, offset));
+    let include_path = path.parent().unwrap_or(Path::new("")).join(file);
+    let canonical = include_path
+        .canonicalize()
+        .map_err(|err| anyhow!("{}: cannot include {}: {}", location(), file, err))?;
+    if stack.contains(&canonical) {
+        return Err(anyhow!(
+            "{}: include cycle: {} -> {}",
+            location(),
+            stack
+                .iter()
+                .map(|p| p.display().to_string())
+                .collect::<Vec<String>>()
+                .join(" -> "),
+            canonical.display(),
+        ));
+    }
+    let included_source = fs::read_to_string(&include_path)
+        .map_err(|err| anyhow!("{}: cannot include {}: {}", location(), file, err))?;
+    let ast = parse_with(&included_source, dotted)
+        .map_err(|err| anyhow!("{}: {}", include_path.display(), err))?;
+    stack.push(canonical);
+    // The statements of the included file are in the scope of the include.
+    let resolved = match ast {
+        Stmt::Block(stmts) => resolve_block(
+            stmts,
+            &include_path,
+            &included_source,
+            stack,
+            scenes,
+            dotted,
+        )
+        .map(Stmt::Block),
+        ast => resolve(ast, &include_path, &included_source, stack, scenes, dotted),
+    };
+    stack.pop();
+    resolved
+}
+
+/// Reports the line number of the byte offset within the source.
+pub fn line(source: &str, offset: usize) -> usize {
+    Position::of(source, offset).line
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Creates an empty directory for the test files.
+    fn test_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("dan-loader-{}", name));
+        let _ = fs::remove_dir_all(&dir);
+        fs::create_dir_all(dir.join("scenes")).unwrap();
+        dir
+    }
+
+    #[test]
+    fn test_include() {
+        let dir = test_dir("include");
+        fs::write(
+            dir.join("scenes/common.dan"),
+            "scene off { set [light] \"off\"; };",
+        )
+        .unwrap();
+        fs::write(
+            dir.join("main.dan"),
+            "include \"scenes/common.dan\"; start off;",
+        )
+        .unwrap();
+
+        let ast = load(&dir.join("main.dan"), false).unwrap();
+        assert_eq!(
+            r#"[scene off [set light "off";]; start off;]"#,
+            format!("{:?}", ast)
+        );
+    }
+    #[test]
+    fn test_include_dotted() {
+        let dir = test_dir("dotted");
+        fs::write(
+            dir.join("scenes/common.dan"),
+            "scene off { set [home.hall.light] \"off\"; };",
+        )
+        .unwrap();
+        fs::write(
+            dir.join("main.dan"),
+            "include \"scenes/common.dan\"; start off;",
+        )
+        .unwrap();
+
+        let ast = load(&dir.join("main.dan"), true).unwrap();
+        assert_eq!(
+            r#"[scene off [set home/hall/light "off";]; start off;]"#,
+            format!("{:?}", ast)
+        );
+        let ast = load(&dir.join("main.dan"), false).unwrap();
+        assert_eq!(
+            r#"[scene off [set home.hall.light "off";]; start off;]"#,
+            format!("{:?}", ast)
+        );
+    }
+    #[test]
+    fn test_include_assert() {
+        let dir = test_dir("assert");
+        fs::write(
+            dir.join("scenes/checks.dan"),
+            "print 1;\nprint 2;\nassert <light> is \"on\";",
+        )
+        .unwrap();
+        fs::write(
+            dir.join("main.dan"),
+            "include \"scenes/checks.dan\";\nassert <door> is \"closed\";",
+        )
+        .unwrap();
+
+        let ast = load(&dir.join("main.dan"), false).unwrap();
+        let locations: Vec<Option<String>> = match ast {
+            Stmt::Block(stmts) => stmts
+                .into_iter()
+                .filter_map(|s| match s {
+                    Stmt::Assert(_, _, location) => Some(location),
+                    _ => None,
+                })
+                .collect(),
+            _ => panic!("expected a block"),
+        };
+        assert_eq!(
+            vec![
+                Some(format!("{}:3", dir.join("scenes/checks.dan").display())),
+                Some(format!("{}:2", dir.join("main.dan").display())),
+            ],
+            locations
+        );
+    }
+    #[test]
+    fn test_include_missing() {
+        let dir = test_dir("missing");
+        fs::write(
+            dir.join("main.dan"),
+            "print 1;\ninclude \"scenes/missing.dan\";",
+        )
+        .unwrap();
+
+        let err = load(&dir.join("main.dan"), false).unwrap_err().to_string();
+        assert!(
+            err.starts_with(&format!(
+                "{}:2: cannot include scenes/missing.dan",
+                dir.join("main.dan").display()
+            )),
+            "unexpected error: {}",
+            err
+        );
+    }
+    #[test]
+    fn test_include_cycle() {
+        let dir = test_dir("cycle");
+        fs::write(dir.join("a.dan"), "include \"scenes/b.dan\";").unwrap();
+        fs::write(dir.join("scenes/b.dan"), "print 1;\ninclude \"../a.dan\";").unwrap();
+
+        let err = load(&dir.join("a.dan"), false).unwrap_err().to_string();
+        assert!(
+            err.starts_with(&format!(
+                "{}:2: include cycle",
+                dir.join("scenes/b.dan").display()
+            )),
+            "unexpected error: {}",
+            err
+        );
+    }
+    #[test]
+    fn test_undefined_scene() {
+        let dir = test_dir("undefined");
+        fs::write(
+            dir.join("scenes/night.dan"),
+            "scene night { stop evening; };",
+        )
+        .unwrap();
+        fs::write(
+            dir.join("main.dan"),
+            "scene evening {};\ninclude \"scenes/night.dan\";\nstart night;\nat 10:00PM {\n    start nigth;\n};",
+        )
+        .unwrap();
+
+        // The misspelled scene is an error before the program runs.
+        let err = load(&dir.join("main.dan"), false).unwrap_err();
+        assert_eq!(
+            Some(&UndefinedScene {
+                name: "nigth".to_string(),
+                file: dir.join("main.dan").display().to_string(),
+                position: Position { line: 5, column: 5 },
+            }),
+            err.downcast_ref::<UndefinedScene>()
+        );
+        assert_eq!(
+            format!(
+                "{}:5:5: undefined scene nigth",
+                dir.join("main.dan").display()
+            ),
+            err.to_string()
+        );
+    }
+    #[test]
+    fn test_undefined_scene_scope() {
+        for (source, line) in [
+            // A scene is not in scope before it is defined, even within a scene.
+            ("start night;\nscene night {};", 1),
+            ("scene evening { start night; };\nscene night {};", 1),
+            // Nor after the block or the body defining it.
+            ("{ scene night {}; };\nstop night;", 2),
+            ("at 10:00PM scene night {};\narm night;", 2),
+            ("print 1;\n  enable missing;", 2),
+        ] {
+            let err = load_source(source, Path::new("main.dan"), false).unwrap_err();
+            let undefined = err.downcast_ref::<UndefinedScene>();
+            assert_eq!(Some(line), undefined.map(|u| u.position.line), "{}", source);
+        }
+        // A scene can use itself and the scenes defined before it.
+        let source = "scene night { stop night; };\nwhen <dark> is 1 { start night; };";
+        let stmt = load_source(source, Path::new("main.dan"), false).unwrap();
+        assert_eq!(
+            "[scene night [stop night;]; when (<dark> is 1) [start night;];]",
+            format!("{:?}", stmt)
+        );
+    }
+    #[test]
+    fn test_uses() {
+        let stmt = load_source(
+            "when <kitchen/light> is \"on\" set [hall/light] \"on\";\n\
+             scene night { set [bedroom/light[12]] \"off\"; };\n\
+             print <garage/door> within 5s else \"unknown\";",
+            Path::new("main.dan"),
+            false,
+        )
+        .unwrap();
+        let found = |path| {
+            uses(&stmt, path)
+                .iter()
+                .map(|s| format!("{:?}", s))
+                .collect::<Vec<String>>()
+        };
+        assert_eq!(
+            vec![r#"when (<kitchen/light> is "on") set hall/light "on""#],
+            found("kitchen/light")
+        );
+        assert_eq!(
+            vec![
+                r#"when (<kitchen/light> is "on") set hall/light "on""#,
+                r#"set hall/light "on""#,
+            ],
+            found("+/light")
+        );
+        assert_eq!(
+            vec![r#"set bedroom/light1 bedroom/light2 "off""#],
+            found("bedroom/light2")
+        );
+        assert!(found("bedroom/light3").is_empty());
+        assert_eq!(1, found("garage/#").len());
+        assert!(found("garage/light").is_empty());
+    }
+    #[test]
+    fn test_undefined_variable() {
+        let path = Path::new("main.dan");
+        // Variables in scope, including the bindings of scenes and as bindings.
+        load_source(
+            "let x = 1;\nscene s { let y = x; print y; };\nwhen <temp> as t: t > x print x;",
+            path,
+            false,
+        )
+        .unwrap();
+        for (source, name) in [
+            ("print x;", "x"),
+            ("{ let x = 1; };\nprint x;", "x"),
+            ("scene s { print y; let y = 1; };", "y"),
+            ("when <temp> > limit print 1;", "limit"),
+            ("at 8:00AM repeat times print 1;", "times"),
+            ("print <temp> as t: t;\nprint t;", "t"),
+        ] {
+            let err = load_source(source, path, false).unwrap_err();
+            assert_eq!(
+                Some(&UndefinedVariable {
+                    name: name.to_string(),
+                    location: "main.dan".to_string(),
+                }),
+                err.downcast_ref::<UndefinedVariable>(),
+                "{}",
+                source
+            );
+        }
+    }
+    #[test]
+    fn test_unsupported_operator() {
+        let path = Path::new("main.dan");
+        load_source("print <temp> > 20 and <temp> < 25;", path, false).unwrap();
+        for (source, operator) in [
+            ("print 22 * 44 + 66;", BinaryOpcode::Add),
+            ("when <temp> > 20 - 2 print 1;", BinaryOpcode::Sub),
+            (
+                "scene s { set [light] {brightness: <lux> / 4}; };",
+                BinaryOpcode::Div,
+            ),
+        ] {
+            let err = load_source(source, path, false).unwrap_err();
+            assert_eq!(
+                Some(&UnsupportedOperator {
+                    operator,
+                    location: "main.dan".to_string(),
+                }),
+                err.downcast_ref::<UnsupportedOperator>(),
+                "{}",
+                source
+            );
+        }
+        let err = load_source("print 2 * 3;", path, false).unwrap_err();
+        assert_eq!("main.dan: operator * is not supported", err.to_string());
+    }
+    #[test]
+    fn test_nested_scene() {
+        let dir = test_dir("nested");
+        fs::write(dir.join("scenes/night.dan"), "scene night {};").unwrap();
+        fs::write(
+            dir.join("main.dan"),
+            "print 1;\nscene evening {\n    include \"scenes/night.dan\";\n};",
+        )
+        .unwrap();
+
+        let err = load(&dir.join("main.dan"), false).unwrap_err().to_string();
+        assert_eq!(
+            format!(
+                "{}:2: scenes cannot be nested",
+                dir.join("main.dan").display()
+            ),
+            err
+        );
+    }
+}
@@ -0,0 +1,136 @@
+use std::{
+    fmt::{Display, Write},
+    str::FromStr,
+    sync::atomic::{AtomicBool, Ordering},
+};
+
+use anyhow::anyhow;
+use serde_json::{json, Map, Value};
+
+/// The target of the records logged for events of running programs.
+pub const EVENT_TARGET: &str = "dan::event";
+
+static JSON: AtomicBool = AtomicBool::new(false);
+
+/// LogFormat is the format of the log records.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum LogFormat {
+    Text,
+    Json,
+}
+
+impl FromStr for LogFormat {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> anyhow::Result<Self> {
+        match s {
+            "text" => Ok(LogFormat::Text),
+            "json" => Ok(LogFormat::Json),
+            _ => Err(anyhow!("log format must be text or json")),
+        }
+    }
+}
+
+/// Sets the format used for the fields of events.
+pub fn set_format(format: LogFormat) {
+    JSON.store(format == LogFormat::Json, Ordering::SeqCst);
+}
+
+/// Logs an event, i.e. an at or when firing, along with its fields.
+pub fn event(level: log::Level, event: &str, fields: &[(&str, &dyn Display)]) {
+    log::log!(
+        target: EVENT_TARGET,
+        level,
+        "{}",
+        message(event, fields, JSON.load(Ordering::SeqCst))
+    );
+}
+
+/// Formats the message of an event, as key=value pairs or as a JSON object.
+fn message(event: &str, fields: &[(&str, &dyn Display)], json: bool) -> String {
+    if json {
+        let mut m = Map::new();
+        m.insert("event".to_string(), event.into());
+        for (k, v) in fields {
+            m.insert(k.to_string(), v.to_string().into());
+        }
+        Value::Object(m).to_string()
+    } else {
+        let mut s = event.to_string();
+        for (k, v) in fields {
+            let _ = write!(s, " {}={}", k, v);
+        }
+        s
+    }
+}
+
+/// Formats the record as a JSON object,
+/// the fields of an event are merged into the object instead of kept as the message.
+pub fn json(record: &log::Record) -> Value {
+    let message = record.args().to_string();
+    let mut line = json!({
+        "level": record.level().as_str(),
+        "target": record.target(),
+    });
+    if record.target() == EVENT_TARGET {
+        if let Ok(Value::Object(fields)) = serde_json::from_str(&message) {
+            for (k, v) in fields {
+                line[k] = v;
+            }
+            return line;
+        }
+    }
+    line["message"] = message.into();
+    line
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_json_event() {
+        let message = message("at", &[("time", &"22:0")], true);
+        let line = json(
+            &log::Record::builder()
+                .level(log::Level::Info)
+                .target(EVENT_TARGET)
+                .args(format_args!("{}", message))
+                .build(),
+        );
+        let line: Value = serde_json::from_str(&line.to_string()).unwrap();
+        assert_eq!(
+            json!({"level": "INFO", "target": "dan::event", "event": "at", "time": "22:0"}),
+            line
+        );
+    }
+    #[test]
+    fn test_json() {
+        let line = json(
+            &log::Record::builder()
+                .level(log::Level::Warn)
+                .target("dan::mqtt_engine")
+                .args(format_args!("resubscribing failed: {}", "timeout"))
+                .build(),
+        );
+        assert_eq!(
+            json!({
+                "level": "WARN",
+                "target": "dan::mqtt_engine",
+                "message": "resubscribing failed: timeout",
+            }),
+            line
+        );
+    }
+    #[test]
+    fn test_text_event() {
+        assert_eq!(
+            "when path=kitchen/light value=on",
+            message(
+                "when",
+                &[("path", &"kitchen/light"), ("value", &"on")],
+                false
+            )
+        );
+    }
+}
@@ -1,85 +1,751 @@
-use anyhow::Result;
+use anyhow::{anyhow, Result};
 use async_trait::async_trait;
-use std::sync::Arc;
+use futures::future;
+use std::{
+    collections::{BTreeMap, BTreeSet, VecDeque},
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc, Mutex as StdMutex,
+    },
+    time::{Duration, SystemTime, UNIX_EPOCH},
+};
 use tokio::{
     select,
-    sync::{mpsc, oneshot},
-    task::JoinHandle,
+    sync::{broadcast, mpsc, oneshot, watch},
+    task::{JoinError, JoinHandle},
+    time::{self, Instant},
 };
 
-use crate::vm::Engine;
+use crate::vm::{Closed, Engine, NoMatch, NotReady};
+
+use mqtt_async_client::client::{Client, Publish, QoS, Subscribe, SubscribeTopic};
+
+/// How long to wait before reconnecting after the connection to the broker is lost,
+/// unless the options give another delay.
+const RECONNECT_DELAY: Duration = Duration::from_secs(5);
+
+/// The longest wait between attempts to reconnect, each failed attempt doubles the wait.
+const RECONNECT_MAX_DELAY: Duration = Duration::from_secs(60);
+
+/// How long after subscribing to a wildcard path the retained values of the topics
+/// matching it are still being received, unless the sync window is longer.
+const RETAINED_DELAY: Duration = Duration::from_millis(500);
 
-use mqtt_async_client::client::{Client, Publish, QoS, ReadResult, Subscribe, SubscribeTopic};
+/// How many topics the last values are kept for to answer finds and histories,
+/// once full the topic updated longest ago is dropped.
+const VALUES_CAPACITY: usize = 10_000;
+
+/// How many changes are buffered for each consumer of the change feed
+/// before the oldest changes are dropped.
+/// A power of two, since the feed rounds its capacity up to one.
+const CHANGES_CAPACITY: usize = 128;
+
+/// How often a dropped change is logged at most.
+const DROPPED_WARNING_INTERVAL: Duration = Duration::from_secs(60);
 
 #[derive(Debug)]
 pub struct MQTTEngine {
+    prefix: Option<String>,
+    strict: bool,
     requests_tx: mpsc::Sender<Request>,
+    // Consumers subscribe to the sender of the change feed, which is dropped
+    // once the engine stops so that the feed closes. The engine holds no receiver,
+    // otherwise the feed would count an unread consumer and always look full.
+    changes_tx: Arc<StdMutex<Option<broadcast::Sender<Change>>>>,
+    // Why the engine stopped on its own, see failed.
+    failed_rx: watch::Receiver<Option<String>>,
     join_handle: JoinHandle<Result<()>>,
 }
 
+/// Change is a message received on any of the subscribed topics.
+/// An empty payload means the retained value of the topic was cleared.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Change {
+    pub topic: String,
+    pub payload: Vec<u8>,
+}
+
+/// Message is a message published to or received from the broker.
+#[derive(Debug, Clone, PartialEq)]
+struct Message {
+    topic: String,
+    payload: Vec<u8>,
+    retain: bool,
+}
+
+/// Connection is the client of the broker used by the engine,
+/// so that tests can use a fake broker in its place.
+#[async_trait]
+trait Connection: Send + 'static {
+    async fn connect(&mut self) -> Result<()>;
+    async fn disconnect(&mut self) -> Result<()>;
+    async fn publish(&mut self, msg: &Message) -> Result<()>;
+    async fn subscribe(&mut self, topics: Vec<String>) -> Result<()>;
+    /// Waits for the next message of any subscribed topic,
+    /// an error means the connection was lost along with the subscriptions.
+    async fn read(&mut self) -> Result<Message>;
+}
+
+#[async_trait]
+impl Connection for Client {
+    async fn connect(&mut self) -> Result<()> {
+        Ok(Client::connect(self).await?)
+    }
+    async fn disconnect(&mut self) -> Result<()> {
+        Ok(Client::disconnect(self).await?)
+    }
+    async fn publish(&mut self, msg: &Message) -> Result<()> {
+        let mut p = Publish::new(msg.topic.clone(), msg.payload.clone());
+        p.set_retain(msg.retain);
+        Ok(Client::publish(self, &p).await?)
+    }
+    async fn subscribe(&mut self, topics: Vec<String>) -> Result<()> {
+        let topics = topics
+            .into_iter()
+            .map(|topic_path| SubscribeTopic {
+                topic_path,
+                qos: QoS::AtLeastOnce,
+            })
+            .collect();
+        Client::subscribe(self, Subscribe::new(topics)).await?;
+        Ok(())
+    }
+    async fn read(&mut self) -> Result<Message> {
+        let data = self.read_subscriptions().await?;
+        Ok(Message {
+            topic: data.topic().to_string(),
+            payload: data.payload().to_vec(),
+            retain: data.retain(),
+        })
+    }
+}
+
 #[derive(Debug)]
 enum Request {
-    Publish(Publish),
-    Subscribe(Subscribe),
+    Publish(Message),
+    // Subscribes to the path, primed for the gets of a when when answered.
+    Subscribe(String, Option<oneshot::Sender<Result<()>>>),
     Get(Get),
+    Find(Find),
+    Subscriptions(oneshot::Sender<BTreeMap<String, usize>>),
+    Dropped(oneshot::Sender<Dropped>),
+    History(String, oneshot::Sender<Result<Vec<Sample>>>),
+    Topics(String, oneshot::Sender<Result<Vec<String>>>),
+    Disconnect(oneshot::Sender<Result<()>>),
+    Reconnect(oneshot::Sender<Result<()>>),
+    Close(oneshot::Sender<Result<()>>),
 }
 #[derive(Debug)]
 struct Get {
     path: String,
-    tx: oneshot::Sender<Vec<u8>>,
+    // Whether the retained values sent when subscribing are ignored.
+    live: bool,
+    // Receives the topic along with the payload, since the path may contain wildcards.
+    tx: oneshot::Sender<(String, Vec<u8>)>,
+}
+/// Primed keeps the last value of a path subscribed ahead of its gets,
+/// until each of the gets it was primed for took it.
+#[derive(Debug, Default)]
+struct Primed {
+    gets: usize,
+    value: Option<Message>,
+}
+#[derive(Debug)]
+struct Find {
+    path: String,
+    tx: oneshot::Sender<Result<Vec<Vec<u8>>>>,
+}
+
+/// Options of an engine.
+#[derive(Debug, Clone)]
+pub struct Options {
+    /// The MQTT client ID, without a client ID the client library chooses one.
+    pub client_id: Option<String>,
+    /// How many of the last values of each topic are kept, see history.
+    pub history_depth: usize,
+    /// How long the values of each topic are kept for trends, see Code::history_window.
+    /// With a window at least the last two values are kept, along with the last value
+    /// received before the window so a change can be measured across all of it.
+    pub history_window: Option<Duration>,
+    /// How long after connecting the retained values are still being received,
+    /// finds and histories are not ready until then since they would act on incomplete values.
+    pub sync_window: Duration,
+    /// The toplevel of every topic, i.e. house1 for several homes sharing a broker.
+    /// Paths are relative to the prefix, the prefix is added to the topics sent to the broker
+    /// and removed from the topics received.
+    pub prefix: Option<String>,
+    /// How long to keep trying to resubscribe after the connection to the broker is lost,
+    /// once it passes the engine stops and the gets waiting on it fail.
+    /// Without a grace the engine keeps trying.
+    pub reconnect_grace: Option<Duration>,
+    /// How long to wait before the first attempt to reconnect,
+    /// each failed attempt doubles the wait up to a minute.
+    pub reconnect_delay: Duration,
+    /// Whether a set of a wildcard path that matches no topic is a NoMatch error,
+    /// otherwise it does nothing.
+    pub strict: bool,
+}
+
+impl Default for Options {
+    fn default() -> Self {
+        Self {
+            client_id: None,
+            history_depth: 1,
+            history_window: None,
+            sync_window: Duration::ZERO,
+            prefix: None,
+            reconnect_grace: None,
+            reconnect_delay: RECONNECT_DELAY,
+            strict: false,
+        }
+    }
+}
+
+/// Dropped counts the changes a slow consumer of the change feed missed, for each topic.
+#[derive(Debug, Clone, Default)]
+pub struct Dropped {
+    pub topics: BTreeMap<String, u64>,
+    pub total: u64,
+    warned_at: Option<Instant>,
 }
 
-enum SelectResult {
+impl Dropped {
+    /// Counts a change of the topic that pushed the oldest change out of the full feed.
+    /// The topic is logged at most once every DROPPED_WARNING_INTERVAL.
+    fn record(&mut self, topic: &str) {
+        *self.topics.entry(topic.to_string()).or_default() += 1;
+        self.total += 1;
+        let now = Instant::now();
+        if self
+            .warned_at
+            .map_or(true, |at| now >= at + DROPPED_WARNING_INTERVAL)
+        {
+            log::warn!(
+                "change feed is full, dropped a change for {} ({} dropped in total)",
+                topic,
+                self.total
+            );
+            self.warned_at = Some(now);
+        }
+    }
+}
+
+/// Sample is a value received on a topic along with when it was received.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Sample {
+    pub time: Instant,
+    pub payload: Vec<u8>,
+}
+
+/// History keeps the most recent values of each topic, oldest first.
+#[derive(Debug)]
+struct History {
+    depth: usize,
+    window: Option<Duration>,
+    capacity: usize,
+    values: BTreeMap<String, VecDeque<Sample>>,
+}
+
+impl History {
+    fn new(depth: usize, window: Option<Duration>) -> Self {
+        let depth = match window {
+            Some(_) => depth.max(2),
+            None => depth.max(1),
+        };
+        Self {
+            depth,
+            window,
+            capacity: VALUES_CAPACITY,
+            values: BTreeMap::new(),
+        }
+    }
+    /// Records the payload of the topic, dropping the oldest value once the history is full
+    /// and the topic updated longest ago once there are too many topics.
+    /// Beyond the depth, the values still needed to reach back the window are kept.
+    /// An empty payload clears the history since the topic no longer has a value.
+    fn record(&mut self, topic: &str, payload: &[u8], time: Instant) {
+        if payload.is_empty() {
+            self.values.remove(topic);
+            return;
+        }
+        if !self.values.contains_key(topic) && self.values.len() >= self.capacity {
+            let oldest = self
+                .values
+                .iter()
+                .min_by_key(|(_, samples)| samples.back().map(|s| s.time))
+                .map(|(topic, _)| topic.clone());
+            if let Some(oldest) = oldest {
+                log::debug!("dropping the values of {}", oldest);
+                self.values.remove(&oldest);
+            }
+        }
+        let samples = self.values.entry(topic.to_string()).or_default();
+        samples.push_back(Sample {
+            time,
+            payload: payload.to_vec(),
+        });
+        while samples.len() > self.depth {
+            // The oldest value is only needed while the next one is still within the window.
+            match self.window {
+                Some(window) if samples[1].time + window > time => break,
+                _ => samples.pop_front(),
+            };
+        }
+    }
+    fn samples(&self, topic: &str) -> Vec<Sample> {
+        self.values
+            .get(topic)
+            .map(|s| s.iter().cloned().collect())
+            .unwrap_or_default()
+    }
+}
+
+enum SelectResult<C> {
     Request(Option<Request>),
-    Data(ReadResult),
+    Data(Result<Message>),
+    Reconnected(std::result::Result<(C, Result<()>), JoinError>),
+}
+
+/// Reads the next message of the connection,
+/// without a connection, while the reconnect task holds it, it waits forever.
+async fn read<C: Connection>(cli: &mut Option<C>) -> Result<Message> {
+    match cli {
+        Some(cli) => cli.read().await,
+        None => future::pending().await,
+    }
+}
+
+/// Waits for the reconnect task to return the connection, without a task it waits forever.
+async fn reconnected<C>(
+    task: &mut Option<JoinHandle<(C, Result<()>)>>,
+) -> std::result::Result<(C, Result<()>), JoinError> {
+    match task {
+        Some(task) => task.await,
+        None => future::pending().await,
+    }
 }
 
 impl MQTTEngine {
     pub fn new(url: &str) -> Result<Arc<Self>> {
+        Self::with_client_id(url, None)
+    }
+    /// Creates an engine that connects using the client ID,
+    /// without a client ID the client library chooses one.
+    pub fn with_client_id(url: &str, client_id: Option<String>) -> Result<Arc<Self>> {
+        Self::with_options(
+            url,
+            Options {
+                client_id,
+                ..Default::default()
+            },
+        )
+    }
+    pub fn with_options(url: &str, options: Options) -> Result<Arc<Self>> {
         // Create a client & define connect options
-        let cli = Client::builder().set_url_string(url)?.build()?;
-
+        let cli = Client::builder()
+            .set_url_string(url)?
+            .set_client_id(options.client_id.clone())
+            .build()?;
+        Ok(Self::with_connection(cli, options))
+    }
+    fn with_connection<C: Connection>(cli: C, options: Options) -> Arc<Self> {
         let (requests_tx, requests_rx) = mpsc::channel(100);
-        let join_handle = tokio::spawn(async move { Self::run(cli, requests_rx).await });
-        Ok(Arc::new(Self {
+        let (tx, _) = broadcast::channel(CHANGES_CAPACITY);
+        let changes_tx = Arc::new(StdMutex::new(Some(tx.clone())));
+        let (failed_tx, failed_rx) = watch::channel(None);
+        let prefix = options.prefix.clone();
+        let strict = options.strict;
+        let join_handle = {
+            let changes_tx = changes_tx.clone();
+            tokio::spawn(async move {
+                let r = Self::run(cli, requests_rx, tx, options).await;
+                changes_tx.lock().unwrap().take();
+                if let Err(err) = &r {
+                    let _ = failed_tx.send(Some(err.to_string()));
+                }
+                r
+            })
+        };
+        Arc::new(Self {
+            prefix,
+            strict,
             requests_tx,
+            changes_tx,
+            failed_rx,
             join_handle,
-        }))
+        })
     }
-    async fn run(mut cli: Client, mut requests_rx: mpsc::Receiver<Request>) -> Result<()> {
-        cli.connect().await?;
+    /// Returns a feed of the changes to every subscribed topic.
+    /// A slow consumer misses the oldest changes instead of blocking the engine, see dropped,
+    /// and the feed is closed once the engine is shutdown.
+    pub fn changes(&self) -> broadcast::Receiver<Change> {
+        match &*self.changes_tx.lock().unwrap() {
+            Some(tx) => tx.subscribe(),
+            // The engine stopped, so the feed is closed.
+            None => broadcast::channel(1).1,
+        }
+    }
+    async fn run<C: Connection>(
+        cli: C,
+        mut requests_rx: mpsc::Receiver<Request>,
+        changes_tx: broadcast::Sender<Change>,
+        options: Options,
+    ) -> Result<()> {
+        // The connection is moved to the reconnect task while it is lost.
+        let mut cli = Some(cli);
+        cli.as_mut().unwrap().connect().await?;
+        let mut connected = true;
+        let mut reconnecting: Option<JoinHandle<(C, Result<()>)>> = None;
+        // The topics subscribed when the connection was lost, the reconnect task restores them.
+        let mut restoring: BTreeSet<String> = BTreeSet::new();
+        let mut synced_at = Instant::now() + options.sync_window;
+        let mut closed = None;
+        let mut failed = None;
         let mut watches: Vec<Get> = Vec::new();
+        // Track every subscribed topic so they can be restored if the broker restarts.
+        let mut topics: BTreeSet<String> = BTreeSet::new();
+        // When the retained values of each subscribed wildcard path have been received.
+        let mut settled: BTreeMap<String, Instant> = BTreeMap::new();
+        // The paths subscribed ahead of their gets.
+        let mut primed: BTreeMap<String, Primed> = BTreeMap::new();
+        // The last values of each topic, used to answer finds.
+        let mut values = History::new(options.history_depth, options.history_window);
+        let mut dropped = Dropped::default();
         loop {
             let s = select! {
                 req = requests_rx.recv() =>  SelectResult::Request(req),
-                data = cli.read_subscriptions() =>  SelectResult::Data(data?),
+                data = read(&mut cli), if connected =>  SelectResult::Data(data),
+                res = reconnected(&mut reconnecting) => SelectResult::Reconnected(res),
             };
             match s {
                 SelectResult::Request(req) => match req {
-                    Some(Request::Get(watch)) => watches.push(watch),
-                    Some(Request::Publish(p)) => {
-                        cli.publish(&p).await?;
+                    Some(Request::Get(watch)) => {
+                        // A primed get receives the value that arrived since subscribing.
+                        let value = match primed.get_mut(&watch.path) {
+                            Some(p) => {
+                                p.gets -= 1;
+                                let value = p.value.clone();
+                                if p.gets == 0 {
+                                    primed.remove(&watch.path);
+                                }
+                                value.filter(|v| !(v.retain && watch.live))
+                            }
+                            None => None,
+                        };
+                        match value {
+                            Some(v) => {
+                                let _ = watch.tx.send((v.topic, v.payload));
+                            }
+                            None => watches.push(watch),
+                        }
+                    }
+                    Some(Request::Find(f)) => {
+                        let settled_at = settled_at(&settled, &f.path, synced_at);
+                        let _ = f.tx.send(ready(settled_at).map(|_| find(&values, &f.path)));
+                    }
+                    Some(Request::Subscriptions(tx)) => {
+                        let _ = tx.send(subscriptions(&topics, &mut watches));
+                    }
+                    Some(Request::Dropped(tx)) => {
+                        let _ = tx.send(dropped.clone());
+                    }
+                    Some(Request::History(topic, tx)) => {
+                        let _ = tx.send(ready(synced_at).map(|_| values.samples(&topic)));
+                    }
+                    Some(Request::Topics(filter, tx)) => {
+                        let settled_at = settled_at(&settled, &filter, synced_at);
+                        let _ = tx.send(ready(settled_at).map(|_| matching(&values, &filter)));
+                    }
+                    Some(Request::Publish(p)) => match cli.as_mut().filter(|_| connected) {
+                        Some(cli) => {
+                            if let Err(err) = cli.publish(&p).await {
+                                log::warn!("dropped publish to {}: {}", p.topic, err);
+                            }
+                        }
+                        None => log::warn!("dropped publish to {} while disconnected", p.topic),
+                    },
+                    Some(Request::Subscribe(path, tx)) => {
+                        // Topics added while disconnected are subscribed when reconnecting.
+                        let mut r = Ok(());
+                        if let Some(cli) = cli.as_mut().filter(|_| connected) {
+                            r = cli
+                                .subscribe(subscribe(std::iter::once(&path), &options.prefix))
+                                .await;
+                            match &r {
+                                Ok(()) => log::trace!("subscribe {}", path),
+                                Err(err) => log::warn!("subscribing to {} failed: {}", path, err),
+                            }
+                        }
+                        if let Some(tx) = tx {
+                            primed.entry(path.clone()).or_default().gets += 1;
+                            let _ = tx.send(r);
+                        }
+                        if is_wildcard(&path) && !settled.contains_key(&path) {
+                            let delay = options.sync_window.max(RETAINED_DELAY);
+                            settled.insert(path.clone(), Instant::now() + delay);
+                        }
+                        topics.insert(path);
+                    }
+                    Some(Request::Disconnect(tx)) => {
+                        let r = match cli.as_mut() {
+                            Some(cli) if connected => {
+                                connected = false;
+                                log::info!("disconnected");
+                                cli.disconnect().await
+                            }
+                            Some(_) => Ok(()),
+                            None => Err(anyhow!("reconnecting to the broker")),
+                        };
+                        let _ = tx.send(r);
                     }
-                    Some(Request::Subscribe(s)) => {
-                        cli.subscribe(s).await?;
+                    Some(Request::Reconnect(tx)) => {
+                        let r = match cli.as_mut() {
+                            Some(cli) if !connected => {
+                                let r = Self::restore(cli, &topics, &options.prefix).await;
+                                connected = r.is_ok();
+                                // The retained values are received again after reconnecting.
+                                synced_at = Instant::now() + options.sync_window;
+                                r
+                            }
+                            // Already connected or the reconnect task is still trying.
+                            _ => Ok(()),
+                        };
+                        let _ = tx.send(r);
+                    }
+                    Some(Request::Close(tx)) => {
+                        closed = Some(tx);
+                        break;
                     }
                     None => break,
                 },
-                SelectResult::Data(data) => {
-                    let mut i = 0 as usize;
-                    while i < watches.len() {
-                        if data.topic() == watches[i].path {
-                            let w = watches.remove(i);
-                            w.tx.send(data.payload().to_vec()).unwrap();
-                            continue;
+                SelectResult::Data(Err(err)) => {
+                    // The subscriptions are lost along with the connection, reconnect
+                    // and resubscribe so that pending gets, and therefore whens, keep working.
+                    // Requests are answered meanwhile, publishes are dropped.
+                    log::warn!("reading subscriptions failed: {}", err);
+                    connected = false;
+                    if let Some(lost) = cli.take() {
+                        restoring = topics.clone();
+                        reconnecting = Some(tokio::spawn(Self::reconnect_lost(
+                            lost,
+                            restoring.clone(),
+                            options.clone(),
+                        )));
+                    }
+                }
+                SelectResult::Reconnected(res) => {
+                    reconnecting = None;
+                    let (restored, r) = match res {
+                        Ok(res) => res,
+                        Err(err) => {
+                            failed = Some(anyhow!("reconnecting failed: {}", err));
+                            break;
+                        }
+                    };
+                    let restored = cli.insert(restored);
+                    if let Err(err) = r {
+                        failed = Some(err);
+                        break;
+                    }
+                    connected = true;
+                    synced_at = Instant::now() + options.sync_window;
+                    let added: Vec<String> = topics.difference(&restoring).cloned().collect();
+                    if !added.is_empty() {
+                        if let Err(err) = restored
+                            .subscribe(subscribe(added.iter(), &options.prefix))
+                            .await
+                        {
+                            log::warn!("subscribing failed: {}", err);
+                        }
+                    }
+                }
+                SelectResult::Data(Ok(data)) => {
+                    log::trace!(
+                        "received {} {}",
+                        data.topic,
+                        String::from_utf8_lossy(&data.payload)
+                    );
+                    // Only topics with the prefix are subscribed.
+                    let topic = match unprefixed(&options.prefix, &data.topic) {
+                        Some(topic) => topic,
+                        None => continue,
+                    };
+                    values.record(topic, &data.payload, Instant::now());
+                    for (path, p) in primed.iter_mut() {
+                        if topic_matches(path, topic) && !data.payload.is_empty() {
+                            p.value = Some(Message {
+                                topic: topic.to_string(),
+                                ..data.clone()
+                            });
                         }
-                        i = i + 1;
                     }
+                    deliver(
+                        &mut watches,
+                        &changes_tx,
+                        &mut dropped,
+                        topic,
+                        &data.payload,
+                        data.retain,
+                    );
+                }
+            }
+        }
+        // Pending gets fail once their watch is dropped, so the whens waiting on them stop.
+        drop(watches);
+        if let Some(task) = reconnecting {
+            task.abort();
+        }
+        if let Some(err) = failed {
+            return Err(err);
+        }
+        let r = match cli.as_mut() {
+            Some(cli) if connected => cli.disconnect().await,
+            _ => Ok(()),
+        };
+        match closed {
+            Some(tx) => {
+                let _ = tx.send(r);
+                Ok(())
+            }
+            None => r,
+        }
+    }
+    async fn restore<C: Connection>(
+        cli: &mut C,
+        topics: &BTreeSet<String>,
+        prefix: &Option<String>,
+    ) -> Result<()> {
+        cli.connect().await?;
+        if !topics.is_empty() {
+            cli.subscribe(subscribe(topics.iter(), prefix)).await?;
+        }
+        log::info!("reconnected and subscribed to {} topics", topics.len());
+        Ok(())
+    }
+    /// Reconnects the lost connection and restores the subscriptions to the topics,
+    /// waiting twice as long after each failed attempt up to RECONNECT_MAX_DELAY.
+    /// Gives up once the connection was lost for longer than the grace.
+    async fn reconnect_lost<C: Connection>(
+        mut cli: C,
+        topics: BTreeSet<String>,
+        options: Options,
+    ) -> (C, Result<()>) {
+        let lost_at = Instant::now();
+        let mut delay = options.reconnect_delay;
+        loop {
+            time::sleep(delay).await;
+            match Self::restore(&mut cli, &topics, &options.prefix).await {
+                Ok(()) => return (cli, Ok(())),
+                Err(err) => {
+                    log::warn!("reconnecting failed: {}", err);
+                    if !within_grace(lost_at, options.reconnect_grace, Instant::now()) {
+                        let err = anyhow!(
+                            "connection to the broker lost for longer than {:?}",
+                            options.reconnect_grace.unwrap_or_default()
+                        );
+                        return (cli, Err(err));
+                    }
+                    delay = (delay * 2).min(RECONNECT_MAX_DELAY);
                 }
             }
         }
-        let r = cli.disconnect().await;
-        Ok(r?)
+    }
+    /// Reports each subscribed topic and how many gets are waiting on it.
+    /// Gets whose thread has stopped are not counted, a count that keeps growing
+    /// means the program is leaking gets.
+    pub async fn subscriptions(&self) -> Result<BTreeMap<String, usize>> {
+        let (tx, rx) = oneshot::channel();
+        self.request(Request::Subscriptions(tx)).await?;
+        Ok(rx.await.map_err(|_| Closed)?)
+    }
+    /// Reports how many changes slow consumers of the change feed missed.
+    pub async fn dropped(&self) -> Result<Dropped> {
+        let (tx, rx) = oneshot::channel();
+        self.request(Request::Dropped(tx)).await?;
+        Ok(rx.await.map_err(|_| Closed)?)
+    }
+    /// Disconnects from the broker until reconnect is called, i.e. for broker maintenance.
+    /// While disconnected sets and clears are dropped and gets wait,
+    /// gets are answered once reconnected since the subscriptions are restored.
+    pub async fn disconnect(&self) -> Result<()> {
+        let (tx, rx) = oneshot::channel();
+        self.request(Request::Disconnect(tx)).await?;
+        rx.await.map_err(|_| Closed)?
+    }
+    /// Reconnects to the broker and restores every subscription.
+    pub async fn reconnect(&self) -> Result<()> {
+        let (tx, rx) = oneshot::channel();
+        self.request(Request::Reconnect(tx)).await?;
+        rx.await.map_err(|_| Closed)?
+    }
+    /// Returns the topics with a value matching the wildcard path,
+    /// waiting until the retained values of every matching topic have been received.
+    async fn topics(&self, path: &str) -> Result<Vec<String>> {
+        self.request(Request::Subscribe(path.to_string(), None))
+            .await?;
+        self.when_ready(|tx| Request::Topics(path.to_string(), tx))
+            .await
+    }
+    /// Sends the request until the engine is ready to answer it,
+    /// waiting as long as the engine reports it is not ready yet.
+    async fn when_ready<T>(
+        &self,
+        request: impl Fn(oneshot::Sender<Result<T>>) -> Request,
+    ) -> Result<T> {
+        loop {
+            let (tx, rx) = oneshot::channel();
+            self.request(request(tx)).await?;
+            match rx.await.map_err(|_| Closed)? {
+                Ok(answer) => return Ok(answer),
+                Err(err) => match err.downcast_ref::<NotReady>() {
+                    Some(not_ready) => time::sleep(not_ready.remaining).await,
+                    None => return Err(err),
+                },
+            }
+        }
+    }
+    /// Waits until the engine stops on its own and returns why,
+    /// i.e. once the connection to the broker was lost for longer than the reconnect grace.
+    /// It never returns while the engine runs or once it was closed.
+    pub async fn failed(&self) -> anyhow::Error {
+        let mut failed_rx = self.failed_rx.clone();
+        loop {
+            if let Some(err) = &*failed_rx.borrow() {
+                return anyhow!("{}", err);
+            }
+            if failed_rx.changed().await.is_err() {
+                // The engine stopped without failing.
+                return future::pending().await;
+            }
+        }
+    }
+    /// Sends the request to the engine, which fails once the engine is closed.
+    async fn request(&self, request: Request) -> Result<()> {
+        self.requests_tx
+            .send(request)
+            .await
+            .map_err(|_| Closed.into())
+    }
+    /// Waits for the next value of the path and its topic, see get and get_live.
+    async fn watch(&self, path: &str, live: bool) -> Result<(String, Vec<u8>)> {
+        self.request(Request::Subscribe(path.to_string(), None))
+            .await?;
+
+        let (tx, rx) = oneshot::channel();
+        self.request(Request::Get(Get {
+            path: path.to_string(),
+            live,
+            tx,
+        }))
+        .await?;
+        Ok(rx.await.map_err(|_| Closed)?)
+    }
+    /// Closes the engine while it may still be shared, unlike shutdown.
+    /// Pending gets fail, stopping the whens waiting on them, and later requests fail.
+    pub async fn close(&self) -> Result<()> {
+        let (tx, rx) = oneshot::channel();
+        self.request(Request::Close(tx)).await?;
+        rx.await.map_err(|_| Closed)?
     }
     pub async fn shutdown(self) -> Result<()> {
         // Explicitly drop request_tx so that the run loop
@@ -90,28 +756,1125 @@ impl MQTTEngine {
     }
 }
 
+/// Returns the client ID with a suffix unique to this process and call.
+/// Brokers disconnect a client when another connects with the same ID,
+/// so a unique ID allows several dan processes to share a broker.
+/// The trade-off is that the broker cannot resume a persistent session
+/// after a restart, since the new process connects with a different ID.
+pub fn unique_client_id(client_id: &str) -> String {
+    static COUNT: AtomicUsize = AtomicUsize::new(0);
+    let nanos = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.subsec_nanos())
+        .unwrap_or_default();
+    format!(
+        "{}-{}-{:x}{}",
+        client_id,
+        std::process::id(),
+        nanos,
+        COUNT.fetch_add(1, Ordering::SeqCst)
+    )
+}
+
+/// Reports whether the engine may still try to resubscribe,
+/// a connection lost at lost_at is given up on once the grace has passed.
+fn within_grace(lost_at: Instant, grace: Option<Duration>, now: Instant) -> bool {
+    grace.map_or(true, |grace| now < lost_at + grace)
+}
+
+/// Returns when the retained values of the path have been received,
+/// the values of the topics matching a wildcard path keep arriving for a while after subscribing.
+fn settled_at(settled: &BTreeMap<String, Instant>, path: &str, synced_at: Instant) -> Instant {
+    settled
+        .get(path)
+        .map_or(synced_at, |at| (*at).max(synced_at))
+}
+
+/// Reports an error until the retained values have been received after connecting.
+fn ready(synced_at: Instant) -> Result<()> {
+    let now = Instant::now();
+    if now < synced_at {
+        return Err(NotReady {
+            remaining: synced_at - now,
+        }
+        .into());
+    }
+    Ok(())
+}
+
+/// Sends the payload to the change feed and to each watch of a matching topic.
+/// An empty payload means the retained value of the topic was cleared,
+/// the topic has no value so the watches keep waiting for the next one.
+/// Live watches keep waiting when the payload is a retained value sent when subscribing.
+/// A full feed drops its oldest change for the slowest consumer, which is counted.
+fn deliver(
+    watches: &mut Vec<Get>,
+    changes: &broadcast::Sender<Change>,
+    dropped: &mut Dropped,
+    topic: &str,
+    payload: &[u8],
+    retained: bool,
+) {
+    if changes.receiver_count() > 0 && changes.len() >= CHANGES_CAPACITY {
+        dropped.record(topic);
+    }
+    // Sending only fails when there are no consumers of the feed.
+    let _ = changes.send(Change {
+        topic: topic.to_string(),
+        payload: payload.to_vec(),
+    });
+    if payload.is_empty() {
+        return;
+    }
+    let mut i = 0 as usize;
+    while i < watches.len() {
+        if topic_matches(&watches[i].path, topic) && !(retained && watches[i].live) {
+            let w = watches.remove(i);
+            // The receiver is gone if the waiting thread was stopped
+            // or gave up waiting, so there is no one to notify.
+            let _ = w.tx.send((topic.to_string(), payload.to_vec()));
+            continue;
+        }
+        i = i + 1;
+    }
+}
+
+/// Counts the waiting gets of each topic.
+/// Gets that no one is waiting on anymore are removed.
+fn subscriptions(topics: &BTreeSet<String>, watches: &mut Vec<Get>) -> BTreeMap<String, usize> {
+    watches.retain(|w| !w.tx.is_closed());
+    let mut counts: BTreeMap<String, usize> = topics.iter().map(|t| (t.clone(), 0)).collect();
+    for w in watches.iter() {
+        *counts.entry(w.path.clone()).or_default() += 1;
+    }
+    counts
+}
+
+/// Returns the values of every topic matching the topic filter.
+fn find(values: &History, filter: &str) -> Vec<Vec<u8>> {
+    values
+        .values
+        .iter()
+        .filter(|(topic, _)| topic_matches(filter, topic))
+        .filter_map(|(_, samples)| samples.back().map(|s| s.payload.clone()))
+        .collect()
+}
+
+/// Returns every topic with a value matching the topic filter.
+fn matching(values: &History, filter: &str) -> Vec<String> {
+    values
+        .values
+        .keys()
+        .filter(|topic| topic_matches(filter, topic))
+        .cloned()
+        .collect()
+}
+
+/// Returns the topics to subscribe to for each of the paths.
+fn subscribe<'a>(topics: impl Iterator<Item = &'a String>, prefix: &Option<String>) -> Vec<String> {
+    topics.map(|topic| prefixed(prefix, topic)).collect()
+}
+
+/// Returns the topic of the path below the prefix.
+fn prefixed(prefix: &Option<String>, path: &str) -> String {
+    match prefix {
+        Some(prefix) => format!("{}/{}", prefix, path),
+        None => path.to_string(),
+    }
+}
+
+/// Returns the path of the topic relative to the prefix,
+/// or None when the topic is not below the prefix.
+fn unprefixed<'a>(prefix: &Option<String>, topic: &'a str) -> Option<&'a str> {
+    match prefix {
+        Some(prefix) => topic.strip_prefix(prefix.as_str())?.strip_prefix('/'),
+        None => Some(topic),
+    }
+}
+
+/// Reports whether the topic matches the MQTT topic filter.
+/// The filter may contain the single level `+` and multi level `#` wildcards,
+/// which allows a single get to observe the same device across many toplevels.
+pub fn topic_matches(filter: &str, topic: &str) -> bool {
+    let mut topic_levels = topic.split('/');
+    for f in filter.split('/') {
+        match f {
+            "#" => return true,
+            "+" => {
+                if topic_levels.next().is_none() {
+                    return false;
+                }
+            }
+            _ => {
+                if topic_levels.next() != Some(f) {
+                    return false;
+                }
+            }
+        }
+    }
+    topic_levels.next().is_none()
+}
+
+/// Reports whether the path contains any MQTT wildcards.
+fn is_wildcard(path: &str) -> bool {
+    path.split('/').any(|level| level == "+" || level == "#")
+}
+
 #[async_trait]
 impl Engine for Arc<MQTTEngine> {
     async fn get(&self, path: &str) -> Result<Vec<u8>> {
-        let s = Subscribe::new(vec![SubscribeTopic {
-            topic_path: path.to_string(),
-            qos: QoS::AtLeastOnce,
-        }]);
-        self.requests_tx.send(Request::Subscribe(s)).await?;
+        Ok(self.watch(path, false).await?.1)
+    }
+    async fn get_live(&self, path: &str) -> Result<Vec<u8>> {
+        Ok(self.watch(path, true).await?.1)
+    }
+    async fn get_topic(&self, path: &str, live: bool) -> Result<(String, Vec<u8>)> {
+        self.watch(path, live).await
+    }
 
+    /// Subscribes once the broker acknowledged it, the first get of the path
+    /// receives the last value that arrived since then.
+    async fn subscribe(&self, path: &str) -> Result<()> {
         let (tx, rx) = oneshot::channel();
-        self.requests_tx
-            .send(Request::Get(Get {
+        self.request(Request::Subscribe(path.to_string(), Some(tx)))
+            .await?;
+        rx.await.map_err(|_| Closed)?
+    }
+
+    async fn set(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        // MQTT does not allow publishing to a topic filter, so a wildcard path
+        // sets every known topic matching it, i.e. +/light the light of every toplevel.
+        let paths = if is_wildcard(path) {
+            self.topics(path).await?
+        } else {
+            vec![path.to_string()]
+        };
+        if paths.is_empty() && self.strict {
+            return Err(NoMatch {
                 path: path.to_string(),
-                tx,
+            }
+            .into());
+        }
+        for path in paths {
+            let topic = prefixed(&self.prefix, &path);
+            log::trace!("publish {} {}", topic, String::from_utf8_lossy(&value));
+            self.request(Request::Publish(Message {
+                topic,
+                payload: value.clone(),
+                retain: false,
             }))
             .await?;
-        Ok(rx.await?)
+        }
+        Ok(())
     }
 
-    async fn set(&self, path: &str, value: Vec<u8>) -> Result<()> {
-        let msg = Publish::new(path.to_string(), value);
-        self.requests_tx.send(Request::Publish(msg)).await?;
+    async fn find(&self, path: &str) -> Result<Vec<Vec<u8>>> {
+        // Wait for the next value so that finds are reactive like gets,
+        // the value is cached before the find request is handled.
+        self.get(path).await?;
+        // The first value of a wildcard path is only one of the retained values of its topics.
+        self.when_ready(|tx| {
+            Request::Find(Find {
+                path: path.to_string(),
+                tx,
+            })
+        })
+        .await
+    }
+
+    /// Only the last value is kept unless the engine was created with a deeper history,
+    /// and only values of subscribed topics are received.
+    async fn history(&self, path: &str) -> Result<Vec<Sample>> {
+        let (tx, rx) = oneshot::channel();
+        self.request(Request::History(path.to_string(), tx)).await?;
+        rx.await.map_err(|_| Closed)?
+    }
+
+    async fn publish(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        if is_wildcard(path) {
+            return Err(anyhow!("cannot publish wildcard path {}", path));
+        }
+        let topic = prefixed(&self.prefix, path);
+        log::trace!(
+            "publish retained {} {}",
+            topic,
+            String::from_utf8_lossy(&value)
+        );
+        self.request(Request::Publish(Message {
+            topic,
+            payload: value,
+            retain: true,
+        }))
+        .await?;
         Ok(())
     }
+
+    async fn clear(&self, path: &str) -> Result<()> {
+        if is_wildcard(path) {
+            return Err(anyhow!("cannot clear wildcard path {}", path));
+        }
+        let topic = prefixed(&self.prefix, path);
+        log::trace!("clear {}", topic);
+        // Brokers delete the retained message of a topic
+        // when they receive a retained message with an empty payload.
+        self.request(Request::Publish(Message {
+            topic,
+            payload: Vec::new(),
+            retain: true,
+        }))
+        .await?;
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::{atomic::AtomicBool, Mutex, Once};
+
+    use super::*;
+    use crate::{compiler::Interpreter, vm::VM, Compile};
+
+    /// Logs captured from this module by the CaptureLogger.
+    static LOGS: Mutex<Vec<String>> = Mutex::new(Vec::new());
+
+    struct CaptureLogger;
+
+    impl log::Log for CaptureLogger {
+        fn enabled(&self, metadata: &log::Metadata) -> bool {
+            metadata.target() == module_path!().trim_end_matches("::tests")
+        }
+        fn log(&self, record: &log::Record) {
+            if self.enabled(record.metadata()) {
+                LOGS.lock().unwrap().push(record.args().to_string());
+            }
+        }
+        fn flush(&self) {}
+    }
+
+    fn capture_logs() {
+        static INIT: Once = Once::new();
+        INIT.call_once(|| {
+            log::set_logger(&CaptureLogger).unwrap();
+            log::set_max_level(log::LevelFilter::Trace);
+        });
+    }
+
+    /// FakeBroker records what the engine publishes and subscribes to and sends it messages,
+    /// including the messages it publishes to the topics it subscribed to.
+    /// It can drop the connection and refuse to connect until it is restored.
+    #[derive(Clone)]
+    struct FakeBroker {
+        published: Arc<Mutex<Vec<Message>>>,
+        subscribed: Arc<Mutex<Vec<String>>>,
+        online: Arc<AtomicBool>,
+        tx: mpsc::UnboundedSender<Result<Message, String>>,
+    }
+
+    struct FakeConnection {
+        broker: FakeBroker,
+        rx: mpsc::UnboundedReceiver<Result<Message, String>>,
+    }
+
+    impl FakeBroker {
+        fn connect(options: Options) -> (Self, Arc<MQTTEngine>) {
+            let (tx, rx) = mpsc::unbounded_channel();
+            let broker = FakeBroker {
+                published: Arc::new(Mutex::new(Vec::new())),
+                subscribed: Arc::new(Mutex::new(Vec::new())),
+                online: Arc::new(AtomicBool::new(true)),
+                tx,
+            };
+            let conn = FakeConnection {
+                broker: broker.clone(),
+                rx,
+            };
+            (broker, MQTTEngine::with_connection(conn, options))
+        }
+        fn send(&self, topic: &str, payload: &str, retain: bool) {
+            let _ = self.tx.send(Ok(Message {
+                topic: topic.to_string(),
+                payload: payload.as_bytes().to_vec(),
+                retain,
+            }));
+        }
+        /// Drops the connection, refusing to connect until restored.
+        fn drop_connection(&self) {
+            self.online.store(false, Ordering::SeqCst);
+            let _ = self.tx.send(Err("connection lost".to_string()));
+        }
+        fn restore(&self) {
+            self.online.store(true, Ordering::SeqCst);
+        }
+        fn published(&self) -> Vec<(String, String)> {
+            self.published
+                .lock()
+                .unwrap()
+                .iter()
+                .map(|m| {
+                    (
+                        m.topic.clone(),
+                        String::from_utf8_lossy(&m.payload).to_string(),
+                    )
+                })
+                .collect()
+        }
+        fn subscribed(&self) -> Vec<String> {
+            self.subscribed.lock().unwrap().clone()
+        }
+        fn check_online(&self) -> Result<()> {
+            if self.online.load(Ordering::SeqCst) {
+                Ok(())
+            } else {
+                Err(anyhow!("broker is offline"))
+            }
+        }
+    }
+
+    #[async_trait]
+    impl Connection for FakeConnection {
+        async fn connect(&mut self) -> Result<()> {
+            self.broker.check_online()
+        }
+        async fn disconnect(&mut self) -> Result<()> {
+            Ok(())
+        }
+        async fn publish(&mut self, msg: &Message) -> Result<()> {
+            self.broker.check_online()?;
+            self.broker.published.lock().unwrap().push(msg.clone());
+            if self
+                .broker
+                .subscribed()
+                .iter()
+                .any(|filter| topic_matches(filter, &msg.topic))
+            {
+                let _ = self.broker.tx.send(Ok(msg.clone()));
+            }
+            Ok(())
+        }
+        async fn subscribe(&mut self, topics: Vec<String>) -> Result<()> {
+            self.broker.check_online()?;
+            self.broker.subscribed.lock().unwrap().extend(topics);
+            Ok(())
+        }
+        async fn read(&mut self) -> Result<Message> {
+            match self.rx.recv().await {
+                Some(Ok(msg)) => Ok(msg),
+                Some(Err(err)) => Err(anyhow!("{}", err)),
+                None => future::pending().await,
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn test_set_trace() {
+        capture_logs();
+        let (broker, mqtt) = FakeBroker::connect(Options::default());
+        mqtt.set("kitchen/light", "on".into()).await.unwrap();
+        mqtt.close().await.unwrap();
+
+        assert!(LOGS
+            .lock()
+            .unwrap()
+            .contains(&"publish kitchen/light on".to_string()));
+        assert_eq!(
+            vec![("kitchen/light".to_string(), "on".to_string())],
+            broker.published()
+        );
+    }
+    #[tokio::test]
+    async fn test_prefix() {
+        let (broker, mqtt) = FakeBroker::connect(Options {
+            prefix: Some("house1".to_string()),
+            ..Default::default()
+        });
+        mqtt.set("porch/light", "on".into()).await.unwrap();
+        let get = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { mqtt.get_topic("+/motion", false).await })
+        };
+        time::sleep(Duration::from_millis(10)).await;
+        // Topics of other prefixes are not below the prefix.
+        broker.send("house10/hall/motion", "detected", false);
+        broker.send("house1/hall/motion", "detected", false);
+
+        // The status round trips without the prefix.
+        assert_eq!(
+            ("hall/motion".to_string(), "detected".as_bytes().to_vec()),
+            get.await.unwrap().unwrap()
+        );
+        assert_eq!(vec!["house1/+/motion".to_string()], broker.subscribed());
+        mqtt.close().await.unwrap();
+        assert_eq!(
+            vec![("house1/porch/light".to_string(), "on".to_string())],
+            broker.published()
+        );
+
+        let prefix = Some("house1".to_string());
+        assert_eq!(
+            Some("hall/motion"),
+            unprefixed(&prefix, "house1/hall/motion")
+        );
+        assert_eq!(None, unprefixed(&prefix, "house10/hall/motion"));
+        assert_eq!(Some("hall/motion"), unprefixed(&None, "hall/motion"));
+    }
+    #[tokio::test]
+    async fn test_set_wildcard() {
+        let (broker, mqtt) = FakeBroker::connect(Options::default());
+        let set = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { mqtt.set("+/light", "on".into()).await })
+        };
+        eventually(|| !broker.subscribed().is_empty()).await;
+        assert_eq!(vec!["+/light".to_string()], broker.subscribed());
+        // The retained values of the matching topics.
+        broker.send("kitchen/light", "off", true);
+        broker.send("bedroom/light", "off", true);
+        broker.send("bedroom/fan", "off", true);
+        broker.send("hall/light", "", true);
+        set.await.unwrap().unwrap();
+        mqtt.close().await.unwrap();
+
+        assert_eq!(
+            vec![
+                ("bedroom/light".to_string(), "on".to_string()),
+                ("kitchen/light".to_string(), "on".to_string())
+            ],
+            broker.published()
+        );
+    }
+    #[tokio::test]
+    async fn test_set_wildcard_no_match() {
+        let (broker, mqtt) = FakeBroker::connect(Options::default());
+        // Without a retained value of a matching topic the set does nothing.
+        broker.send("kitchen/fan", "off", true);
+        mqtt.set("+/light", "on".into()).await.unwrap();
+        mqtt.close().await.unwrap();
+        assert!(broker.published().is_empty());
+
+        let (broker, mqtt) = FakeBroker::connect(Options {
+            strict: true,
+            ..Default::default()
+        });
+        broker.send("kitchen/fan", "off", true);
+        let err = mqtt.set("+/light", "on".into()).await.unwrap_err();
+        assert_eq!(
+            Some(&NoMatch {
+                path: "+/light".to_string()
+            }),
+            err.downcast_ref::<NoMatch>()
+        );
+        // A path without wildcards is set regardless.
+        mqtt.set("kitchen/light", "on".into()).await.unwrap();
+        mqtt.close().await.unwrap();
+        assert_eq!(
+            vec![("kitchen/light".to_string(), "on".to_string())],
+            broker.published()
+        );
+    }
+    #[tokio::test]
+    async fn test_find_settled() {
+        let (broker, mqtt) = FakeBroker::connect(Options::default());
+        let find = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { mqtt.find("+/temp").await })
+        };
+        eventually(|| !broker.subscribed().is_empty()).await;
+        // The first retained value answers the get of the find,
+        // the find waits for the others.
+        broker.send("kitchen/temp", "21", true);
+        broker.send("bedroom/temp", "19", true);
+        let mut values = find.await.unwrap().unwrap();
+        values.sort();
+        mqtt.close().await.unwrap();
+
+        assert_eq!(vec![b"19".to_vec(), b"21".to_vec()], values);
+    }
+    #[tokio::test]
+    async fn test_scene_set_observed() {
+        let (broker, mqtt) = FakeBroker::connect(Options::default());
+        // The when has subscribed before the set after it in the scene runs.
+        let code = Interpreter::from_source(
+            r#"
+            scene morning {
+                set [kitchen/light] "on";
+                when <kitchen/light> is "on" set [kitchen/seen] "yes";
+            };
+            start morning;
+        "#,
+        )
+        .unwrap();
+        let (shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let vm = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { VM::new(mqtt).run(code, shutdown_rx).await })
+        };
+        eventually(|| {
+            broker
+                .published()
+                .contains(&("kitchen/seen".to_string(), "yes".to_string()))
+        })
+        .await;
+        shutdown_tx.send(()).unwrap();
+        vm.await.unwrap().unwrap();
+        mqtt.close().await.unwrap();
+    }
+    #[tokio::test]
+    async fn test_publish_wildcard() {
+        let (_broker, mqtt) = FakeBroker::connect(Options::default());
+        assert!(mqtt.publish("dan/#", "ok".into()).await.is_err());
+    }
+    #[tokio::test]
+    async fn test_clear_wildcard() {
+        let (_broker, mqtt) = FakeBroker::connect(Options::default());
+        assert!(mqtt.clear("+/light").await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_reconnect() {
+        let (broker, mqtt) = FakeBroker::connect(Options::default());
+        let get = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { mqtt.get("kitchen/light").await })
+        };
+        time::sleep(Duration::from_millis(10)).await;
+        mqtt.disconnect().await.unwrap();
+        // Sets are dropped while disconnected instead of failing the engine.
+        mqtt.set("kitchen/light", "on".into()).await.unwrap();
+        mqtt.reconnect().await.unwrap();
+
+        // The get is still waiting for its value.
+        assert_eq!(
+            btree_map!["kitchen/light".to_string() => 1],
+            mqtt.subscriptions().await.unwrap()
+        );
+        assert!(broker.published().is_empty());
+        // Subscribed once when the get started and again when reconnecting.
+        assert_eq!(
+            vec!["kitchen/light".to_string(), "kitchen/light".to_string()],
+            broker.subscribed()
+        );
+        broker.send("kitchen/light", "off", false);
+        assert_eq!("off".as_bytes().to_vec(), get.await.unwrap().unwrap());
+    }
+    /// Options that retry a lost connection quickly.
+    fn retrying() -> Options {
+        Options {
+            reconnect_delay: Duration::from_millis(10),
+            ..Default::default()
+        }
+    }
+    /// Waits until the condition holds, failing the test after a second.
+    async fn eventually(mut condition: impl FnMut() -> bool) {
+        time::timeout(Duration::from_secs(1), async {
+            while !condition() {
+                time::sleep(Duration::from_millis(5)).await;
+            }
+        })
+        .await
+        .unwrap();
+    }
+    #[tokio::test]
+    async fn test_connection_lost() {
+        let (broker, mqtt) = FakeBroker::connect(retrying());
+        let get = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { mqtt.get("kitchen/light").await })
+        };
+        time::sleep(Duration::from_millis(10)).await;
+        broker.drop_connection();
+        // Requests are answered while the broker refuses to connect.
+        time::sleep(Duration::from_millis(50)).await;
+        mqtt.set("kitchen/light", "on".into()).await.unwrap();
+        assert_eq!(
+            btree_map!["kitchen/light".to_string() => 1],
+            mqtt.subscriptions().await.unwrap()
+        );
+        assert!(broker.published().is_empty());
+
+        broker.restore();
+        eventually(|| broker.subscribed().len() == 2).await;
+        broker.send("kitchen/light", "off", false);
+        assert_eq!("off".as_bytes().to_vec(), get.await.unwrap().unwrap());
+        mqtt.close().await.unwrap();
+    }
+    #[tokio::test]
+    async fn test_connection_lost_without_topics() {
+        let (broker, mqtt) = FakeBroker::connect(retrying());
+        mqtt.set("kitchen/light", "on".into()).await.unwrap();
+        eventually(|| broker.published().len() == 1).await;
+        broker.drop_connection();
+        time::sleep(Duration::from_millis(20)).await;
+        // Dropped while disconnected.
+        mqtt.set("kitchen/light", "off".into()).await.unwrap();
+        broker.restore();
+        // Reconnects even though there is nothing to resubscribe.
+        time::timeout(Duration::from_secs(1), async {
+            while broker.published().len() == 1 {
+                mqtt.set("kitchen/light", "off".into()).await.unwrap();
+                time::sleep(Duration::from_millis(5)).await;
+            }
+        })
+        .await
+        .unwrap();
+        assert!(broker.subscribed().is_empty());
+        mqtt.close().await.unwrap();
+    }
+    #[tokio::test]
+    async fn test_close() {
+        let (_broker, mqtt) = FakeBroker::connect(Options::default());
+        let get = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { mqtt.get("kitchen/light").await })
+        };
+        time::sleep(Duration::from_millis(10)).await;
+        mqtt.close().await.unwrap();
+
+        // The get stopped waiting even though the engine is still shared.
+        assert!(get.await.unwrap().unwrap_err().is::<Closed>());
+        assert!(mqtt.get("kitchen/light").await.unwrap_err().is::<Closed>());
+        assert!(mqtt.close().await.unwrap_err().is::<Closed>());
+    }
+    #[tokio::test]
+    async fn test_reconnect_grace() {
+        let (broker, mqtt) = FakeBroker::connect(Options {
+            reconnect_grace: Some(Duration::from_millis(100)),
+            ..retrying()
+        });
+        mqtt.subscriptions().await.unwrap();
+
+        // Resumes when the broker is back within the grace.
+        broker.drop_connection();
+        time::sleep(Duration::from_millis(20)).await;
+        broker.restore();
+        let get = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { mqtt.get("kitchen/light").await })
+        };
+        eventually(|| !broker.subscribed().is_empty()).await;
+        broker.send("kitchen/light", "on", false);
+        assert_eq!("on".as_bytes().to_vec(), get.await.unwrap().unwrap());
+
+        // Stops once the broker is gone for longer than the grace.
+        let get = {
+            let mqtt = mqtt.clone();
+            tokio::spawn(async move { mqtt.get("kitchen/light").await })
+        };
+        broker.drop_connection();
+        let err = time::timeout(Duration::from_secs(1), mqtt.failed())
+            .await
+            .unwrap();
+        assert_eq!(
+            "connection to the broker lost for longer than 100ms",
+            err.to_string()
+        );
+        assert!(get.await.unwrap().unwrap_err().is::<Closed>());
+        assert!(mqtt.close().await.unwrap_err().is::<Closed>());
+    }
+    #[test]
+    fn test_within_grace() {
+        let lost_at = Instant::now();
+        let later = |secs| lost_at + Duration::from_secs(secs);
+        // A reconnect within the grace resumes the engine.
+        assert!(within_grace(
+            lost_at,
+            Some(Duration::from_secs(60)),
+            later(30)
+        ));
+        assert!(!within_grace(
+            lost_at,
+            Some(Duration::from_secs(60)),
+            later(60)
+        ));
+        assert!(within_grace(lost_at, None, later(3600)));
+    }
+    #[test]
+    fn test_deliver_empty_payload() {
+        let (tx, mut rx) = oneshot::channel();
+        let mut watches = vec![Get {
+            path: "kitchen/light".to_string(),
+            live: false,
+            tx,
+        }];
+        let (changes, _) = broadcast::channel(1);
+
+        deliver(
+            &mut watches,
+            &changes,
+            &mut Dropped::default(),
+            "kitchen/light",
+            &[],
+            false,
+        );
+        assert_eq!(1, watches.len());
+        assert!(rx.try_recv().is_err());
+
+        deliver(
+            &mut watches,
+            &changes,
+            &mut Dropped::default(),
+            "kitchen/light",
+            "on".as_bytes(),
+            false,
+        );
+        assert!(watches.is_empty());
+        assert_eq!(
+            ("kitchen/light".to_string(), "on".as_bytes().to_vec()),
+            rx.try_recv().unwrap()
+        );
+    }
+    #[test]
+    fn test_deliver_retained() {
+        let (live_tx, mut live_rx) = oneshot::channel();
+        let (tx, mut rx) = oneshot::channel();
+        let mut watches = vec![
+            Get {
+                path: "front/door".to_string(),
+                live: true,
+                tx: live_tx,
+            },
+            Get {
+                path: "front/door".to_string(),
+                live: false,
+                tx,
+            },
+        ];
+        let (changes, _) = broadcast::channel(1);
+
+        // The retained value sent when subscribing only answers the get that is not live.
+        deliver(
+            &mut watches,
+            &changes,
+            &mut Dropped::default(),
+            "front/door",
+            "open".as_bytes(),
+            true,
+        );
+        assert_eq!(1, watches.len());
+        assert_eq!("open".as_bytes().to_vec(), rx.try_recv().unwrap().1);
+        assert!(live_rx.try_recv().is_err());
+
+        deliver(
+            &mut watches,
+            &changes,
+            &mut Dropped::default(),
+            "front/door",
+            "closed".as_bytes(),
+            false,
+        );
+        assert!(watches.is_empty());
+        assert_eq!("closed".as_bytes().to_vec(), live_rx.try_recv().unwrap().1);
+    }
+    #[test]
+    fn test_deliver_changes() {
+        let (changes, mut changes_rx) = broadcast::channel(CHANGES_CAPACITY);
+
+        deliver(
+            &mut Vec::new(),
+            &changes,
+            &mut Dropped::default(),
+            "kitchen/light",
+            "on".as_bytes(),
+            false,
+        );
+        deliver(
+            &mut Vec::new(),
+            &changes,
+            &mut Dropped::default(),
+            "kitchen/light",
+            &[],
+            false,
+        );
+
+        assert_eq!(
+            Change {
+                topic: "kitchen/light".to_string(),
+                payload: "on".as_bytes().to_vec(),
+            },
+            changes_rx.try_recv().unwrap()
+        );
+        assert_eq!(
+            Change {
+                topic: "kitchen/light".to_string(),
+                payload: Vec::new(),
+            },
+            changes_rx.try_recv().unwrap()
+        );
+    }
+    #[test]
+    fn test_deliver_dropped() {
+        let (changes, mut changes_rx) = broadcast::channel(CHANGES_CAPACITY);
+        let mut dropped = Dropped::default();
+        for i in 0..CHANGES_CAPACITY + 3 {
+            let topic = if i < CHANGES_CAPACITY {
+                "kitchen/light"
+            } else {
+                "hall/light"
+            };
+            deliver(
+                &mut Vec::new(),
+                &changes,
+                &mut dropped,
+                topic,
+                "on".as_bytes(),
+                false,
+            );
+        }
+        assert_eq!(3, dropped.total);
+        assert_eq!(
+            vec![("hall/light".to_string(), 3)],
+            dropped.topics.into_iter().collect::<Vec<(String, u64)>>()
+        );
+        // The consumer missed the oldest changes.
+        assert!(matches!(
+            changes_rx.try_recv(),
+            Err(broadcast::error::TryRecvError::Lagged(3))
+        ));
+    }
+    #[test]
+    fn test_deliver_not_dropped() {
+        // Without consumers nothing is kept, so nothing is dropped.
+        let (changes, changes_rx) = broadcast::channel(CHANGES_CAPACITY);
+        drop(changes_rx);
+        let mut dropped = Dropped::default();
+        for _ in 0..CHANGES_CAPACITY * 2 {
+            deliver(
+                &mut Vec::new(),
+                &changes,
+                &mut dropped,
+                "kitchen/light",
+                "on".as_bytes(),
+                false,
+            );
+        }
+        assert_eq!(0, dropped.total);
+
+        // A consumer keeping up misses nothing.
+        let mut changes_rx = changes.subscribe();
+        for _ in 0..CHANGES_CAPACITY * 2 {
+            deliver(
+                &mut Vec::new(),
+                &changes,
+                &mut dropped,
+                "kitchen/light",
+                "on".as_bytes(),
+                false,
+            );
+            changes_rx.try_recv().unwrap();
+        }
+        assert_eq!(0, dropped.total);
+    }
+    #[tokio::test]
+    async fn test_changes() {
+        let (broker, mqtt) = FakeBroker::connect(Options::default());
+        let mut changes = mqtt.changes();
+        // A slow consumer does not count as a dropped change for the others.
+        let slow = mqtt.changes();
+        for _ in 0..CHANGES_CAPACITY * 2 {
+            broker.send("kitchen/light", "on", false);
+            changes.recv().await.unwrap();
+        }
+        assert_eq!(CHANGES_CAPACITY as u64, mqtt.dropped().await.unwrap().total);
+        drop(slow);
+        for _ in 0..CHANGES_CAPACITY * 2 {
+            broker.send("kitchen/light", "off", false);
+            changes.recv().await.unwrap();
+        }
+        assert_eq!(CHANGES_CAPACITY as u64, mqtt.dropped().await.unwrap().total);
+
+        // The feed closes once the engine stops.
+        mqtt.close().await.unwrap();
+        time::sleep(Duration::from_millis(10)).await;
+        assert!(matches!(
+            changes.recv().await,
+            Err(broadcast::error::RecvError::Closed)
+        ));
+        assert!(matches!(
+            mqtt.changes().recv().await,
+            Err(broadcast::error::RecvError::Closed)
+        ));
+    }
+    #[test]
+    fn test_subscriptions() {
+        let topics: BTreeSet<String> = ["kitchen/light", "bedroom/light"]
+            .iter()
+            .map(|t| t.to_string())
+            .collect();
+        let (tx1, rx1) = oneshot::channel();
+        let (tx2, rx2) = oneshot::channel();
+        let mut watches = vec![
+            Get {
+                path: "kitchen/light".to_string(),
+                live: false,
+                tx: tx1,
+            },
+            Get {
+                path: "kitchen/light".to_string(),
+                live: false,
+                tx: tx2,
+            },
+        ];
+
+        assert_eq!(
+            btree_map![
+                "bedroom/light".to_string() => 0,
+                "kitchen/light".to_string() => 2
+            ],
+            subscriptions(&topics, &mut watches)
+        );
+
+        // Stopped threads drop their receivers
+        drop(rx1);
+        assert_eq!(
+            btree_map![
+                "bedroom/light".to_string() => 0,
+                "kitchen/light".to_string() => 1
+            ],
+            subscriptions(&topics, &mut watches)
+        );
+        drop(rx2);
+        assert_eq!(
+            btree_map![
+                "bedroom/light".to_string() => 0,
+                "kitchen/light".to_string() => 0
+            ],
+            subscriptions(&topics, &mut watches)
+        );
+        assert!(watches.is_empty());
+    }
+    #[test]
+    fn test_unique_client_id() {
+        let a = unique_client_id("dan");
+        let b = unique_client_id("dan");
+        assert_ne!(a, b);
+        assert!(a.starts_with("dan-"));
+        assert!(b.starts_with("dan-"));
+    }
+    #[test]
+    fn test_find() {
+        let mut values = History::new(1, None);
+        let now = Instant::now();
+        values.record("kitchen/temp", b"20", now);
+        values.record("kitchen/temp", b"21", now);
+        values.record("bedroom/temp", b"19", now);
+        values.record("bedroom/light", b"on", now);
+        assert_eq!(
+            vec!["19".as_bytes().to_vec(), "21".as_bytes().to_vec()],
+            find(&values, "+/temp")
+        );
+        assert!(find(&values, "garage/temp").is_empty());
+    }
+    #[test]
+    fn test_history() {
+        let mut history = History::new(3, None);
+        let start = Instant::now();
+        for (i, v) in ["18", "19", "20", "21"].iter().enumerate() {
+            history.record(
+                "kitchen/temp",
+                v.as_bytes(),
+                start + Duration::from_secs(i as u64),
+            );
+        }
+        assert_eq!(
+            vec![
+                Sample {
+                    time: start + Duration::from_secs(1),
+                    payload: b"19".to_vec()
+                },
+                Sample {
+                    time: start + Duration::from_secs(2),
+                    payload: b"20".to_vec()
+                },
+                Sample {
+                    time: start + Duration::from_secs(3),
+                    payload: b"21".to_vec()
+                },
+            ],
+            history.samples("kitchen/temp")
+        );
+        assert!(history.samples("bedroom/temp").is_empty());
+
+        history.record("kitchen/temp", b"", start);
+        assert!(history.samples("kitchen/temp").is_empty());
+
+        let mut history = History::new(0, None);
+        history.record("kitchen/temp", b"20", start);
+        history.record("kitchen/temp", b"21", start);
+        assert_eq!(1, history.samples("kitchen/temp").len());
+    }
+    #[test]
+    fn test_history_window() {
+        let payloads = |history: &History| {
+            history
+                .samples("kitchen/temp")
+                .into_iter()
+                .map(|s| s.payload)
+                .collect::<Vec<_>>()
+        };
+        let start = Instant::now();
+        // Trends without a window keep the last two values.
+        let mut history = History::new(1, Some(Duration::ZERO));
+        for (i, v) in ["18", "19", "20"].iter().enumerate() {
+            history.record(
+                "kitchen/temp",
+                v.as_bytes(),
+                start + Duration::from_secs(i as u64),
+            );
+        }
+        assert_eq!(vec![b"19".to_vec(), b"20".to_vec()], payloads(&history));
+
+        // The last value before the window is kept to measure the change across it.
+        let mut history = History::new(1, Some(Duration::from_secs(10)));
+        for (i, v) in ["18", "19", "20", "21"].iter().enumerate() {
+            history.record(
+                "kitchen/temp",
+                v.as_bytes(),
+                start + Duration::from_secs(5 * i as u64),
+            );
+        }
+        assert_eq!(
+            vec![b"19".to_vec(), b"20".to_vec(), b"21".to_vec()],
+            payloads(&history)
+        );
+    }
+    #[test]
+    fn test_history_capacity() {
+        let mut history = History::new(1, None);
+        history.capacity = 2;
+        let start = Instant::now();
+        history.record("kitchen/temp", b"20", start);
+        history.record("bedroom/temp", b"19", start + Duration::from_secs(1));
+        history.record("kitchen/temp", b"21", start + Duration::from_secs(2));
+        // The bedroom was updated longest ago.
+        history.record("hall/temp", b"18", start + Duration::from_secs(3));
+
+        assert_eq!(
+            vec!["hall/temp", "kitchen/temp"],
+            history.values.keys().collect::<Vec<_>>()
+        );
+    }
+    #[test]
+    fn test_topic_matches() {
+        assert!(topic_matches("kitchen/light", "kitchen/light"));
+        assert!(!topic_matches("kitchen/light", "kitchen/light/set"));
+        assert!(!topic_matches("kitchen/light/set", "kitchen/light"));
+        assert!(!topic_matches("kitchen/light", "bedroom/light"));
+    }
+    #[test]
+    fn test_topic_matches_wildcard_toplevel() {
+        assert!(topic_matches("+/light", "kitchen/light"));
+        assert!(topic_matches("+/light", "bedroom/light"));
+        assert!(!topic_matches("+/light", "kitchen/fan"));
+        assert!(!topic_matches("+/light", "kitchen/light/set"));
+        assert!(topic_matches("+/+/light", "house/kitchen/light"));
+        assert!(topic_matches("#", "kitchen/light"));
+        assert!(topic_matches("kitchen/#", "kitchen/light/set"));
+        assert!(!topic_matches("kitchen/#", "bedroom/light"));
+    }
+    #[test]
+    fn test_is_wildcard() {
+        assert!(is_wildcard("+/light"));
+        assert!(is_wildcard("kitchen/#"));
+        assert!(!is_wildcard("kitchen/light"));
+        assert!(!is_wildcard("kitchen+/light"));
+    }
 }
@@ -0,0 +1,233 @@
+use anyhow::{anyhow, Result};
+use async_trait::async_trait;
+use std::{collections::BTreeMap, sync::Arc};
+
+use crate::{
+    mqtt_engine::Sample,
+    vm::{Engine, NoMatch},
+};
+
+/// Router is an engine that forwards each get and set to the engine
+/// that owns the toplevel of the path.
+/// This allows a single program to control devices across several MQTT brokers.
+#[derive(Debug, Clone)]
+pub struct Router<E: Engine> {
+    routes: Arc<BTreeMap<String, E>>,
+    default: Option<E>,
+}
+
+impl<E: Engine> Router<E> {
+    /// Creates a router from a map of toplevel to engine.
+    /// Paths with a toplevel not in the map use the default engine,
+    /// without a default engine they are an error.
+    pub fn new(routes: BTreeMap<String, E>, default: Option<E>) -> Self {
+        Self {
+            routes: Arc::new(routes),
+            default,
+        }
+    }
+    /// Returns every engine that may own a path of the wildcard toplevel.
+    fn engines(&self) -> impl Iterator<Item = &E> {
+        self.routes.values().chain(self.default.as_ref())
+    }
+    fn engine(&self, path: &str) -> Result<&E> {
+        let toplevel = path.split('/').next().unwrap_or_default();
+        self.routes
+            .get(toplevel)
+            .or(self.default.as_ref())
+            .ok_or_else(|| anyhow!("no engine for toplevel {}", toplevel))
+    }
+}
+
+#[async_trait]
+impl<E: Engine + 'static> Engine for Router<E> {
+    async fn get(&self, path: &str) -> Result<Vec<u8>> {
+        self.engine(path)?.get(path).await
+    }
+    async fn get_live(&self, path: &str) -> Result<Vec<u8>> {
+        self.engine(path)?.get_live(path).await
+    }
+    async fn get_topic(&self, path: &str, live: bool) -> Result<(String, Vec<u8>)> {
+        self.engine(path)?.get_topic(path, live).await
+    }
+    async fn subscribe(&self, path: &str) -> Result<()> {
+        // A wildcard toplevel may match the devices of every broker.
+        if matches!(path.split('/').next(), Some("+" | "#")) {
+            for engine in self.engines() {
+                engine.subscribe(path).await?;
+            }
+            return Ok(());
+        }
+        self.engine(path)?.subscribe(path).await
+    }
+    async fn set(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        // A wildcard toplevel sets the matching devices of every broker,
+        // it matches nothing only if it matches nothing in any of them.
+        if matches!(path.split('/').next(), Some("+" | "#")) {
+            let mut no_match = None;
+            let mut matched = false;
+            for engine in self.engines() {
+                match engine.set(path, value.clone()).await {
+                    Ok(()) => matched = true,
+                    Err(err) if err.is::<NoMatch>() => no_match = Some(err),
+                    Err(err) => return Err(err),
+                }
+            }
+            return match no_match {
+                Some(err) if !matched => Err(err),
+                _ => Ok(()),
+            };
+        }
+        self.engine(path)?.set(path, value).await
+    }
+    async fn publish(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        self.engine(path)?.publish(path, value).await
+    }
+    async fn clear(&self, path: &str) -> Result<()> {
+        self.engine(path)?.clear(path).await
+    }
+    async fn find(&self, path: &str) -> Result<Vec<Vec<u8>>> {
+        self.engine(path)?.find(path).await
+    }
+    async fn history(&self, path: &str) -> Result<Vec<Sample>> {
+        self.engine(path)?.history(path).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Mutex;
+
+    use super::*;
+
+    #[derive(Debug, Clone)]
+    struct TestEngine {
+        calls: Arc<Mutex<Vec<String>>>,
+    }
+    impl TestEngine {
+        fn new() -> Self {
+            Self {
+                calls: Arc::new(Mutex::new(Vec::new())),
+            }
+        }
+        fn calls(&self) -> Vec<String> {
+            self.calls.lock().unwrap().drain(..).collect()
+        }
+    }
+
+    #[async_trait]
+    impl Engine for TestEngine {
+        async fn get(&self, path: &str) -> Result<Vec<u8>> {
+            self.calls.lock().unwrap().push(format!("get {}", path));
+            Ok("1".as_bytes().to_vec())
+        }
+        async fn subscribe(&self, path: &str) -> Result<()> {
+            self.calls
+                .lock()
+                .unwrap()
+                .push(format!("subscribe {}", path));
+            Ok(())
+        }
+        async fn set(&self, path: &str, value: Vec<u8>) -> Result<()> {
+            self.calls.lock().unwrap().push(format!(
+                "set {} {}",
+                path,
+                String::from_utf8(value).unwrap()
+            ));
+            Ok(())
+        }
+        async fn publish(&self, path: &str, value: Vec<u8>) -> Result<()> {
+            self.calls.lock().unwrap().push(format!(
+                "publish {} {}",
+                path,
+                String::from_utf8(value).unwrap()
+            ));
+            Ok(())
+        }
+        async fn clear(&self, path: &str) -> Result<()> {
+            self.calls.lock().unwrap().push(format!("clear {}", path));
+            Ok(())
+        }
+        async fn find(&self, path: &str) -> Result<Vec<Vec<u8>>> {
+            self.calls.lock().unwrap().push(format!("find {}", path));
+            Ok(Vec::new())
+        }
+        async fn history(&self, path: &str) -> Result<Vec<Sample>> {
+            self.calls.lock().unwrap().push(format!("history {}", path));
+            Ok(Vec::new())
+        }
+    }
+
+    #[tokio::test]
+    async fn test_route_by_toplevel() {
+        let home = TestEngine::new();
+        let cabin = TestEngine::new();
+        let router = Router::new(
+            btree_map![
+                "home".to_string() => home.clone(),
+                "cabin".to_string() => cabin.clone()
+            ],
+            None,
+        );
+
+        router.set("home/light", "on".into()).await.unwrap();
+        router.get("cabin/temp").await.unwrap();
+        router.set("cabin/heat", "off".into()).await.unwrap();
+        router.clear("cabin/fan").await.unwrap();
+
+        assert_eq!(vec!["set home/light on".to_string()], home.calls());
+        assert_eq!(
+            vec![
+                "get cabin/temp".to_string(),
+                "set cabin/heat off".to_string(),
+                "clear cabin/fan".to_string()
+            ],
+            cabin.calls()
+        );
+    }
+    #[tokio::test]
+    async fn test_route_unknown_toplevel() {
+        let home = TestEngine::new();
+        let router = Router::new(btree_map!["home".to_string() => home.clone()], None);
+
+        assert!(router.set("garage/door", "open".into()).await.is_err());
+        assert!(router.get("garage/door").await.is_err());
+        assert!(home.calls().is_empty());
+    }
+    #[tokio::test]
+    async fn test_route_wildcard_toplevel() {
+        let home = TestEngine::new();
+        let cabin = TestEngine::new();
+        let router = Router::new(
+            btree_map![
+                "home".to_string() => home.clone(),
+                "cabin".to_string() => cabin.clone()
+            ],
+            None,
+        );
+
+        router.set("+/light", "on".into()).await.unwrap();
+
+        assert_eq!(vec!["set +/light on".to_string()], home.calls());
+        assert_eq!(vec!["set +/light on".to_string()], cabin.calls());
+
+        router.subscribe("+/temp").await.unwrap();
+
+        assert_eq!(vec!["subscribe +/temp".to_string()], home.calls());
+        assert_eq!(vec!["subscribe +/temp".to_string()], cabin.calls());
+    }
+    #[tokio::test]
+    async fn test_route_default() {
+        let home = TestEngine::new();
+        let other = TestEngine::new();
+        let router = Router::new(
+            btree_map!["home".to_string() => home.clone()],
+            Some(other.clone()),
+        );
+
+        router.set("garage/door", "open".into()).await.unwrap();
+
+        assert!(home.calls().is_empty());
+        assert_eq!(vec!["set garage/door open".to_string()], other.calls());
+    }
+}
@@ -0,0 +1,295 @@
+use anyhow::{anyhow, Result};
+use async_trait::async_trait;
+use std::{
+    collections::{BTreeMap, BTreeSet},
+    sync::{Arc, Mutex},
+};
+use tokio::{sync::broadcast, time};
+
+use crate::{
+    mqtt_engine::{topic_matches, Sample},
+    vm::{self, Engine},
+};
+
+/// Snapshot is an engine that answers gets from a snapshot of the values of the devices
+/// and records sets instead of publishing them, to simulate a program without a broker.
+/// Like the retained values a broker sends when subscribing, each when receives
+/// the value of every path it reads once, its later gets wait for the program to set the path.
+/// Gets outside of a when receive the value each time.
+#[derive(Debug, Clone)]
+pub struct Snapshot {
+    state: Arc<Mutex<State>>,
+    // Sends every set, publish and clear to the gets waiting on its path.
+    changes_tx: broadcast::Sender<(String, Vec<u8>)>,
+}
+
+#[derive(Debug, Default)]
+struct State {
+    values: BTreeMap<String, Vec<u8>>,
+    // The paths whose value from the snapshot each when already received, see vm::reader.
+    received: BTreeSet<(usize, String)>,
+    history: BTreeMap<String, Vec<Sample>>,
+    sets: Vec<(String, Vec<u8>)>,
+}
+
+impl Snapshot {
+    /// Creates a snapshot from a map of path to payload.
+    pub fn new(values: BTreeMap<String, Vec<u8>>) -> Self {
+        let history = values
+            .iter()
+            .map(|(path, payload)| (path.clone(), vec![sample(payload)]))
+            .collect();
+        let (changes_tx, _) = broadcast::channel(64);
+        Self {
+            state: Arc::new(Mutex::new(State {
+                values,
+                history,
+                ..Default::default()
+            })),
+            changes_tx,
+        }
+    }
+    /// Reads a snapshot from a JSON object of path to value,
+    /// a string value is the payload itself and any other value is its JSON.
+    pub fn from_json(json: &str) -> Result<Self> {
+        let object = match serde_json::from_str(json)? {
+            serde_json::Value::Object(object) => object,
+            _ => return Err(anyhow!("snapshot must be a JSON object of path to value")),
+        };
+        let values = object
+            .into_iter()
+            .map(|(path, value)| {
+                let payload = match value {
+                    serde_json::Value::String(s) => s.into_bytes(),
+                    value => value.to_string().into_bytes(),
+                };
+                (path, payload)
+            })
+            .collect();
+        Ok(Self::new(values))
+    }
+    /// Returns every set, publish and clear of the program in order,
+    /// a clear has an empty payload.
+    pub fn sets(&self) -> Vec<(String, Vec<u8>)> {
+        self.state.lock().unwrap().sets.clone()
+    }
+    fn change(&self, path: &str, value: Vec<u8>) {
+        let mut state = self.state.lock().unwrap();
+        state.sets.push((path.to_string(), value.clone()));
+        state
+            .history
+            .entry(path.to_string())
+            .or_default()
+            .push(sample(&value));
+        state.values.insert(path.to_string(), value.clone());
+        // Without waiting gets nobody receives the change.
+        let _ = self.changes_tx.send((path.to_string(), value));
+    }
+    /// Waits for the program to change a path matching the path.
+    async fn changed(
+        mut changes_rx: broadcast::Receiver<(String, Vec<u8>)>,
+        path: &str,
+    ) -> Result<(String, Vec<u8>)> {
+        loop {
+            let (topic, value) = changes_rx.recv().await?;
+            if topic_matches(path, &topic) {
+                return Ok((topic, value));
+            }
+        }
+    }
+}
+
+fn sample(payload: &[u8]) -> Sample {
+    Sample {
+        time: time::Instant::now(),
+        payload: payload.to_vec(),
+    }
+}
+
+#[async_trait]
+impl Engine for Snapshot {
+    async fn get(&self, path: &str) -> Result<Vec<u8>> {
+        Ok(self.get_topic(path, false).await?.1)
+    }
+    async fn get_live(&self, path: &str) -> Result<Vec<u8>> {
+        Ok(self.get_topic(path, true).await?.1)
+    }
+    async fn get_topic(&self, path: &str, live: bool) -> Result<(String, Vec<u8>)> {
+        if live {
+            return Self::changed(self.changes_tx.subscribe(), path).await;
+        }
+        let changes_rx = {
+            let mut state = self.state.lock().unwrap();
+            let reader = vm::reader();
+            let value = state
+                .values
+                .iter()
+                .find(|(topic, value)| {
+                    topic_matches(path, topic)
+                        && !value.is_empty()
+                        && reader
+                            .map_or(true, |r| !state.received.contains(&(r, topic.to_string())))
+                })
+                .map(|(topic, value)| (topic.clone(), value.clone()));
+            if let Some((topic, value)) = value {
+                if let Some(reader) = reader {
+                    state.received.insert((reader, topic.clone()));
+                }
+                return Ok((topic, value));
+            }
+            // Subscribe while locked so that no change is missed.
+            self.changes_tx.subscribe()
+        };
+        Self::changed(changes_rx, path).await
+    }
+    async fn set(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        self.change(path, value);
+        Ok(())
+    }
+    async fn publish(&self, path: &str, value: Vec<u8>) -> Result<()> {
+        self.change(path, value);
+        Ok(())
+    }
+    async fn clear(&self, path: &str) -> Result<()> {
+        self.change(path, Vec::new());
+        Ok(())
+    }
+    async fn find(&self, path: &str) -> Result<Vec<Vec<u8>>> {
+        let state = self.state.lock().unwrap();
+        Ok(state
+            .values
+            .iter()
+            .filter(|(topic, value)| topic_matches(path, topic) && !value.is_empty())
+            .map(|(_, value)| value.clone())
+            .collect())
+    }
+    async fn history(&self, path: &str) -> Result<Vec<Sample>> {
+        let state = self.state.lock().unwrap();
+        Ok(state.history.get(path).cloned().unwrap_or_default())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::{compiler::Interpreter, vm::VM, Compile};
+    use std::time::Duration;
+
+    #[tokio::test]
+    async fn test_snapshot() {
+        let snapshot = Snapshot::from_json(
+            r#"{"living/lux": 20, "living/mode": "movie", "porch/light": "off"}"#,
+        )
+        .unwrap();
+        let code = Interpreter::from_source(
+            r#"
+            scene evening {
+                when <living/lux> < 50 set [living/light] "on";
+                set [living/blinds] <living/mode>;
+                set [porch/light] "on";
+            };
+            start evening;
+            "#,
+        )
+        .unwrap();
+        let vm = VM::new(snapshot.clone());
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        // The when waits for the next value of the lux forever.
+        let _ = time::timeout(Duration::from_millis(100), vm.run(code, shutdown_rx)).await;
+
+        let mut sets: Vec<(String, String)> = snapshot
+            .sets()
+            .into_iter()
+            .map(|(path, value)| (path, String::from_utf8(value).unwrap()))
+            .collect();
+        sets.sort();
+        assert_eq!(
+            vec![
+                ("living/blinds".to_string(), "movie".to_string()),
+                ("living/light".to_string(), "on".to_string()),
+                ("porch/light".to_string(), "on".to_string()),
+            ],
+            sets
+        );
+    }
+    #[tokio::test]
+    async fn test_snapshot_received_once() {
+        let snapshot = Snapshot::from_json(r#"{"kitchen/light": "off"}"#).unwrap();
+        // Gets outside of a when receive the value each time.
+        assert_eq!(b"off".to_vec(), snapshot.get("kitchen/+").await.unwrap());
+        assert_eq!(
+            b"off".to_vec(),
+            snapshot.get("kitchen/light").await.unwrap()
+        );
+        // A when receives it once, like the retained value of a subscribed topic,
+        // its next get waits for a set.
+        let when = {
+            let snapshot = snapshot.clone();
+            tokio::spawn(vm::READER.scope(1, async move {
+                let first = snapshot.get("kitchen/light").await?;
+                let next = snapshot.get("kitchen/light").await?;
+                Ok::<_, anyhow::Error>((first, next))
+            }))
+        };
+        time::sleep(Duration::from_millis(10)).await;
+        snapshot.set("kitchen/light", "on".into()).await.unwrap();
+        assert_eq!(
+            (b"off".to_vec(), b"on".to_vec()),
+            when.await.unwrap().unwrap()
+        );
+        assert_eq!(2, snapshot.history("kitchen/light").await.unwrap().len());
+    }
+    #[tokio::test]
+    async fn test_snapshot_two_whens() {
+        let snapshot = Snapshot::from_json(r#"{"kitchen/light": "on"}"#).unwrap();
+        let code = Interpreter::from_source(
+            r#"
+            when <kitchen/light> is "on" set [kitchen/fan] "on";
+            when <kitchen/light> is "on" set [hall/light] "on";
+            "#,
+        )
+        .unwrap();
+        let vm = VM::new(snapshot.clone());
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let _ = time::timeout(Duration::from_millis(100), vm.run(code, shutdown_rx)).await;
+
+        // Both whens receive the value of the light once.
+        let mut sets = snapshot.sets();
+        sets.sort();
+        assert_eq!(
+            vec![
+                ("hall/light".to_string(), b"on".to_vec()),
+                ("kitchen/fan".to_string(), b"on".to_vec()),
+            ],
+            sets
+        );
+    }
+    #[tokio::test]
+    async fn test_snapshot_wildcard_when() {
+        let snapshot = Snapshot::from_json(
+            r#"{"home/bath/motion": "detected", "home/hall/motion": "clear", "home/kitchen/motion": "detected"}"#,
+        )
+        .unwrap();
+        let code = Interpreter::from_source(
+            r#"when <home/+/motion> is "detected" publish [dan/motion] $path;"#,
+        )
+        .unwrap();
+        let vm = VM::new(snapshot.clone());
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let _ = time::timeout(Duration::from_millis(100), vm.run(code, shutdown_rx)).await;
+
+        // The when fires for every room with motion and its publish does not match the filter.
+        assert_eq!(
+            vec![
+                ("dan/motion".to_string(), b"home/bath/motion".to_vec()),
+                ("dan/motion".to_string(), b"home/kitchen/motion".to_vec()),
+            ],
+            snapshot.sets()
+        );
+    }
+    #[test]
+    fn test_from_json() {
+        assert!(Snapshot::from_json("[1, 2]").is_err());
+        assert!(Snapshot::from_json("{").is_err());
+    }
+}
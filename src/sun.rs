@@ -1,72 +1,132 @@
-use chrono::{DateTime, Local};
-pub fn sunset(lat: f64, lon: f64, offset: f64) -> DateTime<Local> {
-}
-fn _do(lat: f64, lon: f64, offset: f64) ->  {
-    let today = Local::today();
+use chrono::{DateTime, Duration, NaiveDate, TimeZone, Utc};
+use std::fmt;
 
-    let d2 = 0.0; // d2 is the current date, # of days since Jan 1 1900?
-    let f2 = d2 + 2415018.5 - offset / 24.0;
-    let g2 = (f2 - 2451545.0) / 36525.0;
-    let i2 = (280.46646 + g2 * (36000.76983 + g2 * 0.0003032)) % 360.0;
-    let j2 = 357.52911 + g2 * (35999.05029 - 0.0001537 * g2);
-    let k2 = 0.016708634 - g2 * (0.000042037 + 0.0000001267 * g2);
-    let l2 = f64::sin(radians(j2)) * (1.914602 - g2 * (0.004817 + 0.000014 * g2))
-        + f64::sin(radians(2.0 * j2)) * (0.019993 - 0.000101 * g2)
-        + f64::sin(radians(3.0 * j2)) * 0.000289;
-    let m2 = i2 + l2;
-    let n2 = j2 + l2;
-    let o2 = (1.000001018 * (1.0 - k2 * k2)) / (1.0 + k2 * f64::cos(radians(n2)));
-    let p2 = m2 - 0.00569 - 0.00478 * f64::sin(radians(125.04 - 1934.136 * g2));
-    let q2 =
-        23.0 + (26.0 + (21.448 - g2 * (46.815 + g2 * (0.00059 - g2 * 0.001813))) / 60.0) / 60.0;
-    let r2 = q2 + 0.00256 * f64::cos(radians(125.04 - 1934.136 * g2));
-    // TODO is atan2 arg order correct?
-    let s2 = degrees(f64::atan2(
-        f64::cos(radians(p2)),
-        f64::cos(radians(r2)) * f64::sin(radians(p2)),
-    ));
-    let t2 = degrees(f64::asin(f64::sin(radians(r2)) * f64::sin(radians(p2))));
-    let u2 = f64::tan(radians(r2 / 2.0)) * f64::tan(radians(r2 / 2.0));
-    let v2 = 4.0
-        * degrees(
-            u2 * f64::sin(2.0 * radians(i2)) - 2.0 * k2 * f64::sin(radians(j2))
-                + 4.0 * k2 * u2 * f64::sin(radians(j2)) * f64::cos(2.0 * radians(i2))
-                - 0.5 * u2 * u2 * f64::sin(4.0 * radians(i2))
-                - 1.25 * k2 * k2 * f64::sin(2.0 * radians(j2)),
-        );
-    let w2 = degrees(f64::acos(
-        f64::cos(radians(90.833)) / (f64::cos(radians(lat)) * f64::cos(radians(t2)))
-            - f64::tan(radians(lat)) * f64::tan(radians(t2)),
-    ));
-    let x2 = (720.0 - 4.0 * lon - v2 + offset * 60.0) / 1440.0;
-    let sunrise = x2 - w2 * 4.0 / 1440.0;
-    let sunset = x2 + w2 * 4.0 / 1440.0;
+/// Location of the home in degrees, north and east are positive.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Location {
+    pub latitude: f64,
+    pub longitude: f64,
 }
 
-fn radians(deg: f64) -> f64 {
-    deg * std::f64::consts::PI / 180.0
+impl fmt::Display for Location {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{},{}", self.latitude, self.longitude)
+    }
 }
-fn degrees(rad: f64) -> f64 {
-    rad / std::f64::consts::PI * 180.0
+
+impl Location {
+    /// Returns when the sun rises on the date at the location,
+    /// there is none on the days the sun stays up or down, i.e. the polar night.
+    pub fn sunrise(&self, date: NaiveDate) -> Option<DateTime<Utc>> {
+        self.sun(date, -1.0)
+    }
+    /// Returns when the sun sets on the date at the location, like sunrise.
+    pub fn sunset(&self, date: NaiveDate) -> Option<DateTime<Utc>> {
+        self.sun(date, 1.0)
+    }
+    // Computes the time the sun crosses the horizon before solar noon, or after it,
+    // using the equations of the NOAA solar calculator.
+    fn sun(&self, date: NaiveDate, side: f64) -> Option<DateTime<Utc>> {
+        let sin = |deg: f64| deg.to_radians().sin();
+        let cos = |deg: f64| deg.to_radians().cos();
+        let tan = |deg: f64| deg.to_radians().tan();
+        let (lat, lon) = (self.latitude, self.longitude);
+
+        let midnight = Utc.from_utc_datetime(&date.and_hms_opt(0, 0, 0).unwrap());
+        // Julian centuries since J2000 of noon at the location.
+        let julian_day = midnight.timestamp() as f64 / 86400.0 + 2440587.5 + 0.5 - lon / 360.0;
+        let t = (julian_day - 2451545.0) / 36525.0;
+
+        let mean_longitude = (280.46646 + t * (36000.76983 + t * 0.0003032)) % 360.0;
+        let mean_anomaly = 357.52911 + t * (35999.05029 - 0.0001537 * t);
+        let eccentricity = 0.016708634 - t * (0.000042037 + 0.0000001267 * t);
+        let center = sin(mean_anomaly) * (1.914602 - t * (0.004817 + 0.000014 * t))
+            + sin(2.0 * mean_anomaly) * (0.019993 - 0.000101 * t)
+            + sin(3.0 * mean_anomaly) * 0.000289;
+        let omega = 125.04 - 1934.136 * t;
+        let apparent_longitude = mean_longitude + center - 0.00569 - 0.00478 * sin(omega);
+        let obliquity = 23.0
+            + (26.0 + (21.448 - t * (46.815 + t * (0.00059 - t * 0.001813))) / 60.0) / 60.0
+            + 0.00256 * cos(omega);
+        let declination = (sin(obliquity) * sin(apparent_longitude))
+            .asin()
+            .to_degrees();
+        let y = tan(obliquity / 2.0) * tan(obliquity / 2.0);
+        let equation_of_time = 4.0
+            * (y * sin(2.0 * mean_longitude) - 2.0 * eccentricity * sin(mean_anomaly)
+                + 4.0 * eccentricity * y * sin(mean_anomaly) * cos(2.0 * mean_longitude)
+                - 0.5 * y * y * sin(4.0 * mean_longitude)
+                - 1.25 * eccentricity * eccentricity * sin(2.0 * mean_anomaly))
+            .to_degrees();
+
+        let cos_hour_angle =
+            cos(90.833) / (cos(lat) * cos(declination)) - tan(lat) * tan(declination);
+        // The sun does not cross the horizon that day.
+        if !(-1.0..=1.0).contains(&cos_hour_angle) {
+            return None;
+        }
+        let hour_angle = cos_hour_angle.acos().to_degrees();
+        // Minutes after midnight UTC, which may be on the day before or after the date.
+        let minutes = 720.0 - 4.0 * lon - equation_of_time + side * 4.0 * hour_angle;
+        Some(midnight + Duration::milliseconds((minutes * 60_000.0) as i64))
+    }
 }
 
-//f2 = D2+2415018.5-$B$5/24
-//g2 = (F2-2451545)/36525
-//i2 = MOD(280.46646+G2*(36000.76983+G2*0.0003032),360)
-//j2 = 357.52911+G2*(35999.05029-0.0001537*G2)
-//k2 = 0.016708634-G2*(0.000042037+0.0000001267*G2)
-//l2 = SIN(RADIANS(J2))*(1.914602-G2*(0.004817+0.000014*G2))+SIN(RADIANS(2*J2))*(0.019993-0.000101*G2)+SIN(RADIANS(3*J2))*0.000289
-//m2 = I2+L2
-//n2 = J2+L2
-//o2 = (1.000001018*(1-K2*K2))/(1+K2*COS(RADIANS(N2)))
-//p2 = M2-0.00569-0.00478*SIN(RADIANS(125.04-1934.136*G2))
-//q2 = 23+(26+((21.448-G2*(46.815+G2*(0.00059-G2*0.001813))))/60)/60
-//r2 = Q2+0.00256*COS(RADIANS(125.04-1934.136*G2))
-//s2 = DEGREES(ATAN2(COS(RADIANS(P2)),COS(RADIANS(R2))*SIN(RADIANS(P2))))
-//t2 = DEGREES(ASIN(SIN(RADIANS(R2))*SIN(RADIANS(P2))))
-//u2 = TAN(RADIANS(R2/2))*TAN(RADIANS(R2/2))
-//v2 = 4*DEGREES(U2*SIN(2*RADIANS(I2))-2*K2*SIN(RADIANS(J2))+4*K2*U2*SIN(RADIANS(J2))*COS(2*RADIANS(I2))-0.5*U2*U2*SIN(4*RADIANS(I2))-1.25*K2*K2*SIN(2*RADIANS(J2)))
-//w2 = DEGREES(ACOS(COS(RADIANS(90.833))/(COS(RADIANS(lat))*COS(RADIANS(T2)))-TAN(RADIANS(lat))*TAN(RADIANS(T2))))
-//x2 =(720-4*lon-V2+offset_east*60)/1440
-//y2 = X2-W2*4/1440 // sunrize
-//z2 = x2 + w2*4/1440 //sunset
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn utc(y: i32, mo: u32, d: u32, h: u32, mi: u32) -> DateTime<Utc> {
+        Utc.from_utc_datetime(
+            &NaiveDate::from_ymd_opt(y, mo, d)
+                .unwrap()
+                .and_hms_opt(h, mi, 0)
+                .unwrap(),
+        )
+    }
+    fn near(want: DateTime<Utc>, got: Option<DateTime<Utc>>) {
+        let got = got.unwrap();
+        assert!(
+            (got - want).num_seconds().abs() < 60,
+            "want {} got {}",
+            want,
+            got
+        );
+    }
+
+    #[test]
+    fn test_sun() {
+        let june = NaiveDate::from_ymd_opt(2024, 6, 21).unwrap();
+        let denver = Location {
+            latitude: 39.74,
+            longitude: -104.99,
+        };
+        // 5:32AM and 8:31PM MDT, the sunset is on the next day in UTC.
+        near(utc(2024, 6, 21, 11, 32), denver.sunrise(june));
+        near(utc(2024, 6, 22, 2, 31), denver.sunset(june));
+
+        let sydney = Location {
+            latitude: -33.87,
+            longitude: 151.21,
+        };
+        // 7:00AM and 4:54PM AEST, the sunrise is on the day before in UTC.
+        near(utc(2024, 6, 20, 21, 0), sydney.sunrise(june));
+        near(utc(2024, 6, 21, 6, 54), sydney.sunset(june));
+    }
+    #[test]
+    fn test_sun_polar() {
+        let tromso = Location {
+            latitude: 69.65,
+            longitude: 18.96,
+        };
+        // The midnight sun and the polar night.
+        for date in [(2024, 6, 21), (2024, 12, 21)] {
+            let date = NaiveDate::from_ymd_opt(date.0, date.1, date.2).unwrap();
+            assert_eq!(None, tromso.sunrise(date));
+            assert_eq!(None, tromso.sunset(date));
+        }
+        let january = NaiveDate::from_ymd_opt(2024, 1, 20).unwrap();
+        near(utc(2024, 1, 20, 9, 39), tromso.sunrise(january));
+        near(utc(2024, 1, 20, 12, 10), tromso.sunset(january));
+    }
+}
@@ -1,9 +1,22 @@
 use {
-    anyhow::Result,
+    anyhow::{anyhow, Result},
     async_trait::async_trait,
-    chrono::{DateTime, Local},
-    futures::future::{BoxFuture, FutureExt},
-    std::{convert::TryInto, fmt, sync::Arc, time::Duration},
+    chrono::{DateTime, Local, LocalResult, NaiveDate, NaiveTime, Offset, TimeZone, Timelike, Utc},
+    chrono_tz::Tz,
+    futures::future::{self, BoxFuture, FutureExt},
+    log::Level,
+    std::{
+        any::Any,
+        collections::{BTreeMap, BTreeSet, VecDeque},
+        convert::{TryFrom, TryInto},
+        fmt,
+        panic::AssertUnwindSafe,
+        sync::{
+            atomic::{AtomicUsize, Ordering},
+            Arc, Mutex,
+        },
+        time::Duration,
+    },
     tokio::{
         io::AsyncWriteExt,
         select,
@@ -18,10 +31,205 @@ use {
 
 use tokio::io;
 
-use crate::compiler::{Code, Instruction, TimeOfDay, Value};
+use crate::ast::{Aggregate, Guard, Range, Trend};
+use crate::compiler::{Band, Code, Instruction, TimeOfDay, Value};
+use crate::logging;
+use crate::mqtt_engine::{topic_matches, Sample};
+use crate::sun::Location;
 
 const STACK_SIZE: usize = 512;
 
+/// How long after an at fired it does not fire again, i.e. for a wall clock behind the timer.
+const AT_REFIRE_WINDOW: Duration = Duration::from_secs(60);
+
+tokio::task_local! {
+    /// Identifies the when running in the task, see reader.
+    pub(crate) static READER: usize;
+}
+
+/// Counts the when threads to give each a distinct reader.
+static READERS: AtomicUsize = AtomicUsize::new(0);
+
+/// Returns an identifier of the when calling the engine, distinct for each when thread,
+/// so that an engine can track the values each when received.
+/// Outside of a when there is no reader.
+pub fn reader() -> Option<usize> {
+    READER.try_with(|reader| *reader).ok()
+}
+
+/// How long a when that failed again waits before waiting for the next value,
+/// each further failure doubles the wait up to RESTART_MAX_DELAY.
+const RESTART_DELAY: Duration = Duration::from_millis(100);
+const RESTART_MAX_DELAY: Duration = Duration::from_secs(60);
+
+/// The format used for printed values.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Output {
+    /// Human readable text
+    Text,
+    /// A JSON document per line
+    Json,
+}
+
+/// Formats the value of a publish statement as the payload of its topic.
+pub type Formatter = fn(Value) -> Result<Vec<u8>>;
+
+/// Reads the current local time, for the guards.
+pub type Clock = fn() -> DateTime<Local>;
+
+/// The formatter used unless the VM is given another,
+/// strings are published as is and objects and lists as JSON.
+pub fn format_value(value: Value) -> Result<Vec<u8>> {
+    value.try_into()
+}
+
+/// QuietHours is a window of the day, from start until end, during which sets are dropped
+/// unless they are urgent. The window may cross midnight, i.e. 10:00PM to 6:00AM.
+#[derive(Debug, Clone, Copy)]
+pub struct QuietHours {
+    start: (u32, u32),
+    end: (u32, u32),
+    time_zone: Option<Tz>,
+    now: Option<fn() -> NaiveTime>,
+}
+
+impl QuietHours {
+    /// Creates quiet hours from the hour and minute of its start until those of its end,
+    /// using the local time of day.
+    pub fn new(start: (u32, u32), end: (u32, u32)) -> Self {
+        Self {
+            start,
+            end,
+            time_zone: None,
+            now: None,
+        }
+    }
+    /// Reads the time of day from now instead of the local clock.
+    pub fn with_clock(mut self, now: fn() -> NaiveTime) -> Self {
+        self.now = Some(now);
+        self
+    }
+    /// Reads the time of day in the time zone instead of the local time zone of the host.
+    pub fn with_time_zone(mut self, time_zone: Tz) -> Self {
+        self.time_zone = Some(time_zone);
+        self
+    }
+    /// Reports whether it is quiet hours now.
+    pub fn active(&self) -> bool {
+        let now = match (self.now, self.time_zone) {
+            (Some(now), _) => now(),
+            (None, Some(tz)) => Utc::now().with_timezone(&tz).time(),
+            (None, None) => Local::now().time(),
+        };
+        let now = (now.hour(), now.minute());
+        if self.start <= self.end {
+            self.start <= now && now < self.end
+        } else {
+            // The window crosses midnight.
+            self.start <= now || now < self.end
+        }
+    }
+}
+
+/// The error returned when the condition of an assert statement is false.
+#[derive(Debug, Clone, PartialEq)]
+pub struct AssertionFailed {
+    /// The byte offset of the assert statement in the source.
+    pub offset: usize,
+    /// The file and line of the assert statement when the program was loaded from a file,
+    /// which may be an included file.
+    pub location: Option<String>,
+}
+
+impl fmt::Display for AssertionFailed {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "assertion failed")
+    }
+}
+
+impl std::error::Error for AssertionFailed {}
+
+/// The error returned by an engine for reads of values it is still receiving after connecting,
+/// i.e. finds and histories, which would act on incomplete values.
+/// A when that is not ready waits for the next value instead of stopping.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct NotReady {
+    /// How long until the engine is ready.
+    pub remaining: Duration,
+}
+
+impl fmt::Display for NotReady {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(
+            f,
+            "not ready, receiving retained values for another {:?}",
+            self.remaining
+        )
+    }
+}
+
+impl std::error::Error for NotReady {}
+
+/// The error of a get that received no value within its timeout and has no default,
+/// see within.
+#[derive(Debug, Clone, PartialEq)]
+pub struct GetTimeout {
+    pub path: String,
+    pub timeout: Duration,
+}
+
+impl fmt::Display for GetTimeout {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "no value for <{}> within {:?}", self.path, self.timeout)
+    }
+}
+
+impl std::error::Error for GetTimeout {}
+
+/// The error returned by an engine for requests once it is closed,
+/// including the gets that were waiting when it closed.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Closed;
+
+impl fmt::Display for Closed {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "engine is closed")
+    }
+}
+
+impl std::error::Error for Closed {}
+
+/// The error returned by an engine for requests it cannot answer,
+/// i.e. an engine without retained values cannot publish or clear them.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Unsupported {
+    /// The name of the request, i.e. publish.
+    pub request: &'static str,
+}
+
+impl fmt::Display for Unsupported {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{} is not supported by the engine", self.request)
+    }
+}
+
+impl std::error::Error for Unsupported {}
+
+/// The error returned by a strict engine for a set of a wildcard path
+/// that matches no device, i.e. a typo in the toplevel.
+#[derive(Debug, Clone, PartialEq)]
+pub struct NoMatch {
+    pub path: String,
+}
+
+impl fmt::Display for NoMatch {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "set of wildcard path {} matched no device", self.path)
+    }
+}
+
+impl std::error::Error for NoMatch {}
+
 #[async_trait]
 pub trait Engine: Clone + Send + Sync {
     async fn print(&self, msg: &str) -> Result<()> {
@@ -36,20 +244,123 @@ pub trait Engine: Clone + Send + Sync {
         Ok(())
     }
     async fn get(&self, path: &str) -> Result<Vec<u8>>;
+    /// Waits for the next value of the path that was published after subscribing,
+    /// ignoring the retained values the broker sends when subscribing.
+    /// Engines that do not know whether a value was retained treat every value as live.
+    async fn get_live(&self, path: &str) -> Result<Vec<u8>> {
+        self.get(path).await
+    }
+    /// Waits for the next value of the path like get or get_live,
+    /// along with the topic it was published to which differs from a path with wildcards.
+    /// Engines that do not know the topic return the path.
+    async fn get_topic(&self, path: &str, live: bool) -> Result<(String, Vec<u8>)> {
+        let value = if live {
+            self.get_live(path).await?
+        } else {
+            self.get(path).await?
+        };
+        Ok((path.to_string(), value))
+    }
+    /// Subscribes to a path a when is about to get, so that the when does not miss
+    /// a value published by the statements after it before its get is waiting.
+    /// Engines that deliver every value published once a get waits need not subscribe.
+    async fn subscribe(&self, _path: &str) -> Result<()> {
+        Ok(())
+    }
     async fn set(&self, path: &str, value: Vec<u8>) -> Result<()>;
+    /// Publishes the value as the retained status of the path.
+    /// Engines without retained values return Unsupported.
+    async fn publish(&self, _path: &str, _value: Vec<u8>) -> Result<()> {
+        Err(Unsupported { request: "publish" }.into())
+    }
+    /// Clears any value retained for the path.
+    /// Engines without retained values return Unsupported.
+    async fn clear(&self, _path: &str) -> Result<()> {
+        Err(Unsupported { request: "clear" }.into())
+    }
+    /// Waits for the next value of any path matching the wildcard path
+    /// and then returns the current values of every matching path.
+    /// Engines that do not keep the values of the paths return Unsupported.
+    async fn find(&self, _path: &str) -> Result<Vec<Vec<u8>>> {
+        Err(Unsupported { request: "find" }.into())
+    }
+    /// Returns the recent values of the path, oldest first.
+    /// Engines that do not keep the values of the paths return Unsupported.
+    async fn history(&self, _path: &str) -> Result<Vec<Sample>> {
+        Err(Unsupported { request: "history" }.into())
+    }
 }
 
 struct Thread<E: Engine> {
     cancel_rx: broadcast::Receiver<()>,
+    // Stops a when thread, without affecting the other threads of its scene.
+    stop_rx: Option<broadcast::Receiver<()>>,
+    // The scene context of the caller of each scene, restored once the scene returns,
+    // along with the depth of the call stack within the scene.
+    callers: Vec<(usize, broadcast::Sender<()>, broadcast::Receiver<()>)>,
+    // The instruction and stack pointers and the depth of the call stack at the start of a when,
+    // restored to wait for the next value when an iteration of the when fails.
+    restart: Option<(usize, usize, usize)>,
+    // How many iterations of the when failed in a row, and until when it backs off.
+    failures: u32,
+    retry_at: Option<time::Instant>,
     ctx: ThreadContext<E>,
 }
+// The state shared by all threads is only locked between awaits, never across one,
+// so a when or at firing never waits for another thread to finish a step.
 struct ThreadContext<E: Engine> {
     engine: E,
     code: Arc<Code>,
+    output: Output,
+    formatter: Formatter,
+    quiet: Option<QuietHours>,
+    clock: Clock,
+    // The time zone of the ats and guards, the local time zone of the host without one.
+    time_zone: Option<Tz>,
+    // Where the home is, for the ats on the sun.
+    location: Option<Location>,
     ip: usize,
     stack: [Value; STACK_SIZE],
     stack_ptr: usize, // points to the next free space
     call_stack: Vec<usize>,
+    deadline: Option<time::Instant>,
+    // When a debounced when runs its statement along with the instruction and stack pointers
+    // of the statement, the when waits for the next value until then.
+    debounce: Option<(time::Instant, usize, usize)>,
+    // The last time the when or at fired.
+    last_fired: Option<time::Instant>,
+    // The trigger of the last time the when fired, used to detect changes.
+    last_trigger: Option<Value>,
+    // The topic and value of the most recent get and of the get that triggered the when.
+    last_get: Option<(String, Value)>,
+    trigger: Option<(String, Value)>,
+    // The last value read by the condition of the when and the value it read before, for $prev.
+    seen: Option<Value>,
+    previous: Option<Value>,
+    // How many more times an at that repeats a number of times runs.
+    remaining: Option<i64>,
+    breaker: Breaker,
+    // Whether a when with hysteresis may fire, it is cleared when the when fires
+    // until the value moves back past the band.
+    armed: bool,
+    // The latest value of each path of an all-of when, answering its gets.
+    latest: BTreeMap<String, Value>,
+    // The names of the disabled scenes, shared by all threads.
+    disabled: Arc<Mutex<BTreeSet<String>>>,
+    // The scenes started and not yet stopped and the sender that stops them,
+    // shared by all threads.
+    scenes: Arc<Mutex<BTreeMap<String, broadcast::Sender<()>>>>,
+    max_scenes: Option<usize>,
+    // The context of the scene being started.
+    scene_tx: Option<broadcast::Sender<()>>,
+    // The paths read by the next spawned when.
+    watching: Vec<String>,
+    // The paths read by each when and the sender that stops it, shared by all threads.
+    whens: Arc<Mutex<Vec<(String, broadcast::Sender<()>)>>>,
+    // The time of the next spawned at.
+    scheduling: Option<TimeOfDay>,
+    // The time of each at and the sender that stops it, shared by all threads.
+    ats: Arc<Mutex<Vec<(TimeOfDay, broadcast::Sender<()>)>>>,
     sender: Sender<JoinHandle<Result<()>>>,
     cancel_tx: broadcast::Sender<()>,
 }
@@ -65,7 +376,7 @@ impl<E: Engine> fmt::Debug for Thread<E> {
 
 enum StepResult {
     Continue,
-    SceneContext,
+    SceneContext(broadcast::Sender<()>),
     Break,
 }
 
@@ -73,19 +384,57 @@ impl<E: Engine + 'static> Thread<E> {
     fn new(
         engine: E,
         code: Arc<Code>,
+        output: Output,
+        formatter: Formatter,
+        quiet: Option<QuietHours>,
+        clock: Clock,
+        time_zone: Option<Tz>,
+        location: Option<Location>,
         ip: usize,
+        max_scenes: Option<usize>,
         sender: Sender<JoinHandle<Result<()>>>,
     ) -> Thread<E> {
         let (cancel_tx, cancel_rx) = broadcast::channel(1);
         Thread {
             cancel_rx,
+            stop_rx: None,
+            callers: Vec::new(),
+            restart: None,
+            failures: 0,
+            retry_at: None,
             ctx: ThreadContext {
                 engine,
                 code,
+                output,
+                formatter,
+                quiet,
+                clock,
+                time_zone,
+                location,
                 ip,
                 stack: unsafe { std::mem::zeroed() },
                 stack_ptr: 0,
                 call_stack: Vec::new(),
+                deadline: None,
+                debounce: None,
+                last_fired: None,
+                last_trigger: None,
+                last_get: None,
+                trigger: None,
+                seen: None,
+                previous: None,
+                remaining: None,
+                breaker: Breaker::default(),
+                armed: true,
+                latest: BTreeMap::new(),
+                disabled: Arc::new(Mutex::new(BTreeSet::new())),
+                scenes: Arc::new(Mutex::new(BTreeMap::new())),
+                max_scenes,
+                scene_tx: None,
+                watching: Vec::new(),
+                whens: Arc::new(Mutex::new(Vec::new())),
+                scheduling: None,
+                ats: Arc::new(Mutex::new(Vec::new())),
                 sender,
                 cancel_tx,
             },
@@ -98,27 +447,129 @@ impl<E: Engine + 'static> Thread<E> {
     }
     async fn _run(mut self, mut shutdown: broadcast::Receiver<()>) -> Result<()> {
         loop {
+            let deadline = self.ctx.deadline;
+            let debounce = self.ctx.debounce.map(|(at, _, _)| at);
+            let retry_at = self.retry_at;
             select! {
                 // TODO: Restructure so that we do not have to pre-emptively resubsribe for each
                 // step
-                step = self.ctx.step(shutdown.resubscribe()) => {
-                    match step? {
+                step = AssertUnwindSafe(self.ctx.step(shutdown.resubscribe())).catch_unwind(), if retry_at.is_none() => {
+                    let step = step.unwrap_or_else(|panic| Err(anyhow!("{}", panic_message(&panic))));
+                    let step = match (step, self.restart) {
+                        // A when that fails keeps running, it waits for the next value
+                        // so that one bad value does not stop it.
+                        // Once the engine is closed there is no next value and the when stops.
+                        (Err(err), Some((ip, stack_ptr, depth))) if !err.is::<Closed>() => {
+                            if err.is::<NotReady>() {
+                                log::debug!("when restarted: {}", err);
+                            } else {
+                                logging::event(Level::Error, "when", &[("error", &err)]);
+                                // A when failing on every value, i.e. setting a path of a broker
+                                // that is gone, backs off instead of retrying as fast as it can.
+                                self.failures += 1;
+                                self.retry_at = restart_delay(self.failures)
+                                    .map(|delay| time::Instant::now() + delay);
+                            }
+                            self.ctx.ip = ip;
+                            self.ctx.stack_ptr = stack_ptr;
+                            // Leave the scenes the iteration started, below the context
+                            // of their callers is restored so stopping them does not stop the when.
+                            self.ctx.call_stack.truncate(depth);
+                            self.ctx.deadline = None;
+                            self.ctx.debounce = None;
+                            StepResult::Continue
+                        }
+                        // An iteration that looped back to the start succeeded.
+                        (Ok(step), Some((ip, _, _))) if self.ctx.ip == ip => {
+                            self.failures = 0;
+                            step
+                        }
+                        (step, _) => step?,
+                    };
+                    match step {
                         StepResult::Continue => {}
-                        StepResult::SceneContext => {
-                            let (cancel_tx, cancel_rx) = broadcast::channel(1);
-                            self.cancel_rx = cancel_rx;
-                            self.ctx.cancel_tx = cancel_tx;
+                        StepResult::SceneContext(cancel_tx) => {
+                            let cancel_rx = cancel_tx.subscribe();
+                            self.callers.push((
+                                self.ctx.call_stack.len(),
+                                std::mem::replace(&mut self.ctx.cancel_tx, cancel_tx),
+                                std::mem::replace(&mut self.cancel_rx, cancel_rx),
+                            ));
                         },
                         StepResult::Break => break,
                     }
                 },
                 _ = shutdown.recv() => break,
                 _ = self.cancel_rx.recv() => break,
+                _ = stopped(&mut self.stop_rx) => break,
+                _ = expired(deadline) => {
+                    log::debug!("thread deadline exceeded");
+                    break
+                },
+                _ = expired(retry_at) => self.retry_at = None,
+                // Stop waiting for the next value once the debounce is over and run the statement.
+                _ = expired(debounce) => {
+                    let (_, ip, stack_ptr) = self.ctx.debounce.take().unwrap();
+                    self.ctx.ip = ip;
+                    self.ctx.stack_ptr = stack_ptr;
+                },
+            }
+            // Restore the context of the caller once a scene returns,
+            // so that stopping the scene does not stop its caller.
+            while let Some((depth, _, _)) = self.callers.last() {
+                if self.ctx.call_stack.len() >= *depth {
+                    break;
+                }
+                let (_, cancel_tx, cancel_rx) = self.callers.pop().unwrap();
+                self.ctx.cancel_tx = cancel_tx;
+                self.cancel_rx = cancel_rx;
             }
         }
         Ok(())
     }
 }
+
+/// Returns how long a when that failed the number of times in a row waits before restarting,
+/// the first failure restarts immediately so that one bad value does not delay the next.
+fn restart_delay(failures: u32) -> Option<Duration> {
+    match failures {
+        0 | 1 => None,
+        n => Some(
+            RESTART_DELAY
+                .saturating_mul(2u32.saturating_pow(n - 2))
+                .min(RESTART_MAX_DELAY),
+        ),
+    }
+}
+
+/// Returns the message of a panic, which is either a &str or a String.
+fn panic_message(panic: &Box<dyn Any + Send>) -> String {
+    if let Some(msg) = panic.downcast_ref::<&str>() {
+        msg.to_string()
+    } else if let Some(msg) = panic.downcast_ref::<String>() {
+        msg.clone()
+    } else {
+        "thread panicked".to_string()
+    }
+}
+
+/// Completes once the when is stopped, never completes for other threads.
+async fn stopped(stop_rx: &mut Option<broadcast::Receiver<()>>) {
+    match stop_rx {
+        Some(stop_rx) => {
+            let _ = stop_rx.recv().await;
+        }
+        None => future::pending().await,
+    }
+}
+
+/// Completes once the deadline has passed, never completes without a deadline.
+async fn expired(deadline: Option<time::Instant>) {
+    match deadline {
+        Some(deadline) => time::sleep_until(deadline).await,
+        None => future::pending().await,
+    }
+}
 impl<E: Engine + 'static> ThreadContext<E> {
     fn spawn(&self, ip: usize) -> Thread<E> {
         let cancel_tx = self.cancel_tx.clone();
@@ -127,14 +578,46 @@ impl<E: Engine + 'static> ThreadContext<E> {
             ctx: ThreadContext {
                 engine: self.engine.clone(),
                 code: self.code.clone(),
+                output: self.output,
+                formatter: self.formatter,
+                quiet: self.quiet,
+                clock: self.clock,
+                time_zone: self.time_zone,
+                location: self.location,
                 ip,
                 stack: self.stack.clone(),
                 stack_ptr: self.stack_ptr,
                 call_stack: Vec::new(),
+                deadline: None,
+                debounce: None,
+                last_fired: None,
+                last_trigger: None,
+                last_get: None,
+                // Threads spawned within a when body may still refer to $value
+                trigger: self.trigger.clone(),
+                seen: None,
+                previous: self.previous.clone(),
+                remaining: None,
+                breaker: Breaker::default(),
+                armed: true,
+                latest: BTreeMap::new(),
+                disabled: self.disabled.clone(),
+                scenes: self.scenes.clone(),
+                max_scenes: self.max_scenes,
+                scene_tx: None,
+                watching: Vec::new(),
+                whens: self.whens.clone(),
+                scheduling: None,
+                ats: self.ats.clone(),
                 sender: self.sender.clone(),
                 cancel_tx,
             },
             cancel_rx,
+            stop_rx: None,
+            callers: Vec::new(),
+            restart: None,
+            failures: 0,
+            retry_at: None,
         }
     }
     pub fn pick(&mut self, depth: usize) {
@@ -146,6 +629,33 @@ impl<E: Engine + 'static> ThreadContext<E> {
         self.stack_ptr += 1; // ignoring the potential stack overflow
     }
 
+    /// Waits for the next value of the path, keeping it as the value that may trigger a when.
+    async fn get(&mut self, path: String, live: bool) -> Result<Value> {
+        if let Some(value) = self.latest.get(&path) {
+            return Ok(value.clone());
+        }
+        let (topic, value) = match self.engine.get_topic(path.as_str(), live).await {
+            Ok(value) => value,
+            Err(err) => {
+                logging::event(Level::Error, "get", &[("path", &path), ("error", &err)]);
+                return Err(err);
+            }
+        };
+        let value: Value = value[..].try_into()?;
+        self.last_get = Some((topic, value.clone()));
+        Ok(value)
+    }
+
+    /// Stops the threads of the scene, reporting whether it was running.
+    fn stop_scene(&self, scene: &str) -> bool {
+        let cancel_tx = self.scenes.lock().unwrap().remove(scene);
+        if let Some(cancel_tx) = &cancel_tx {
+            let count = cancel_tx.send(()).unwrap_or_default();
+            log::debug!("stopped {} scene threads", count);
+        }
+        cancel_tx.is_some()
+    }
+
     pub fn pop(&mut self) -> Value {
         // ignoring the potential of stack underflow
         // cloning rather than mem::replace for easier testing
@@ -164,7 +674,11 @@ impl<E: Engine + 'static> ThreadContext<E> {
                 self.push(self.code.constants[const_idx as usize].clone());
             }
             Instruction::Print => {
-                let msg = format!("{}", self.pop());
+                let v = self.pop();
+                let msg = match self.output {
+                    Output::Text => format!("{}", v),
+                    Output::Json => serde_json::to_string(&v)?,
+                };
                 self.engine.print(msg.as_str()).await?;
             }
             Instruction::Pick(depth) => {
@@ -180,10 +694,46 @@ impl<E: Engine + 'static> ThreadContext<E> {
                 self.push(b);
             }
             Instruction::Spawn(ip) => {
-                let new_thread = self.spawn(self.ip);
-                let join_handle = tokio::spawn(new_thread.run(shutdown));
+                // Subscribe before the statements after the when run, i.e. a set it reacts to,
+                // a failure is reported again by the get of the when.
+                for path in &self.watching {
+                    if let Err(err) = self.engine.subscribe(path).await {
+                        log::warn!("subscribing to {} failed: {}", path, err);
+                    }
+                }
+                let mut new_thread = self.spawn(self.ip);
+                if !self.watching.is_empty() {
+                    let (stop_tx, stop_rx) = broadcast::channel(1);
+                    new_thread.stop_rx = Some(stop_rx);
+                    new_thread.restart = Some((
+                        new_thread.ctx.ip,
+                        new_thread.ctx.stack_ptr,
+                        new_thread.ctx.call_stack.len(),
+                    ));
+                    let mut whens = self.whens.lock().unwrap();
+                    for path in self.watching.drain(..) {
+                        whens.push((path, stop_tx.clone()));
+                    }
+                } else if let Some(t) = self.scheduling.take() {
+                    let (stop_tx, stop_rx) = broadcast::channel(1);
+                    new_thread.stop_rx = Some(stop_rx);
+                    self.ats.lock().unwrap().push((t, stop_tx));
+                }
+                let join_handle = match new_thread.restart {
+                    Some(_) => {
+                        let reader = READERS.fetch_add(1, Ordering::SeqCst);
+                        tokio::spawn(READER.scope(reader, new_thread.run(shutdown)))
+                    }
+                    None => tokio::spawn(new_thread.run(shutdown)),
+                };
                 // Track every spawned thread, so we can join on them
-                self.sender.send(join_handle).await?;
+                if let Err(mpsc::error::SendError(join_handle)) =
+                    self.sender.send(join_handle).await
+                {
+                    // The VM is shutting down and no longer tracks threads.
+                    join_handle.abort();
+                    return Err(anyhow!("cannot spawn a thread while shutting down"));
+                }
 
                 // update local ip to jump location
                 self.ip = ip;
@@ -198,15 +748,89 @@ impl<E: Engine + 'static> ThreadContext<E> {
             }
             Instruction::Get => {
                 let path: String = self.pop().try_into()?;
-                // Creature future and queue it for the executor
-                let value = self.engine.get(path.as_str()).await?;
-                self.push(value[..].try_into()?);
+                let value = self.get(path, false).await?;
+                self.push(value);
+            }
+            Instruction::GetWithin(has_default) => {
+                let default = if has_default { Some(self.pop()) } else { None };
+                let timeout = match self.pop() {
+                    Value::Duration(d) => d,
+                    v => return Err(anyhow!("within must be a duration: {}", v)),
+                };
+                let path: String = self.pop().try_into()?;
+                let value = match time::timeout(timeout, self.get(path.clone(), false)).await {
+                    Ok(value) => value?,
+                    Err(_) => default.ok_or(GetTimeout { path, timeout })?,
+                };
+                self.push(value);
+            }
+            Instruction::GetLive => {
+                let path: String = self.pop().try_into()?;
+                let value = self.get(path, true).await?;
+                self.push(value);
+            }
+            Instruction::Aggregate(agg) => {
+                let path: String = self.pop().try_into()?;
+                let values = self.engine.find(path.as_str()).await?;
+                self.push(aggregate(agg, &path, values)?);
+            }
+            Instruction::Triggered => {
+                if let Some((path, value)) = &self.last_get {
+                    logging::event(Level::Info, "when", &[("path", path), ("value", value)]);
+                }
+                self.trigger = self.last_get.clone();
+            }
+            Instruction::Trigger => {
+                let (_, value) = self
+                    .trigger
+                    .clone()
+                    .ok_or_else(|| anyhow!("$value is only defined within a when"))?;
+                self.push(value);
+            }
+            Instruction::Seen => {
+                if let Some((_, value)) = &self.last_get {
+                    self.previous = self.seen.replace(value.clone());
+                }
+            }
+            Instruction::Previous => {
+                if self.trigger.is_none() {
+                    return Err(anyhow!("$prev is only defined within a when"));
+                }
+                // The first value has no previous value.
+                let previous = self.previous.clone().unwrap_or(Value::Str(String::new()));
+                self.push(previous);
+            }
+            Instruction::TriggerPath => {
+                let (path, _) = self
+                    .trigger
+                    .clone()
+                    .ok_or_else(|| anyhow!("$path is only defined within a when"))?;
+                self.push(Value::Str(path));
             }
-            Instruction::Set => {
+            Instruction::Set(urgent) => {
                 let value: Vec<u8> = self.pop().try_into()?;
                 let path: String = self.pop().try_into()?;
+                if !urgent && self.quiet.map_or(false, |quiet| quiet.active()) {
+                    logging::event(Level::Info, "quiet", &[("path", &path)]);
+                    return Ok(StepResult::Continue);
+                }
                 // Creature future and queue it for the executor
-                self.engine.set(path.as_str(), value).await?;
+                if let Err(err) = self.engine.set(path.as_str(), value).await {
+                    logging::event(Level::Error, "set", &[("path", &path), ("error", &err)]);
+                    return Err(err);
+                }
+            }
+            Instruction::Publish => {
+                let value = (self.formatter)(self.pop())?;
+                let path: String = self.pop().try_into()?;
+                if let Err(err) = self.engine.publish(path.as_str(), value).await {
+                    logging::event(Level::Error, "publish", &[("path", &path), ("error", &err)]);
+                    return Err(err);
+                }
+            }
+            Instruction::Clear => {
+                let path: String = self.pop().try_into()?;
+                self.engine.clear(path.as_str()).await?;
             }
             Instruction::Wait => {
                 let v = self.pop();
@@ -214,11 +838,21 @@ impl<E: Engine + 'static> ThreadContext<E> {
                     Value::Duration(d) => {
                         self.engine.wait(d).await?;
                     }
-                    _ => {
-                        panic!("wait arg must be a duration")
+                    v => return Err(anyhow!("wait must be a duration: {}", v)),
+                };
+            }
+            Instruction::Deadline => {
+                let v = self.pop();
+                match v {
+                    Value::Duration(d) => {
+                        self.deadline = Some(time::Instant::now() + d);
                     }
+                    v => return Err(anyhow!("wait until must be for a duration: {}", v)),
                 };
             }
+            Instruction::ClearDeadline => {
+                self.deadline = None;
+            }
             Instruction::Call => {
                 self.call_stack.push(self.ip);
                 self.ip = match self.pop() {
@@ -230,39 +864,289 @@ impl<E: Engine + 'static> ThreadContext<E> {
                 self.ip = self.call_stack.pop().unwrap();
             }
             Instruction::SceneContext => {
-                return Ok(StepResult::SceneContext);
+                let cancel_tx = self
+                    .scene_tx
+                    .take()
+                    .unwrap_or_else(|| broadcast::channel(1).0);
+                return Ok(StepResult::SceneContext(cancel_tx));
+            }
+            Instruction::Watch => {
+                let path: String = self.pop().try_into()?;
+                self.watching.push(path);
+            }
+            Instruction::StopWhen => {
+                let filter: String = self.pop().try_into()?;
+                let mut count = 0;
+                // Whens that already stopped have no receiver and are forgotten as well.
+                self.whens.lock().unwrap().retain(|(path, stop_tx)| {
+                    if topic_matches(&filter, path) {
+                        let _ = stop_tx.send(());
+                        count += 1;
+                        false
+                    } else {
+                        stop_tx.receiver_count() > 0
+                    }
+                });
+                log::debug!("stopped whens of {} paths", count);
+            }
+            Instruction::Guard(guard) => {
+                let passed = match self.pop() {
+                    Value::Time(TimeOfDay::HM(h, m)) => match self.time_zone {
+                        Some(tz) => passed(h, m, (self.clock)().with_timezone(&tz)),
+                        None => passed(h, m, (self.clock)()),
+                    },
+                    v => return Err(anyhow!("{:?} must be a time of day", v)),
+                };
+                self.push(Value::Bool(passed == (guard == Guard::After)))
+            }
+            Instruction::Schedule => {
+                if let Value::Time(t) = self.pop() {
+                    self.scheduling = Some(t);
+                }
+            }
+            Instruction::Repeat(end) => {
+                let count = self.pop();
+                let remaining = match self.remaining {
+                    Some(remaining) => remaining,
+                    None => match count {
+                        Value::Integer(count) => count,
+                        _ => return Err(anyhow!("repeat count must be an integer")),
+                    },
+                };
+                if remaining <= 0 {
+                    self.ip = end;
+                } else {
+                    self.remaining = Some(remaining - 1);
+                }
+            }
+            Instruction::StopAt => {
+                let time = self.pop();
+                let mut count = 0;
+                // Ats that already stopped have no receiver and are forgotten as well.
+                self.ats.lock().unwrap().retain(|(t, stop_tx)| {
+                    if matches!(&time, Value::Time(time) if time == t) {
+                        let _ = stop_tx.send(());
+                        count += 1;
+                        false
+                    } else {
+                        stop_tx.receiver_count() > 0
+                    }
+                });
+                log::debug!("stopped {} ats", count);
             }
             Instruction::Stop => {
-                let count = self.cancel_tx.send(()).unwrap();
-                log::debug!("stopped {} scene threads", count);
+                let scene: String = self.pop().try_into()?;
+                self.stop_scene(&scene);
+            }
+            Instruction::Redefine(ip) => {
+                let scene: String = self.pop().try_into()?;
+                if !self.stop_scene(&scene) {
+                    self.ip = ip;
+                }
             }
             Instruction::At => {
                 let v = self.pop();
                 match v {
                     Value::Time(t) => {
-                        let then: DateTime<Local> = match t {
-                            TimeOfDay::Sunrise => todo!(),
-                            TimeOfDay::Sunset => todo!(),
-                            TimeOfDay::HM(h, m) => Local::today().and_hms(h, m, 0),
+                        let fired_recently = self
+                            .last_fired
+                            .map_or(false, |last| last.elapsed() < AT_REFIRE_WINDOW);
+                        let next = match t {
+                            TimeOfDay::Sunrise | TimeOfDay::Sunset => {
+                                // Without a location there is no time to wait for,
+                                // so the at stops instead of guessing one.
+                                let location = self.location.ok_or_else(|| {
+                                    anyhow!("at {} needs the location of the home", t)
+                                })?;
+                                let event = |date| match t {
+                                    TimeOfDay::Sunrise => location.sunrise(date),
+                                    _ => location.sunset(date),
+                                };
+                                let next = match self.time_zone {
+                                    Some(tz) => until_sun(
+                                        Utc::now().with_timezone(&tz),
+                                        fired_recently,
+                                        event,
+                                    ),
+                                    None => until_sun(Local::now(), fired_recently, event),
+                                };
+                                match next {
+                                    Some((_, skipped)) if skipped > 0 => logging::event(
+                                        Level::Warn,
+                                        "at",
+                                        &[("time", &t), ("days_without", &skipped)],
+                                    ),
+                                    _ => {}
+                                }
+                                next.map(|(d, _)| d)
+                            }
+                            TimeOfDay::HM(h, m) => Some(match self.time_zone {
+                                Some(tz) => {
+                                    until_next(h, m, Utc::now().with_timezone(&tz), fired_recently)
+                                }
+                                None => until_next(h, m, Local::now(), fired_recently),
+                            }),
+                        };
+                        let d = match next {
+                            Some(d) if !d.is_zero() => d,
+                            // Without a next time, i.e. a sun that does not rise for a year,
+                            // or with no time to wait the at would fire over and over,
+                            // so it ends like an at that repeated as many times as it should.
+                            _ => {
+                                logging::event(
+                                    Level::Warn,
+                                    "at",
+                                    &[
+                                        ("time", &t),
+                                        ("error", &"there is no next time, removing the at"),
+                                    ],
+                                );
+                                return Ok(StepResult::Break);
+                            }
                         };
-                        let now: DateTime<Local> = Local::now();
-                        let mut diff = then.timestamp() - now.timestamp();
-                        if diff <= 0 {
-                            // If the time has passed today wait for the next one.
-                            diff += 24 * 60 * 60;
-                        }
-                        let d = Duration::from_secs(diff as u64);
                         self.engine.wait(d).await?;
+                        self.last_fired = Some(time::Instant::now());
+                        logging::event(Level::Info, "at", &[("time", &t)]);
                     }
-                    _ => {
-                        panic!("at arg must be a time")
-                    }
+                    v => return Err(anyhow!("at must be a time of day: {}", v)),
                 };
             }
             Instruction::Equal => {
                 let rhs = self.pop();
                 let lhs = self.pop();
-                self.push(Value::Bool(rhs == lhs))
+                self.push(Value::Bool(lhs.equals(&rhs)))
+            }
+            Instruction::Greater => {
+                let rhs = self.pop();
+                let lhs = self.pop();
+                let b = matches!((lhs.number(), rhs.number()), (Some(l), Some(r)) if l > r);
+                self.push(Value::Bool(b))
+            }
+            Instruction::Less => {
+                let rhs = self.pop();
+                let lhs = self.pop();
+                let b = matches!((lhs.number(), rhs.number()), (Some(l), Some(r)) if l < r);
+                self.push(Value::Bool(b))
+            }
+            Instruction::And => {
+                let rhs = self.pop();
+                let lhs = self.pop();
+                // Like a condition, any value but false is true.
+                let b = !matches!(lhs, Value::Bool(false)) && !matches!(rhs, Value::Bool(false));
+                self.push(Value::Bool(b))
+            }
+            Instruction::Latest(n, live) => {
+                let mut paths = Vec::with_capacity(n);
+                for _ in 0..n {
+                    let path: String = self.pop().try_into()?;
+                    paths.push(path);
+                }
+                paths.reverse();
+                if paths.iter().any(|path| !self.latest.contains_key(path)) {
+                    // The condition needs a value of every path.
+                    for path in paths {
+                        if !self.latest.contains_key(&path) {
+                            let value = self.get(path.clone(), live).await?;
+                            self.latest.insert(path, value);
+                        }
+                    }
+                } else {
+                    let gets = paths
+                        .iter()
+                        .map(|path| self.engine.get_topic(path.as_str(), live));
+                    let (result, i, rest) = future::select_all(gets).await;
+                    drop(rest);
+                    let (topic, value) = result?;
+                    let value: Value = value[..].try_into()?;
+                    self.last_get = Some((topic, value.clone()));
+                    self.latest.insert(paths[i].clone(), value);
+                }
+            }
+            Instruction::Edge(ip) => {
+                if let Value::Bool(false) = self.pop() {
+                    self.armed = true;
+                    self.ip = ip;
+                } else if self.armed {
+                    self.armed = false;
+                } else {
+                    self.ip = ip;
+                }
+            }
+            Instruction::Hysteresis(ip, band) => {
+                let mut number = |name: &str| {
+                    self.pop()
+                        .number()
+                        .ok_or_else(|| anyhow!("hysteresis {} must be a number", name))
+                };
+                let width = number("width")?;
+                let (lo, hi) = match band {
+                    Band::Above | Band::Below => {
+                        let t = number("threshold")?;
+                        (t, t)
+                    }
+                    Band::Inside | Band::Outside => {
+                        let hi = number("threshold")?;
+                        (number("threshold")?, hi)
+                    }
+                };
+                let fired = matches!(self.pop(), Value::Bool(true));
+                if fired && self.armed {
+                    self.armed = false;
+                } else {
+                    let v = self.trigger.as_ref().and_then(|(_, v)| v.number());
+                    if let (false, Some(v)) = (fired, v) {
+                        let past = match band {
+                            Band::Above => v < lo - width,
+                            Band::Below => v > hi + width,
+                            Band::Inside => v < lo - width || hi + width < v,
+                            Band::Outside => lo + width < v && v < hi - width,
+                        };
+                        if past {
+                            self.armed = true;
+                        }
+                    }
+                    self.ip = ip;
+                }
+            }
+            Instruction::Range(r) => {
+                let hi = self.pop();
+                let lo = self.pop();
+                let v = self.pop();
+                let (lo, hi) = match (lo.number(), hi.number()) {
+                    (Some(lo), Some(hi)) => (lo, hi),
+                    _ => return Err(anyhow!("range bounds must be numbers: {}..{}", lo, hi)),
+                };
+                // Values that are not numbers are neither inside nor outside the range.
+                let b = match v.number() {
+                    Some(v) if r == Range::Inside => lo <= v && v <= hi,
+                    Some(v) => v < lo || hi < v,
+                    None => false,
+                };
+                self.push(Value::Bool(b))
+            }
+            Instruction::Trend(t) => {
+                let path: String = self.pop().try_into()?;
+                self.get(path.clone(), false).await?;
+                let samples = self.engine.history(path.as_str()).await?;
+                self.push(Value::Bool(trend(t, &samples, None)))
+            }
+            Instruction::Change(t) => {
+                let window = self.pop();
+                let by = self.pop();
+                let path: String = self.pop().try_into()?;
+                let change = match (by.number(), window) {
+                    (Some(by), Value::Duration(window)) => (by, window),
+                    (_, window) => {
+                        return Err(anyhow!(
+                            "change must be by a number in a duration: by {} in {}",
+                            by,
+                            window
+                        ))
+                    }
+                };
+                self.get(path.clone(), false).await?;
+                let samples = self.engine.history(path.as_str()).await?;
+                self.push(Value::Bool(trend(t, &samples, Some(change))))
             }
             Instruction::JmpNot(ip) => {
                 let v = self.pop();
@@ -274,23 +1158,141 @@ impl<E: Engine + 'static> ThreadContext<E> {
                         self.ip = ip;
                     }
                     _ => {
-                        panic!("value must be a bool")
+                        // Any other value is present and so true,
+                        // i.e. when <path> fires for every value of the path.
                     }
                 }
             }
-            Instruction::Index => {
-                if let Value::Str(prop) = self.pop() {
-                    if let Value::Object(props) = self.pop() {
-                        if let Some(v) = props.get(&prop) {
-                            self.push(v.to_owned());
-                        } else {
-                            panic!("object does not have property")
-                        }
-                    } else {
-                        panic!("cannot index into non object values")
+            Instruction::Assert(offset, ref location) => {
+                let location = location.clone();
+                if let Value::Bool(false) = self.pop() {
+                    return Err(AssertionFailed { offset, location }.into());
+                }
+            }
+            Instruction::Enable => {
+                let scene: String = self.pop().try_into()?;
+                self.disabled.lock().unwrap().remove(&scene);
+            }
+            Instruction::Disable => {
+                let scene: String = self.pop().try_into()?;
+                self.disabled.lock().unwrap().insert(scene);
+            }
+            Instruction::Disabled(ip) => {
+                let scene: String = self.pop().try_into()?;
+                if self.disabled.lock().unwrap().contains(&scene) {
+                    log::debug!("scene {} is disabled", scene);
+                    self.ip = ip;
+                    return Ok(StepResult::Continue);
+                }
+                // Starting a running scene again does not take another slot,
+                // its threads share the context of the running scene.
+                let mut scenes = self.scenes.lock().unwrap();
+                if let Some(max) = self.max_scenes {
+                    if scenes.len() >= max && !scenes.contains_key(&scene) {
+                        return Err(anyhow!(
+                            "cannot start scene {}, {} scenes are already running",
+                            scene,
+                            scenes.len()
+                        ));
                     }
+                }
+                let cancel_tx = scenes
+                    .entry(scene)
+                    .or_insert_with(|| broadcast::channel(1).0);
+                self.scene_tx = Some(cancel_tx.clone());
+            }
+            Instruction::Changed(ip) => {
+                let trigger = self.trigger.as_ref().map(|(_, value)| value.clone());
+                if trigger == self.last_trigger {
+                    // Same value as last time, i.e. a retained value delivered again
+                    self.ip = ip;
                 } else {
-                    panic!("index property must be a string value")
+                    self.last_trigger = trigger;
+                }
+            }
+            Instruction::Cooldown(ip) => {
+                let v = self.pop();
+                match v {
+                    Value::Duration(d) => {
+                        let now = time::Instant::now();
+                        match self.last_fired {
+                            Some(last) if now.duration_since(last) < d => {
+                                // Still cooling down, ignore this trigger
+                                self.ip = ip;
+                            }
+                            _ => {
+                                self.last_fired = Some(now);
+                            }
+                        }
+                    }
+                    v => return Err(anyhow!("cooldown must be a duration: {}", v)),
+                };
+            }
+            Instruction::Breaker(ip) => {
+                let (open, window, max) = match (self.pop(), self.pop(), self.pop()) {
+                    (Value::Duration(open), Value::Duration(window), Value::Integer(max)) => {
+                        (open, window, max)
+                    }
+                    (open, window, max) => {
+                        return Err(anyhow!(
+                            "breaker must be a number of times per duration for a duration: {} per {} for {}",
+                            max,
+                            window,
+                            open
+                        ))
+                    }
+                };
+                let was_open = self.breaker.open_until.is_some();
+                if !self.breaker.fire(time::Instant::now(), max, window, open) {
+                    if !was_open {
+                        let path = self.trigger.as_ref().map(|(path, _)| path.clone());
+                        logging::event(
+                            Level::Warn,
+                            "breaker",
+                            &[
+                                ("path", &path.unwrap_or_default()),
+                                ("open", &format!("{:?}", open)),
+                            ],
+                        );
+                    }
+                    self.ip = ip;
+                }
+            }
+            Instruction::Debounce(ip) => {
+                let d = match self.pop() {
+                    Value::Duration(d) => d,
+                    v => return Err(anyhow!("debounce must be a duration: {}", v)),
+                };
+                // Each time the when fires again the debounce starts over.
+                self.debounce = Some((time::Instant::now() + d, self.ip, self.stack_ptr));
+                self.ip = ip;
+            }
+            Instruction::Object(n) => {
+                let mut props = BTreeMap::new();
+                for _ in 0..n {
+                    let value = self.pop();
+                    let key: String = self.pop().try_into()?;
+                    // The properties are popped last first, a repeated name keeps the last value.
+                    props.entry(key).or_insert(value);
+                }
+                self.push(Value::Object(props))
+            }
+            Instruction::Index => {
+                // The object is usually the payload of a device,
+                // which may not have the property or not be an object at all.
+                let prop: String = self.pop().try_into()?;
+                match self.pop() {
+                    Value::Object(props) => match props.get(&prop) {
+                        Some(v) => self.push(v.to_owned()),
+                        None => return Err(anyhow!("object does not have property {}", prop)),
+                    },
+                    v => {
+                        return Err(anyhow!(
+                            "cannot index {} of {}, it is not an object",
+                            prop,
+                            v
+                        ))
+                    }
                 }
             }
         };
@@ -298,33 +1300,280 @@ impl<E: Engine + 'static> ThreadContext<E> {
     }
 }
 
-pub struct VM<E: Engine> {
-    engine: E,
+/// Breaker counts the recent firings of a when to stop it while it fires too often,
+/// i.e. for a flapping device toggling an actuator.
+#[derive(Debug, Default)]
+struct Breaker {
+    firings: VecDeque<time::Instant>,
+    // When the breaker closes again, while it is open the when does not run.
+    open_until: Option<time::Instant>,
 }
-impl<E: Engine + 'static> VM<E> {
-    pub fn new(engine: E) -> VM<E> {
-        VM { engine }
-    }
-    pub async fn run(&self, code: Code, mut shutdown: broadcast::Receiver<()>) -> Result<()> {
-        // Create channel for thread join handles
-        let (thread_join_send, mut thread_join_recv) = mpsc::channel(100);
 
-        // Create and run main thread
-        let thread = Thread::new(self.engine.clone(), Arc::new(code), 0, thread_join_send);
-        thread.run(shutdown.resubscribe()).await?;
+impl Breaker {
+    /// Records a firing at now and reports whether the when may run.
+    /// Firing more than max times within the window opens the breaker for the open duration,
+    /// once it closes the firings are counted from scratch.
+    fn fire(&mut self, now: time::Instant, max: i64, window: Duration, open: Duration) -> bool {
+        match self.open_until {
+            Some(until) if now < until => return false,
+            Some(_) => {
+                self.open_until = None;
+                self.firings.clear();
+            }
+            None => {}
+        }
+        while matches!(self.firings.front(), Some(first) if now.duration_since(*first) >= window) {
+            self.firings.pop_front();
+        }
+        if self.firings.len() as i64 >= max {
+            self.open_until = Some(now + open);
+            return false;
+        }
+        self.firings.push_back(now);
+        true
+    }
+}
 
-        // Now that the main thread is completed wait until all other threads
-        // are completed before returning.
+/// Computes the aggregate of the numeric values found for the path.
+/// Values that are not numbers are skipped.
+fn aggregate(agg: Aggregate, path: &str, values: Vec<Vec<u8>>) -> Result<Value> {
+    let mut numbers = Vec::with_capacity(values.len());
+    for value in values {
+        match Value::try_from(&value[..])? {
+            Value::Integer(i) => numbers.push(i as f64),
+            Value::Float(f) => numbers.push(f),
+            _ => {}
+        }
+    }
+    if numbers.is_empty() && agg != Aggregate::Count && agg != Aggregate::Sum {
+        return Err(anyhow!("no numeric values for {:?} <{}>", agg, path));
+    }
+    Ok(match agg {
+        Aggregate::Avg => Value::Float(numbers.iter().sum::<f64>() / numbers.len() as f64),
+        Aggregate::Min => Value::Float(numbers.iter().cloned().fold(f64::INFINITY, f64::min)),
+        Aggregate::Max => Value::Float(numbers.iter().cloned().fold(f64::NEG_INFINITY, f64::max)),
+        Aggregate::Sum => Value::Float(numbers.iter().sum()),
+        Aggregate::Count => Value::Integer(numbers.len() as i64),
+    })
+}
+
+/// Reports whether the latest of the samples moved in the direction of the trend.
+/// Without a change the latest value is compared to the value before it.
+/// With a change, an amount and a window, the latest value is compared to the value
+/// the path had the window before the latest value was received and must have moved by at least the amount.
+/// Without enough history, or when the values are not numbers, the trend is false.
+fn trend(t: Trend, samples: &[Sample], change: Option<(f64, Duration)>) -> bool {
+    let number = |s: &Sample| {
+        Value::try_from(&s.payload[..])
+            .ok()
+            .and_then(|v| v.number())
+    };
+    let (latest, rest) = match samples.split_last() {
+        Some(split) => split,
+        None => return false,
+    };
+    let reference = match change {
+        None => rest.last(),
+        Some((_, window)) => rest.iter().rev().find(|s| s.time + window <= latest.time),
+    };
+    let delta = match (reference.and_then(number), number(latest)) {
+        (Some(from), Some(to)) if t == Trend::Rising => to - from,
+        (Some(from), Some(to)) => from - to,
+        _ => return false,
+    };
+    match change {
+        None => delta > 0.0,
+        Some((by, _)) => delta >= by,
+    }
+}
+
+/// Computes how long until the next h:m after now in the time zone of now.
+/// The day is advanced by date so that days that are shorter or longer
+/// because of daylight saving time are handled.
+/// A time repeated when clocks fall back is only the earliest of the two,
+/// and a time skipped when clocks spring forward is as long after the change
+/// as it would have been after the time before the clocks changed,
+/// so each time happens exactly once a day.
+fn until<Tz: TimeZone>(h: u32, m: u32, now: DateTime<Tz>) -> Duration {
+    let tz = now.timezone();
+    let mut date = now.naive_local().date();
+    loop {
+        let then = date.and_hms_opt(h, m, 0).unwrap();
+        let then = match tz.from_local_datetime(&then) {
+            LocalResult::Single(then) | LocalResult::Ambiguous(then, _) => then,
+            LocalResult::None => {
+                // Clocks do not spring forward more than a few hours,
+                // so the offset a day before is the offset before the change.
+                let before = tz
+                    .offset_from_local_datetime(&(then - chrono::Duration::days(1)))
+                    .earliest()
+                    .unwrap();
+                tz.from_utc_datetime(&(then - before.fix()))
+            }
+        };
+        if then > now {
+            return (then - now).to_std().unwrap();
+        }
+        // The time has passed today, wait for the next one.
+        date = date.succ_opt().unwrap();
+    }
+}
+
+/// Returns how long until the time of day h:m, like until,
+/// unless the at fired recently, then the time after the one it fired at.
+/// The wait for the time ends by the timer, so a wall clock slightly behind it
+/// would find the time just fired still ahead and fire the at again right away.
+fn until_next<Tz: TimeZone>(h: u32, m: u32, now: DateTime<Tz>, fired_recently: bool) -> Duration {
+    if fired_recently {
+        let window = chrono::Duration::from_std(AT_REFIRE_WINDOW).unwrap();
+        until(h, m, now + window) + AT_REFIRE_WINDOW
+    } else {
+        until(h, m, now)
+    }
+}
+
+/// How many days an at on the sun looks ahead for the sunrise or sunset,
+/// the polar night lasts less than half a year.
+const SUN_DAYS: i64 = 366;
+
+/// Returns how long until the next sunrise or sunset after now, computed by event for each date,
+/// along with how many days it skipped since the sun did not rise or set on them.
+/// Like until_next, an at that fired recently waits for the time after the one it fired at.
+fn until_sun<Tz: TimeZone>(
+    now: DateTime<Tz>,
+    fired_recently: bool,
+    event: impl Fn(NaiveDate) -> Option<DateTime<Utc>>,
+) -> Option<(Duration, i64)> {
+    let date = now.naive_local().date();
+    let now = now.with_timezone(&Utc);
+    let after = if fired_recently {
+        now + chrono::Duration::from_std(AT_REFIRE_WINDOW).unwrap()
+    } else {
+        now
+    };
+    let mut skipped = 0;
+    for day in 0..SUN_DAYS {
+        match event(date + chrono::Duration::days(day)) {
+            Some(then) if then > after => return Some(((then - now).to_std().unwrap(), skipped)),
+            Some(_) => {}
+            None => skipped += 1,
+        }
+    }
+    None
+}
+
+/// Reports whether the time of day of now is at or after h:m.
+fn passed<Tz: TimeZone>(h: u32, m: u32, now: DateTime<Tz>) -> bool {
+    let now = now.naive_local().time();
+    now.hour() * 60 + now.minute() >= h * 60 + m
+}
+
+pub struct VM<E: Engine> {
+    engine: E,
+    output: Output,
+    formatter: Formatter,
+    quiet: Option<QuietHours>,
+    clock: Clock,
+    time_zone: Option<Tz>,
+    location: Option<Location>,
+    max_scenes: Option<usize>,
+}
+impl<E: Engine + 'static> VM<E> {
+    pub fn new(engine: E) -> VM<E> {
+        Self::with_output(engine, Output::Text)
+    }
+    pub fn with_output(engine: E, output: Output) -> VM<E> {
+        VM {
+            engine,
+            output,
+            formatter: format_value,
+            quiet: None,
+            clock: Local::now,
+            time_zone: None,
+            location: None,
+            max_scenes: None,
+        }
+    }
+    /// Formats the values of publish statements with the formatter instead of format_value,
+    /// i.e. to always publish JSON.
+    pub fn with_formatter(mut self, formatter: Formatter) -> VM<E> {
+        self.formatter = formatter;
+        self
+    }
+    /// Drops the sets that are not urgent during the quiet hours.
+    pub fn with_quiet_hours(mut self, quiet: QuietHours) -> VM<E> {
+        self.quiet = Some(quiet);
+        self
+    }
+    /// Reads the time of day of the guards from now instead of the local clock.
+    pub fn with_clock(mut self, now: Clock) -> VM<E> {
+        self.clock = now;
+        self
+    }
+    /// Interprets the times of the ats, guards and quiet hours in the time zone
+    /// instead of the local time zone of the host, i.e. for a server in UTC controlling a home.
+    pub fn with_time_zone(mut self, time_zone: Tz) -> VM<E> {
+        self.time_zone = Some(time_zone);
+        self
+    }
+    /// Computes the times of the ats on the sun, #sunrise and #sunset, at the location.
+    pub fn with_location(mut self, location: Location) -> VM<E> {
+        self.location = Some(location);
+        self
+    }
+    /// Limits how many scenes may run at once, starting another scene is an error.
+    /// A scene is running from when it is started or armed until it is stopped.
+    pub fn with_max_scenes(mut self, max_scenes: usize) -> VM<E> {
+        self.max_scenes = Some(max_scenes);
+        self
+    }
+    /// Runs the code until all of its threads complete or shutdown,
+    /// once it returns no thread uses the engine so the engine can be closed.
+    /// Run may be called concurrently, i.e. to evaluate code while a program is running,
+    /// each run has its own scenes, whens and ats and only shares the engine.
+    pub async fn run(&self, code: Code, mut shutdown: broadcast::Receiver<()>) -> Result<()> {
+        // Create channel for thread join handles
+        let (thread_join_send, mut thread_join_recv) = mpsc::channel(100);
+
+        // Create and run main thread
+        let thread = Thread::new(
+            self.engine.clone(),
+            Arc::new(code),
+            self.output,
+            self.formatter,
+            self.quiet.map(|quiet| match self.time_zone {
+                Some(tz) => quiet.with_time_zone(tz),
+                None => quiet,
+            }),
+            self.clock,
+            self.time_zone,
+            self.location,
+            0,
+            self.max_scenes,
+            thread_join_send,
+        );
+        thread.run(shutdown.resubscribe()).await?;
+
+        // Now that the main thread is completed wait until all other threads
+        // are completed before returning.
         //
         // NOTE: The thread_join_send, will be dropped once all active threads are
         // completed and this loop will terminate.
         loop {
             select! {
                 thread_join = thread_join_recv.recv() => {
-                    if let Some(thread_join) = thread_join {
+                    if let Some(mut thread_join) = thread_join {
                         select! {
-                        _ = thread_join => {},
-                        _ = shutdown.recv() => break,
+                        res = &mut thread_join => match res {
+                            Ok(Err(err)) => log::error!("thread failed: {}", err),
+                            Err(err) => log::error!("thread failed: {}", err),
+                            Ok(Ok(())) => {}
+                        },
+                        _ = shutdown.recv() => {
+                            thread_join.abort();
+                            let _ = thread_join.await;
+                            break;
+                        },
                         };
                     } else {
                         // All threads have completed
@@ -334,6 +1583,13 @@ impl<E: Engine + 'static> VM<E> {
                 _ = shutdown.recv() => break,
             }
         }
+        // Stop the threads that are still running, i.e. threads spawned as shutdown was sent,
+        // so that no thread uses the engine once run returns and the engine can be closed.
+        thread_join_recv.close();
+        while let Some(thread_join) = thread_join_recv.recv().await {
+            thread_join.abort();
+            let _ = thread_join.await;
+        }
         Ok(())
     }
 }
@@ -342,8 +1598,9 @@ impl<E: Engine + 'static> VM<E> {
 mod tests {
     use async_std::future;
     use std::{
+        collections::VecDeque,
         sync::{
-            atomic::{AtomicUsize, Ordering},
+            atomic::{AtomicBool, AtomicUsize, Ordering},
             Arc, Mutex,
         },
         task::Poll,
@@ -352,6 +1609,7 @@ mod tests {
     use super::*;
     use crate::compiler::Interpreter;
     use crate::Compile;
+    use chrono::Datelike;
 
     struct TestEngine {
         print_count: AtomicUsize,
@@ -360,11 +1618,39 @@ mod tests {
         wait_args: Mutex<Vec<Duration>>,
         get_count: AtomicUsize,
         get_args: Mutex<Vec<String>>,
+        get_values: Mutex<VecDeque<String>>,
+        // How many gets found no value left to answer with.
+        starved: AtomicUsize,
         set_count: AtomicUsize,
         set_args: Mutex<Vec<(String, String)>>,
+        publish_args: Mutex<Vec<(String, String)>>,
+        clear_args: Mutex<Vec<String>>,
+        find_values: Mutex<Option<Vec<String>>>,
+        history: Mutex<Vec<Sample>>,
+        // How many finds and histories are answered as not ready.
+        not_ready: AtomicUsize,
+        // Waits complete once ticked when set, instead of immediately.
+        ticks: Option<tokio::sync::Semaphore>,
+        // Gets fail as if the engine was closed once set.
+        closed: AtomicBool,
+        // Wakes the gets waiting for a value once closed.
+        closing: tokio::sync::Notify,
     }
     impl TestEngine {
         fn new() -> Arc<Self> {
+            Self::with_gets(&["true"])
+        }
+        /// Creates a test engine that answers gets with each of the values in order,
+        /// once all values are used gets never complete.
+        fn with_gets(values: &[&str]) -> Arc<Self> {
+            Self::build(values, None)
+        }
+        /// Creates a test engine whose waits complete only when ticked,
+        /// so a test decides when each at fires instead of the clock.
+        fn ticking() -> Arc<Self> {
+            Self::build(&["true"], Some(tokio::sync::Semaphore::new(0)))
+        }
+        fn build(values: &[&str], ticks: Option<tokio::sync::Semaphore>) -> Arc<Self> {
             Arc::new(Self {
                 print_count: AtomicUsize::new(0),
                 print_args: Mutex::new(Vec::new()),
@@ -372,10 +1658,43 @@ mod tests {
                 wait_args: Mutex::new(Vec::new()),
                 get_count: AtomicUsize::new(0),
                 get_args: Mutex::new(Vec::new()),
+                get_values: Mutex::new(values.iter().map(|v| v.to_string()).collect()),
+                starved: AtomicUsize::new(0),
                 set_count: AtomicUsize::new(0),
                 set_args: Mutex::new(Vec::new()),
+                publish_args: Mutex::new(Vec::new()),
+                clear_args: Mutex::new(Vec::new()),
+                find_values: Mutex::new(None),
+                history: Mutex::new(Vec::new()),
+                not_ready: AtomicUsize::new(0),
+                ticks,
+                closed: AtomicBool::new(false),
+                closing: tokio::sync::Notify::new(),
             })
         }
+        /// Closes the engine, failing the waiting and later gets.
+        fn close(&self) {
+            self.closed.store(true, Ordering::SeqCst);
+            self.closing.notify_waiters();
+        }
+        /// Completes one of the waits of a ticking engine.
+        fn tick(&self) {
+            self.ticks.as_ref().unwrap().add_permits(1);
+        }
+    }
+
+    impl TestEngine {
+        fn ready(&self) -> Result<()> {
+            let not_ready = self.not_ready.load(Ordering::SeqCst);
+            if not_ready > 0 {
+                self.not_ready.store(not_ready - 1, Ordering::SeqCst);
+                return Err(NotReady {
+                    remaining: Duration::from_secs(1),
+                }
+                .into());
+            }
+            Ok(())
+        }
     }
 
     #[async_trait]
@@ -388,17 +1707,29 @@ mod tests {
         async fn wait(&self, d: Duration) -> Result<()> {
             self.wait_count.fetch_add(1, Ordering::SeqCst);
             self.wait_args.lock().unwrap().push(d.clone());
+            if let Some(ticks) = &self.ticks {
+                ticks.acquire().await?.forget();
+            }
             future::ready(Ok(())).await
         }
 
         async fn get(&self, path: &str) -> Result<Vec<u8>> {
-            let count = self.get_count.fetch_add(1, Ordering::SeqCst);
+            self.get_count.fetch_add(1, Ordering::SeqCst);
             self.get_args.lock().unwrap().push(path.to_string());
-            println!("count {}", count);
-            if count == 0 {
-                future::ready(Ok("true".as_bytes().to_vec())).await
+            if self.closed.load(Ordering::SeqCst) {
+                return Err(Closed.into());
+            }
+            let value = self.get_values.lock().unwrap().pop_front();
+            if let Some(value) = value {
+                self.history.lock().unwrap().push(Sample {
+                    time: time::Instant::now(),
+                    payload: value.clone().into_bytes(),
+                });
+                future::ready(Ok(value.into_bytes())).await
             } else {
-                empty().await
+                self.starved.fetch_add(1, Ordering::SeqCst);
+                self.closing.notified().await;
+                Err(Closed.into())
             }
         }
 
@@ -410,6 +1741,31 @@ mod tests {
                 .push((path.to_string(), String::from_utf8(value.into()).unwrap()));
             future::ready(Ok(())).await
         }
+        async fn publish(&self, path: &str, value: Vec<u8>) -> Result<()> {
+            self.publish_args
+                .lock()
+                .unwrap()
+                .push((path.to_string(), String::from_utf8(value).unwrap()));
+            future::ready(Ok(())).await
+        }
+        async fn clear(&self, path: &str) -> Result<()> {
+            self.clear_args.lock().unwrap().push(path.to_string());
+            future::ready(Ok(())).await
+        }
+        async fn find(&self, _path: &str) -> Result<Vec<Vec<u8>>> {
+            self.ready()?;
+            // Answer a single find, later finds never complete like gets.
+            let values = self.find_values.lock().unwrap().take();
+            if let Some(values) = values {
+                future::ready(Ok(values.into_iter().map(|v| v.into_bytes()).collect())).await
+            } else {
+                empty().await
+            }
+        }
+        async fn history(&self, _path: &str) -> Result<Vec<Sample>> {
+            self.ready()?;
+            Ok(self.history.lock().unwrap().clone())
+        }
     }
 
     use core::marker;
@@ -443,10 +1799,41 @@ mod tests {
         }
     }
 
+    /// Waits until the condition holds, failing the test after a second.
+    async fn eventually(mut condition: impl FnMut() -> bool) {
+        time::timeout(Duration::from_secs(1), async {
+            while !condition() {
+                time::sleep(Duration::from_millis(5)).await;
+            }
+        })
+        .await
+        .unwrap();
+    }
+    /// Waits until a get found no value left to answer with,
+    /// so the whens handled every value before it.
+    async fn drained(te: &TestEngine) {
+        eventually(|| te.starved.load(Ordering::SeqCst) > 0).await;
+    }
+    /// Runs the source until the VM finishes, for programs without whens or ats.
+    async fn run_vm_to_end(source: &str, te: Arc<TestEngine>, output: Output) -> Arc<TestEngine> {
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        VM::with_output(te.clone(), output)
+            .run(code, shutdown_rx)
+            .await
+            .unwrap();
+        te
+    }
     fn run_vm(source: &str) -> (Arc<TestEngine>, broadcast::Sender<()>) {
+        run_vm_with(source, TestEngine::new(), Output::Text)
+    }
+    fn run_vm_with(
+        source: &str,
+        te: Arc<TestEngine>,
+        output: Output,
+    ) -> (Arc<TestEngine>, broadcast::Sender<()>) {
         let code = Interpreter::from_source(source).unwrap();
-        let te = TestEngine::new();
-        let vm = VM::new(te.clone());
+        let vm = VM::with_output(te.clone(), output);
         let (shutdown_tx, shutdown_rx) = broadcast::channel(2);
         tokio::spawn(async move {
             vm.run(code, shutdown_rx).await.unwrap();
@@ -479,6 +1866,48 @@ mod tests {
         let _ = shutdown.send(());
     }
     #[tokio::test]
+    async fn test_print_json() {
+        let source = "
+        print {x: 1, y: \"on\"};
+        print \"off\";
+";
+
+        let te = run_vm_to_end(source, TestEngine::new(), Output::Json).await;
+
+        assert_eq!(2, te.print_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec![r#"{"x":1,"y":"on"}"#.to_string(), r#""off""#.to_string()],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_print_object() {
+        let source = "
+        let x = 1;
+        let y = 2.5;
+        print {a: x, b: {c: y, d: x}, e: \"on\"};
+        print 3 as z {a: z, a: x};
+";
+
+        let te = run_vm_to_end(source, TestEngine::new(), Output::Json).await;
+
+        assert_eq!(
+            vec![
+                r#"{"a":1,"b":{"c":2.5,"d":1},"e":"on"}"#.to_string(),
+                r#"{"a":1}"#.to_string()
+            ],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+    }
+    #[tokio::test]
     async fn test_as() {
         let source = "
         print 1 as x x;
@@ -564,96 +1993,1560 @@ mod tests {
         let _ = shutdown.send(());
     }
     #[tokio::test]
-    async fn test_wait() {
+    async fn test_when_trigger() {
         let source = "
-            wait 1s print \"done\";
+            when <lux> set [light/brightness] $value;
     ";
-        let (te, shutdown) = run_vm(source);
-        // TODO: remove this sleep
-        time::sleep(Duration::from_millis(100)).await;
+        let (te, shutdown) =
+            run_vm_with(source, TestEngine::with_gets(&["40", "55"]), Output::Text);
+        drained(&te).await;
 
-        assert_eq!(0, te.get_count.load(Ordering::SeqCst));
-        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
-        assert_eq!(1, te.wait_count.load(Ordering::SeqCst));
         assert_eq!(
-            vec![Duration::from_secs(1),],
-            te.wait_args
+            vec![
+                ("light/brightness".to_string(), "40".to_string()),
+                ("light/brightness".to_string(), "55".to_string())
+            ],
+            te.set_args
                 .lock()
                 .unwrap()
                 .drain(..)
-                .collect::<Vec<Duration>>(),
+                .collect::<Vec<(String, String)>>(),
         );
         let _ = shutdown.send(());
     }
     #[tokio::test]
-    async fn test_set() {
+    async fn test_trigger_outside_when() {
+        let code = Interpreter::from_source("print $value;").unwrap();
+        let vm = VM::new(TestEngine::new());
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        assert!(vm.run(code, shutdown_rx).await.is_err());
+    }
+    #[tokio::test]
+    async fn test_assert() {
+        let code = Interpreter::from_source(r#"assert <light> is "on";"#).unwrap();
+        let vm = VM::new(TestEngine::with_gets(&["\"on\""]));
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        vm.run(code, shutdown_rx).await.unwrap();
+    }
+    #[tokio::test]
+    async fn test_assert_failed() {
+        let code = Interpreter::from_source(r#"print 1; assert <light> is "on";"#).unwrap();
+        let vm = VM::new(TestEngine::with_gets(&["\"off\""]));
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let err = vm.run(code, shutdown_rx).await.unwrap_err();
+        assert_eq!(
+            Some(&AssertionFailed {
+                offset: 9,
+                location: None
+            }),
+            err.downcast_ref::<AssertionFailed>()
+        );
+    }
+    async fn run_aggregate(source: &str, values: &[&str]) -> Result<Vec<String>> {
+        let te = TestEngine::new();
+        *te.find_values.lock().unwrap() = Some(values.iter().map(|v| v.to_string()).collect());
+        let code = Interpreter::from_source(source).unwrap();
+        let vm = VM::new(te.clone());
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        vm.run(code, shutdown_rx).await?;
+        let prints = te.print_args.lock().unwrap().drain(..).collect();
+        Ok(prints)
+    }
+    #[tokio::test]
+    async fn test_aggregate() {
+        let temps = &["20", "23.5", "\"off\"", "27"];
+        assert_eq!(
+            vec!["23.5".to_string()],
+            run_aggregate("print avg <+/temp>;", temps).await.unwrap()
+        );
+        assert_eq!(
+            vec!["27".to_string()],
+            run_aggregate("print max <+/temp>;", temps).await.unwrap()
+        );
+        assert_eq!(
+            vec!["20".to_string()],
+            run_aggregate("print min <+/temp>;", temps).await.unwrap()
+        );
+        assert_eq!(
+            vec!["3".to_string()],
+            run_aggregate("print count <+/temp>;", temps).await.unwrap()
+        );
+        assert_eq!(
+            vec!["true".to_string()],
+            run_aggregate("print max <+/temp> is 27;", temps)
+                .await
+                .unwrap()
+        );
+        assert!(run_aggregate("print avg <+/temp>;", &["\"off\""])
+            .await
+            .is_err());
+    }
+    #[test]
+    fn test_trend() {
+        let start = time::Instant::now();
+        let samples = |values: &[(u64, &str)]| -> Vec<Sample> {
+            values
+                .iter()
+                .map(|(secs, v)| Sample {
+                    time: start + Duration::from_secs(*secs),
+                    payload: v.as_bytes().to_vec(),
+                })
+                .collect()
+        };
+        let rising = samples(&[(0, "20"), (60, "21"), (120, "20.5"), (600, "23")]);
+        assert!(trend(Trend::Rising, &rising, None));
+        assert!(!trend(Trend::Falling, &rising, None));
+        assert!(trend(Trend::Falling, &rising[..3], None));
+        // The value 10m before the latest value was 20.
+        let by = |by: f64| Some((by, Duration::from_secs(600)));
+        assert!(trend(Trend::Rising, &rising, by(3.0)));
+        assert!(!trend(Trend::Rising, &rising, by(3.5)));
+        assert!(!trend(Trend::Falling, &rising, by(1.0)));
+        // The value 5m before the latest value was 20.5.
+        assert!(!trend(
+            Trend::Rising,
+            &rising,
+            Some((3.0, Duration::from_secs(300)))
+        ));
+        assert!(trend(
+            Trend::Rising,
+            &rising,
+            Some((2.5, Duration::from_secs(300)))
+        ));
+        // The history does not reach back far enough.
+        assert!(!trend(
+            Trend::Rising,
+            &rising,
+            Some((1.0, Duration::from_secs(3600)))
+        ));
+        assert!(!trend(Trend::Rising, &rising[..1], None));
+        assert!(!trend(Trend::Rising, &[], None));
+        let falling = samples(&[(0, "on"), (60, "18")]);
+        assert!(!trend(Trend::Falling, &falling, None));
+    }
+    #[tokio::test]
+    async fn test_when_rising() {
         let source = "
-            set [path/to/value] \"on\";
-    ";
-        let (te, shutdown) = run_vm(source);
-        // TODO: remove this sleep
-        time::sleep(Duration::from_millis(100)).await;
-
-        assert_eq!(0, te.get_count.load(Ordering::SeqCst));
-        assert_eq!(0, te.wait_count.load(Ordering::SeqCst));
+        when <temp> rising print $value;
+";
+        let te = TestEngine::with_gets(&["20", "21", "21", "19", "22"]);
+        let (te, shutdown) = run_vm_with(source, te, Output::Text);
+        drained(&te).await;
 
-        assert_eq!(1, te.set_count.load(Ordering::SeqCst));
         assert_eq!(
-            vec![("path/to/value".to_string(), "on".to_string())],
-            te.set_args
+            vec!["21".to_string(), "22".to_string()],
+            te.print_args
                 .lock()
                 .unwrap()
                 .drain(..)
-                .collect::<Vec<(String, String)>>(),
+                .collect::<Vec<String>>(),
         );
         let _ = shutdown.send(());
     }
     #[tokio::test]
-    async fn test_many_threads() {
+    async fn test_when_not_ready() {
         let source = "
-            wait 5s print \"a\";
-            wait 4s print \"b\";
-            wait 3s print \"c\";
-            wait 2s print \"d\";
-            wait 1s print \"e\";
-    ";
-        let (te, shutdown) = run_vm(source);
-        // TODO: remove this sleep
-        time::sleep(Duration::from_millis(100)).await;
+        when <temp> rising print $value;
+";
+        let te = TestEngine::with_gets(&["20", "21", "22"]);
+        te.not_ready.store(2, Ordering::SeqCst);
+        let (te, shutdown) = run_vm_with(source, te, Output::Text);
+        drained(&te).await;
 
-        assert_eq!(0, te.get_count.load(Ordering::SeqCst));
-        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
-        assert_eq!(5, te.wait_count.load(Ordering::SeqCst));
+        // The values received while not ready are only kept as history,
+        // the when then waits for a fourth value.
+        assert_eq!(4, te.get_count.load(Ordering::SeqCst));
         assert_eq!(
-            vec![
-                Duration::from_secs(5),
-                Duration::from_secs(4),
-                Duration::from_secs(3),
-                Duration::from_secs(2),
-                Duration::from_secs(1),
-            ],
-            te.wait_args
+            vec!["22".to_string()],
+            te.print_args
                 .lock()
                 .unwrap()
                 .drain(..)
-                .collect::<Vec<Duration>>(),
+                .collect::<Vec<String>>(),
         );
         let _ = shutdown.send(());
     }
     #[tokio::test]
-    async fn test_scene() {
+    async fn test_when_failed() {
+        // Indexing into a string fails, the when keeps running for the next value.
         let source = "
-        scene night { print \"x\"; };
-        start night;
-        stop night;
+        when <light> is \"on\" print $value.brightness;
+";
+        let te = TestEngine::with_gets(&["on", "on"]);
+        let (te, shutdown) = run_vm_with(source, te, Output::Text);
+        // The second failure in a row backs off before the third get.
+        eventually(|| te.get_count.load(Ordering::SeqCst) == 3).await;
+        assert_eq!(0, te.print_count.load(Ordering::SeqCst));
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_when_failed_in_scene() {
+        // The scene fails for each value, stopping it must not stop the when that started it.
+        let source = "
+        scene s { print $value.brightness; };
+        when <light> {
+            print $value;
+            stop s;
+            start s;
+        };
+";
+        let te = TestEngine::with_gets(&["on", "on", "on"]);
+        let (te, shutdown) = run_vm_with(source, te, Output::Text);
+        eventually(|| te.print_count.load(Ordering::SeqCst) == 3).await;
+        drained(&te).await;
+        assert_eq!(
+            vec!["on".to_string(), "on".to_string(), "on".to_string()],
+            te.print_args.lock().unwrap().clone(),
+        );
+        let _ = shutdown.send(());
+    }
+    #[test]
+    fn test_restart_delay() {
+        assert_eq!(None, restart_delay(1));
+        assert_eq!(Some(Duration::from_millis(100)), restart_delay(2));
+        assert_eq!(Some(Duration::from_millis(400)), restart_delay(4));
+        assert_eq!(Some(RESTART_MAX_DELAY), restart_delay(20));
+        assert_eq!(Some(RESTART_MAX_DELAY), restart_delay(u32::MAX));
+    }
+    #[tokio::test]
+    async fn test_not_ready() {
+        let te = TestEngine::new();
+        *te.find_values.lock().unwrap() = Some(vec!["20".to_string()]);
+        te.not_ready.store(1, Ordering::SeqCst);
+        let code = Interpreter::from_source("print avg <+/temp>;").unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let err = VM::new(te.clone())
+            .run(code, shutdown_rx)
+            .await
+            .unwrap_err();
+        assert!(err.is::<NotReady>());
+        assert_eq!(0, te.print_count.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_unsupported() {
+        // An engine implementing only the required requests.
+        #[derive(Clone)]
+        struct GetSetEngine;
+        #[async_trait]
+        impl Engine for GetSetEngine {
+            async fn get(&self, _path: &str) -> Result<Vec<u8>> {
+                Ok(b"1".to_vec())
+            }
+            async fn set(&self, _path: &str, _value: Vec<u8>) -> Result<()> {
+                Ok(())
+            }
+        }
+        let code = Interpreter::from_source("publish [light] 1;").unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let err = VM::new(GetSetEngine)
+            .run(code, shutdown_rx)
+            .await
+            .unwrap_err();
+        assert_eq!(
+            Some(&Unsupported { request: "publish" }),
+            err.downcast_ref::<Unsupported>()
+        );
+    }
+    #[tokio::test]
+    async fn test_range() {
+        for (source, want) in [
+            ("print 50 is inside 40..60;", "true"),
+            ("print 40 is inside 40..60;", "true"),
+            ("print 60.0 is inside 40..60;", "true"),
+            ("print 60.5 is inside 40..60;", "false"),
+            ("print 60 is outside 40..60;", "false"),
+            ("print 39 is outside 40..60;", "true"),
+            ("print \"off\" is inside 40..60;", "false"),
+            ("print \"off\" is outside 40..60;", "false"),
+        ] {
+            assert_eq!(
+                vec![want.to_string()],
+                run_aggregate(source, &[]).await.unwrap(),
+                "{}",
+                source
+            );
+        }
+        assert!(run_aggregate("print 50 is inside \"a\"..60;", &[])
+            .await
+            .is_err());
+    }
+    #[tokio::test]
+    async fn test_index_missing() {
+        for source in ["let o = {x: 1}; print o.y;", "let o = 1; print o.y;"] {
+            assert!(run_aggregate(source, &[]).await.is_err(), "{}", source);
+        }
+    }
+    #[tokio::test]
+    async fn test_when_range() {
+        let source = "
+            when <bath/humidity> is outside 40..60 print $value;
     ";
-        let (te, shutdown) = run_vm(source);
-        // TODO: remove this sleep
-        time::sleep(Duration::from_millis(100)).await;
+        let (te, shutdown) = run_vm_with(
+            source,
+            TestEngine::with_gets(&["30", "40", "\"off\"", "60", "61"]),
+            Output::Text,
+        );
+        drained(&te).await;
 
-        assert_eq!(0, te.get_count.load(Ordering::SeqCst));
-        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
-        assert_eq!(0, te.wait_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec!["30".to_string(), "61".to_string()],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_compare() {
+        for (source, want) in [
+            ("print 26 > 25;", "true"),
+            ("print 25 > 25;", "false"),
+            ("print 24.5 < 25;", "true"),
+            ("print \"24\" < 25;", "true"),
+            ("print \"off\" < 25;", "false"),
+        ] {
+            assert_eq!(
+                vec![want.to_string()],
+                run_aggregate(source, &[]).await.unwrap(),
+                "{}",
+                source
+            );
+        }
+    }
+    async fn run_hysteresis(source: &str, gets: &[&str]) -> Vec<String> {
+        let (te, shutdown) = run_vm_with(source, TestEngine::with_gets(gets), Output::Text);
+        drained(&te).await;
+        let _ = shutdown.send(());
+        let prints = te.print_args.lock().unwrap().drain(..).collect();
+        prints
+    }
+    #[tokio::test]
+    async fn test_when_hysteresis() {
+        // Chatter around the threshold only fires again once below 24.
+        let temps = &["24.5", "25.5", "24.5", "25.5", "24", "25.2", "23.9", "25.1"];
+        assert_eq!(
+            vec!["25.5".to_string(), "25.1".to_string()],
+            run_hysteresis("when <temp> > 25 hysteresis 1 print $value;", temps).await
+        );
+        assert_eq!(
+            vec!["25.5", "25.5", "25.2", "25.1"],
+            run_hysteresis("when <temp> > 25 print $value;", temps).await
+        );
+        let temps = &["25", "24.5", "25", "26", "24.5", "26.5", "24.5"];
+        assert_eq!(
+            vec!["24.5".to_string(), "24.5".to_string()],
+            run_hysteresis("when <temp> < 25 hysteresis 1 print $value;", temps).await
+        );
+        let humidity = &["50", "65", "58", "70", "54", "35", "50", "38"];
+        assert_eq!(
+            vec!["65".to_string(), "35".to_string(), "38".to_string()],
+            run_hysteresis(
+                "when <humidity> is outside 40..60 hysteresis 5 print $value;",
+                humidity
+            )
+            .await
+        );
+    }
+    #[tokio::test]
+    async fn test_when_all() {
+        let source = r#"
+            when <back/lock> is "locked" and <front/lock> is "locked" print $path;
+    "#;
+        // The front door stays locked while the back door is locked, unlocked and locked again.
+        let locks = &[
+            "\"unlocked\"",
+            "\"locked\"",
+            "\"locked\"",
+            "\"locked\"",
+            "\"unlocked\"",
+            "\"locked\"",
+        ];
+        let (te, shutdown) = run_vm_with(source, TestEngine::with_gets(locks), Output::Text);
+        drained(&te).await;
+
+        // The gets of the condition answer with the latest values,
+        // so the when only fires once both are locked and again once they were not.
+        assert_eq!(
+            vec!["back/lock".to_string(), "back/lock".to_string()],
+            te.print_args.lock().unwrap().clone()
+        );
+        // Once out of values it waits for a value of either lock.
+        assert_eq!(
+            vec![
+                "back/lock",
+                "front/lock",
+                "back/lock",
+                "back/lock",
+                "back/lock",
+                "back/lock",
+                "back/lock",
+                "front/lock",
+            ],
+            te.get_args.lock().unwrap().clone()
+        );
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_when_prev() {
+        let source = "
+            when <dimmer> > 15 {
+                set [dimmer/from] $prev;
+                set [dimmer/to] $value;
+            };
+    ";
+        let (te, shutdown) = run_vm_with(
+            source,
+            TestEngine::with_gets(&["10", "20", "30", "5", "40"]),
+            Output::Text,
+        );
+        drained(&te).await;
+        let _ = shutdown.send(());
+
+        // The previous value is the value before the trigger, even when it did not fire.
+        assert_eq!(
+            vec![
+                ("dimmer/from".to_string(), "10".to_string()),
+                ("dimmer/to".to_string(), "20".to_string()),
+                ("dimmer/from".to_string(), "20".to_string()),
+                ("dimmer/to".to_string(), "30".to_string()),
+                ("dimmer/from".to_string(), "5".to_string()),
+                ("dimmer/to".to_string(), "40".to_string()),
+            ],
+            te.set_args.lock().unwrap().clone()
+        );
+
+        // The first value has no previous value.
+        let (te, shutdown) = run_vm("when <dimmer> print $prev;");
+        drained(&te).await;
+        let _ = shutdown.send(());
+        assert_eq!(vec!["".to_string()], te.print_args.lock().unwrap().clone());
+    }
+    #[tokio::test]
+    async fn test_when_debounce() {
+        let source = "
+            when <motion> is \"detected\" debounce 50ms print $value;
+    ";
+        // A burst of triggers, with a value that does not fire in between.
+        let (te, shutdown) = run_vm_with(
+            source,
+            TestEngine::with_gets(&["\"detected\"", "\"clear\"", "\"detected\""]),
+            Output::Text,
+        );
+        // The fourth get waits for a value while the debounce runs out.
+        eventually(|| te.get_count.load(Ordering::SeqCst) == 4).await;
+        assert_eq!(0, te.print_count.load(Ordering::SeqCst));
+
+        // The statement runs once the burst is over.
+        eventually(|| te.get_count.load(Ordering::SeqCst) == 5).await;
+        let _ = shutdown.send(());
+        assert_eq!(
+            vec!["detected".to_string()],
+            te.print_args.lock().unwrap().clone()
+        );
+        // The get waiting for the next value when the debounce was over was dropped,
+        // and the when waits for the next value again after running the statement.
+        assert_eq!(5, te.get_count.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_when_changed() {
+        let source = "
+            when <setpoint> changed print $value;
+    ";
+        let (te, shutdown) = run_vm_with(
+            source,
+            TestEngine::with_gets(&["20", "20", "21", "21", "20"]),
+            Output::Text,
+        );
+        drained(&te).await;
+
+        assert_eq!(6, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec!["20".to_string(), "21".to_string(), "20".to_string()],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+        let _ = shutdown.send(());
+    }
+    /// Reports whether the program finishes, i.e. every when was stopped.
+    async fn finishes(source: &str) -> bool {
+        let code = Interpreter::from_source(source).unwrap();
+        let vm = VM::new(TestEngine::new());
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        time::timeout(Duration::from_millis(100), vm.run(code, shutdown_rx))
+            .await
+            .is_ok()
+    }
+    #[tokio::test]
+    async fn test_at_tick() {
+        let source = "
+            at 7:00AM set [porch/light] \"on\";
+    ";
+        let (te, shutdown) = run_vm_with(source, TestEngine::ticking(), Output::Text);
+        eventually(|| te.wait_count.load(Ordering::SeqCst) == 1).await;
+        // The at waits for the time of day until ticked.
+        assert_eq!(1, te.wait_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
+
+        te.tick();
+        eventually(|| te.wait_count.load(Ordering::SeqCst) == 2).await;
+        assert_eq!(
+            vec![("porch/light".to_string(), "on".to_string())],
+            te.set_args.lock().unwrap().clone(),
+        );
+        // Then it waits for the next day.
+        assert_eq!(2, te.wait_count.load(Ordering::SeqCst));
+        let waits = te.wait_args.lock().unwrap().clone();
+        assert!(waits
+            .iter()
+            .all(|d| *d <= Duration::from_secs(24 * 60 * 60)));
+
+        te.tick();
+        eventually(|| te.wait_count.load(Ordering::SeqCst) == 3).await;
+        assert_eq!(2, te.set_count.load(Ordering::SeqCst));
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_at_repeat() {
+        let source = "
+            at 8:00AM repeat 3 print \"pill\";
+    ";
+        let te = TestEngine::ticking();
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        for _ in 0..5 {
+            te.tick();
+        }
+        // The at stops after its third day, which completes the program.
+        time::timeout(
+            Duration::from_secs(1),
+            VM::new(te.clone()).run(code, shutdown_rx),
+        )
+        .await
+        .unwrap()
+        .unwrap();
+        assert_eq!(3, te.print_count.load(Ordering::SeqCst));
+        assert_eq!(3, te.wait_count.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_at_sunrise() {
+        let source = "
+            at #sunrise print \"morning\";
+    ";
+        let te = TestEngine::ticking();
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        // Without a location the at stops with an error, which completes the program.
+        time::timeout(
+            Duration::from_secs(1),
+            VM::new(te.clone()).run(code, shutdown_rx),
+        )
+        .await
+        .unwrap()
+        .unwrap();
+        assert_eq!(0, te.print_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.wait_count.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_run_concurrently() {
+        let te = TestEngine::ticking();
+        let vm = Arc::new(VM::new(te.clone()));
+        let (shutdown_tx, shutdown_rx) = broadcast::channel(2);
+        {
+            let vm = vm.clone();
+            let code = Interpreter::from_source("at 7:00AM set [porch/light] \"on\";").unwrap();
+            let shutdown_rx = shutdown_rx.resubscribe();
+            tokio::spawn(async move { vm.run(code, shutdown_rx).await.unwrap() });
+        }
+        // Evaluate while the at fires, neither waits for the other.
+        for i in 0..10 {
+            te.tick();
+            let code =
+                Interpreter::from_source(&format!("scene s {{ print {}; }}; start s; stop s;", i))
+                    .unwrap();
+            time::timeout(
+                Duration::from_millis(100),
+                vm.run(code, shutdown_rx.resubscribe()),
+            )
+            .await
+            .unwrap()
+            .unwrap();
+        }
+        eventually(|| te.set_count.load(Ordering::SeqCst) == 10).await;
+        assert_eq!(10, te.print_count.load(Ordering::SeqCst));
+        let _ = shutdown_tx.send(());
+    }
+    #[tokio::test]
+    async fn test_shutdown_stops_threads() {
+        let te = TestEngine::with_gets(&[]);
+        let vm = VM::new(te.clone());
+        let code = Interpreter::from_source("when <front/lock> is \"locked\" print 1;").unwrap();
+        let (shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        // Threads spawned once shutdown was sent do not receive it.
+        shutdown_tx.send(()).unwrap();
+        time::timeout(Duration::from_millis(100), vm.run(code, shutdown_rx))
+            .await
+            .unwrap()
+            .unwrap();
+        // The when was stopped and dropped along with the VM.
+        drop(vm);
+        assert_eq!(1, Arc::strong_count(&te));
+    }
+    #[tokio::test]
+    async fn test_stop_at() {
+        assert!(
+            finishes(
+                "
+            at 7:00AM print \"a\";
+            at 7:00AM print \"b\";
+            stop at 7:00AM;
+    "
+            )
+            .await
+        );
+        // Only the ats of the time are stopped,
+        // the other at waits for a value since the test engine does not wait for the time.
+        assert!(
+            !finishes(
+                "
+            at 7:00AM print \"a\";
+            at 8:00AM print <kitchen/light>;
+            stop at 7:00AM;
+    "
+            )
+            .await
+        );
+    }
+    #[tokio::test]
+    async fn test_stop_when() {
+        assert!(
+            finishes(
+                "
+            when <kitchen/light> print $value;
+            when <kitchen/fan> is \"on\" print $value;
+            stop when <kitchen/+>;
+    "
+            )
+            .await
+        );
+        // Only the whens reading a matching path are stopped.
+        assert!(
+            !finishes(
+                "
+            when <kitchen/light> print $value;
+            when <bedroom/light> print $value;
+            stop when <kitchen/+>;
+    "
+            )
+            .await
+        );
+        assert!(
+            !finishes(
+                "
+            when <kitchen/light> print $value;
+            stop when <kitchen/light/set>;
+    "
+            )
+            .await
+        );
+    }
+    #[tokio::test]
+    async fn test_max_scenes() {
+        let run = |source: &str| {
+            let te = TestEngine::new();
+            let code = Interpreter::from_source(source).unwrap();
+            let vm = VM::new(te.clone()).with_max_scenes(2);
+            async move {
+                let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+                vm.run(code, shutdown_rx).await?;
+                let prints: Vec<String> = te.print_args.lock().unwrap().drain(..).collect();
+                Ok(prints) as Result<Vec<String>>
+            }
+        };
+        let scenes = "
+            scene a { print \"a\"; };
+            scene b { print \"b\"; };
+            scene c { print \"c\"; };
+        ";
+        let err = run(&format!("{} start a; start b; start c;", scenes))
+            .await
+            .unwrap_err();
+        assert_eq!(
+            "cannot start scene c, 2 scenes are already running",
+            err.to_string()
+        );
+        // Starting a running scene again does not take another slot.
+        assert_eq!(
+            vec!["a", "b", "a"],
+            run(&format!("{} start a; start b; start a;", scenes))
+                .await
+                .unwrap()
+        );
+        // Stopping a scene frees its slot.
+        assert_eq!(
+            vec!["a", "b", "c"],
+            run(&format!("{} start a; start b; stop a; start c;", scenes))
+                .await
+                .unwrap()
+        );
+    }
+    #[tokio::test]
+    async fn test_scene_disabled() {
+        let source = "
+            scene vacation disabled { print \"away\"; };
+            start vacation;
+            enable vacation;
+            start vacation;
+            disable vacation;
+            start vacation;
+    ";
+        let te = run_vm_to_end(source, TestEngine::new(), Output::Text).await;
+
+        assert_eq!(
+            vec!["away".to_string()],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_when_cooldown() {
+        let source = "
+        when <motion> cooldown 30s set [porch/light] \"on\";
+";
+
+        let (te, shutdown) = run_vm_with(
+            source,
+            TestEngine::with_gets(&["true", "true", "true"]),
+            Output::Text,
+        );
+        drained(&te).await;
+
+        assert_eq!(4, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(1, te.set_count.load(Ordering::SeqCst));
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_online() {
+        let source = "
+            print online <zwave>;
+            print online <zigbee>;
+    ";
+        // The retained connected values, zigbee is connected to the broker but not its hardware.
+        let te = TestEngine::with_gets(&["2", "1"]);
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        VM::new(te.clone()).run(code, shutdown_rx).await.unwrap();
+
+        assert_eq!(
+            vec!["true".to_string(), "false".to_string()],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_when_breaker() {
+        let source = "
+        when <motion> breaker 2 per 1m for 10m set [porch/light] \"on\";
+";
+
+        let (te, shutdown) = run_vm_with(
+            source,
+            TestEngine::with_gets(&["true", "true", "true", "true"]),
+            Output::Text,
+        );
+        drained(&te).await;
+
+        assert_eq!(5, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(2, te.set_count.load(Ordering::SeqCst));
+        let _ = shutdown.send(());
+    }
+    #[test]
+    fn test_breaker() {
+        let (window, open) = (Duration::from_secs(60), Duration::from_secs(600));
+        let start = time::Instant::now();
+        let at = |secs| start + Duration::from_secs(secs);
+        let mut breaker = Breaker::default();
+        // Flapping trips the breaker on the third firing within the minute.
+        assert!(breaker.fire(at(0), 2, window, open));
+        assert!(breaker.fire(at(10), 2, window, open));
+        assert!(!breaker.fire(at(20), 2, window, open));
+        assert!(!breaker.fire(at(300), 2, window, open));
+        // Once the breaker closes the when runs again.
+        assert!(breaker.fire(at(620), 2, window, open));
+        assert!(breaker.fire(at(630), 2, window, open));
+        // Firings older than the window are not counted.
+        assert!(breaker.fire(at(700), 2, window, open));
+    }
+    #[tokio::test]
+    async fn test_when_cooldown_elapsed() {
+        let source = "
+        when <motion> cooldown 0s set [porch/light] \"on\";
+";
+
+        let (te, shutdown) = run_vm_with(
+            source,
+            TestEngine::with_gets(&["true", "true", "true"]),
+            Output::Text,
+        );
+        drained(&te).await;
+
+        assert_eq!(4, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(3, te.set_count.load(Ordering::SeqCst));
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_wait() {
+        let source = "
+            wait 1s print \"done\";
+    ";
+        let (te, shutdown) = run_vm(source);
+        // TODO: remove this sleep
+        time::sleep(Duration::from_millis(100)).await;
+
+        assert_eq!(0, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
+        assert_eq!(1, te.wait_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec![Duration::from_secs(1),],
+            te.wait_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<Duration>>(),
+        );
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_when_numeric() {
+        let source = "
+            when <temp> is 21 print \"warm\";
+    ";
+        let (te, shutdown) =
+            run_vm_with(source, TestEngine::with_gets(&["20", "21"]), Output::Text);
+        drained(&te).await;
+
+        assert_eq!(3, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec!["warm".to_string()],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_wait_until() {
+        let source = "
+            wait until <ready> for 1s print \"ready\";
+    ";
+        let te = run_vm_to_end(source, TestEngine::new(), Output::Text).await;
+
+        assert_eq!(1, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec!["ready".to_string()],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_bool_is_on() {
+        let source = "
+            print <switch> is \"on\";
+            print <switch> is \"off\";
+            print <valve> is \"off\";
+    ";
+        let te = TestEngine::with_gets(&["true", "true", "false"]);
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        VM::new(te.clone()).run(code, shutdown_rx).await.unwrap();
+        assert_eq!(
+            vec!["true", "false", "true"],
+            te.print_args.lock().unwrap().clone()
+        );
+    }
+    #[tokio::test]
+    async fn test_wait_until_timeout() {
+        let source = "
+            wait until <ready> is \"on\" for 50ms print \"ready\";
+    ";
+        let te = run_vm_to_end(source, TestEngine::with_gets(&["off"]), Output::Text).await;
+
+        assert_eq!(2, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.print_count.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_within() {
+        let source = "
+            print <temp> within 50ms else 20;
+            print <humidity> within 50ms else 40;
+            print <light> within 50ms;
+    ";
+        let te = TestEngine::with_gets(&["21"]);
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let err = VM::new(te.clone())
+            .run(code, shutdown_rx)
+            .await
+            .unwrap_err();
+
+        assert_eq!("no value for <light> within 50ms", err.to_string());
+        assert_eq!(
+            Some(&GetTimeout {
+                path: "light".to_string(),
+                timeout: Duration::from_millis(50),
+            }),
+            err.downcast_ref::<GetTimeout>()
+        );
+        assert_eq!(
+            vec!["21".to_string(), "40".to_string()],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_within_unknown() {
+        // The engine answers the first get and never answers the second.
+        let source = "
+            print <room/temp> within 50ms else $unknown;
+            let sensor = <room/sensor> within 50ms else $unknown;
+            print sensor;
+            print sensor is $unknown;
+            print 21 is $unknown;
+    ";
+        let te = TestEngine::with_gets(&["21"]);
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        VM::new(te.clone()).run(code, shutdown_rx).await.unwrap();
+
+        assert_eq!(
+            vec!["21", "<unknown>", "true", "false"],
+            te.print_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_set() {
+        let source = "
+            set [path/to/value] \"on\";
+    ";
+        let (te, shutdown) = run_vm(source);
+        // TODO: remove this sleep
+        time::sleep(Duration::from_millis(100)).await;
+
+        assert_eq!(0, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.wait_count.load(Ordering::SeqCst));
+
+        assert_eq!(1, te.set_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec![("path/to/value".to_string(), "on".to_string())],
+            te.set_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<(String, String)>>(),
+        );
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_when_closed() {
+        let source = "
+            when <kitchen/light> is \"on\" print \"on\";
+    ";
+        let te = TestEngine::new();
+        te.closed.store(true, Ordering::SeqCst);
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        // The when stops instead of retrying a get that can never succeed.
+        time::timeout(
+            Duration::from_secs(1),
+            VM::new(te.clone()).run(code, shutdown_rx),
+        )
+        .await
+        .unwrap()
+        .unwrap();
+        assert_eq!(1, te.get_count.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_when_engine_closed() {
+        let source = "
+            when <kitchen/light> is \"on\" print \"on\";
+    ";
+        let te = TestEngine::with_gets(&["on"]);
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let vm = {
+            let te = te.clone();
+            tokio::spawn(async move { VM::new(te).run(code, shutdown_rx).await })
+        };
+        eventually(|| te.get_count.load(Ordering::SeqCst) == 2).await;
+
+        // The when waiting for the next value stops once the engine closes.
+        te.close();
+        time::timeout(Duration::from_secs(1), vm)
+            .await
+            .unwrap()
+            .unwrap()
+            .unwrap();
+        assert_eq!(1, te.print_count.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_redefine_scene() {
+        let source = "
+            scene evening { when <hall/motion> is \"on\" print \"old\"; };
+            scene night { when <hall/motion> is \"on\" print \"night\"; };
+            start evening;
+            scene evening { print \"new\"; };
+            scene night { print \"not started\"; };
+    ";
+        let te = TestEngine::with_gets(&[]);
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        // The when of the old evening stops, so the program completes.
+        time::timeout(
+            Duration::from_secs(1),
+            VM::new(te.clone()).run(code, shutdown_rx),
+        )
+        .await
+        .unwrap()
+        .unwrap();
+        assert_eq!(vec!["new"], te.print_args.lock().unwrap().clone());
+    }
+    #[tokio::test]
+    async fn test_set_mirror() {
+        let source = "
+            set [b/x] <a/y>;
+            set [b/z] <a/w> within 50ms;
+    ";
+        let te = TestEngine::with_gets(&["on"]);
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        // The second get fails, so its device is not set.
+        let err = VM::new(te.clone())
+            .run(code, shutdown_rx)
+            .await
+            .unwrap_err();
+        assert!(err.downcast_ref::<GetTimeout>().is_some(), "{}", err);
+
+        assert_eq!(
+            vec![("b/x".to_string(), "on".to_string())],
+            te.set_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<(String, String)>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_set_mirror_bool() {
+        let source = "
+            set [b/x] <a/y>;
+            set [b/z] <a/w>;
+    ";
+        // The devices publish JSON booleans.
+        let te = run_vm_to_end(
+            source,
+            TestEngine::with_gets(&["true", "false"]),
+            Output::Text,
+        )
+        .await;
+
+        assert_eq!(
+            vec![
+                ("b/x".to_string(), "true".to_string()),
+                ("b/z".to_string(), "false".to_string()),
+            ],
+            te.set_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<(String, String)>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_set_class() {
+        let source = "
+            set [bedroom/light[1-3]] \"on\";
+    ";
+        let te = run_vm_to_end(source, TestEngine::new(), Output::Text).await;
+
+        assert_eq!(
+            vec![
+                ("bedroom/light1".to_string(), "on".to_string()),
+                ("bedroom/light2".to_string(), "on".to_string()),
+                ("bedroom/light3".to_string(), "on".to_string()),
+            ],
+            te.set_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<(String, String)>>(),
+        );
+    }
+    #[test]
+    fn test_until() {
+        // Mountain standard time, i.e. a home in a different zone than a server using UTC.
+        let tz = chrono::FixedOffset::west_opt(7 * 60 * 60).unwrap();
+        let at = |h, m| {
+            chrono::NaiveDate::from_ymd_opt(2022, 1, 1)
+                .unwrap()
+                .and_hms_opt(h, m, 0)
+                .unwrap()
+        };
+
+        let now = tz.from_local_datetime(&at(8, 30)).unwrap();
+        assert_eq!(Duration::from_secs(30 * 60), until(9, 0, now));
+
+        let now = tz.from_local_datetime(&at(9, 0)).unwrap();
+        assert_eq!(Duration::from_secs(24 * 60 * 60), until(9, 0, now));
+
+        // 9:00AM mountain time is 16:00 UTC
+        let now = chrono::Utc.from_utc_datetime(&at(15, 0)).with_timezone(&tz);
+        assert_eq!(Duration::from_secs(60 * 60), until(9, 0, now));
+
+        // #midnight is the start of the next day and #noon is later today
+        let now = tz.from_local_datetime(&at(23, 30)).unwrap();
+        assert_eq!(Duration::from_secs(30 * 60), until(0, 0, now));
+        let now = tz.from_local_datetime(&at(0, 0)).unwrap();
+        assert_eq!(Duration::from_secs(12 * 60 * 60), until(12, 0, now));
+    }
+    #[test]
+    fn test_until_time_zone() {
+        let at = |month, h| {
+            chrono::NaiveDate::from_ymd_opt(2022, month, 1)
+                .unwrap()
+                .and_hms_opt(h, 0, 0)
+                .unwrap()
+        };
+        // 15:00 UTC is 8:00AM in Denver during winter, whatever the time zone of the host.
+        let now = Utc
+            .from_utc_datetime(&at(1, 15))
+            .with_timezone(&chrono_tz::America::Denver);
+        assert_eq!(Duration::from_secs(60 * 60), until(9, 0, now));
+        // And 9:00AM during summer, so 9:00AM is the next day.
+        let now = Utc
+            .from_utc_datetime(&at(7, 15))
+            .with_timezone(&chrono_tz::America::Denver);
+        assert_eq!(Duration::from_secs(24 * 60 * 60), until(9, 0, now));
+    }
+    #[test]
+    fn test_until_next() {
+        let tz = chrono::FixedOffset::west_opt(7 * 60 * 60).unwrap();
+        // The wait for 9:00AM ended with the wall clock a second behind.
+        let now = tz
+            .from_local_datetime(
+                &chrono::NaiveDate::from_ymd_opt(2022, 1, 1)
+                    .unwrap()
+                    .and_hms_opt(8, 59, 59)
+                    .unwrap(),
+            )
+            .unwrap();
+        assert_eq!(Duration::from_secs(1), until_next(9, 0, now, false));
+        // Having just fired, the at waits for the next day instead of firing again.
+        assert_eq!(
+            Duration::from_secs(24 * 60 * 60 + 1),
+            until_next(9, 0, now, true)
+        );
+    }
+    #[test]
+    fn test_until_sun() {
+        let utc = |d: u32, h: u32| {
+            Utc.from_utc_datetime(
+                &NaiveDate::from_ymd_opt(2022, 1, d)
+                    .unwrap()
+                    .and_hms_opt(h, 0, 0)
+                    .unwrap(),
+            )
+        };
+        // The sun rises at 9:00AM, except on the 2nd and 3rd of the polar night.
+        let sunrise = |date: NaiveDate| match date.day() {
+            2 | 3 => None,
+            d => Some(utc(d, 9)),
+        };
+        let hours = |h| Duration::from_secs(h * 60 * 60);
+        assert_eq!(Some((hours(1), 0)), until_sun(utc(1, 8), false, sunrise));
+        // After the sunrise the next is on the 4th, skipping the days without one.
+        assert_eq!(Some((hours(62), 2)), until_sun(utc(1, 19), false, sunrise));
+        // Having just fired, the at waits for the next sunrise instead of firing again.
+        let now = utc(1, 9) - chrono::Duration::seconds(1);
+        assert_eq!(
+            Some((hours(72) + Duration::from_secs(1), 2)),
+            until_sun(now, true, sunrise)
+        );
+        // A sun that never rises is no time at all.
+        assert_eq!(None, until_sun(utc(1, 8), false, |_| None));
+    }
+    #[tokio::test]
+    async fn test_at_no_next_time() {
+        let source = "
+            at #sunrise print \"morning\";
+            print \"done\";
+    ";
+        let te = TestEngine::ticking();
+        let code = Interpreter::from_source(source).unwrap();
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        // The formula of the sun has no sunrise at the pole on any day.
+        let vm = VM::new(te.clone()).with_location(Location {
+            latitude: 90.0,
+            longitude: 0.0,
+        });
+        // The at ends without waiting or firing, which completes the program.
+        time::timeout(Duration::from_secs(1), vm.run(code, shutdown_rx))
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(1, te.print_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.wait_count.load(Ordering::SeqCst));
+    }
+    #[tokio::test]
+    async fn test_at_sunset() {
+        let source = "
+            at #sunset print \"evening\";
+    ";
+        let te = TestEngine::ticking();
+        let code = Interpreter::from_source(source).unwrap();
+        let (shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        let vm = VM::new(te.clone()).with_location(Location {
+            latitude: 39.74,
+            longitude: -104.99,
+        });
+        tokio::spawn(async move { vm.run(code, shutdown_rx).await });
+        eventually(|| te.wait_count.load(Ordering::SeqCst) == 1).await;
+        // The at waits for the sunset, which is at most a day away.
+        let waits = te.wait_args.lock().unwrap().clone();
+        assert!(waits
+            .iter()
+            .all(|d| *d <= Duration::from_secs(24 * 60 * 60)));
+
+        te.tick();
+        eventually(|| te.print_count.load(Ordering::SeqCst) == 1).await;
+        let _ = shutdown_tx.send(());
+    }
+    /// US mountain time for 2022, clocks spring forward on March 13th
+    /// and fall back on November 6th, both at 2:00AM.
+    #[derive(Clone, Copy, Debug)]
+    struct Mountain;
+    impl Mountain {
+        fn mst() -> chrono::FixedOffset {
+            chrono::FixedOffset::west_opt(7 * 60 * 60).unwrap()
+        }
+        fn mdt() -> chrono::FixedOffset {
+            chrono::FixedOffset::west_opt(6 * 60 * 60).unwrap()
+        }
+        fn change(month: u32, day: u32, offset: chrono::FixedOffset) -> chrono::NaiveDateTime {
+            chrono::NaiveDate::from_ymd_opt(2022, month, day)
+                .unwrap()
+                .and_hms_opt(2, 0, 0)
+                .unwrap()
+                - offset
+        }
+    }
+    impl TimeZone for Mountain {
+        type Offset = chrono::FixedOffset;
+        fn from_offset(_: &chrono::FixedOffset) -> Self {
+            Mountain
+        }
+        fn offset_from_local_date(
+            &self,
+            local: &chrono::NaiveDate,
+        ) -> LocalResult<chrono::FixedOffset> {
+            self.offset_from_local_datetime(&local.and_hms_opt(0, 0, 0).unwrap())
+        }
+        fn offset_from_local_datetime(
+            &self,
+            local: &chrono::NaiveDateTime,
+        ) -> LocalResult<chrono::FixedOffset> {
+            let valid = |offset: chrono::FixedOffset| {
+                let utc = *local - offset;
+                self.offset_from_utc_datetime(&utc) == offset
+            };
+            match (valid(Self::mst()), valid(Self::mdt())) {
+                (true, true) => LocalResult::Ambiguous(Self::mdt(), Self::mst()),
+                (true, false) => LocalResult::Single(Self::mst()),
+                (false, true) => LocalResult::Single(Self::mdt()),
+                (false, false) => LocalResult::None,
+            }
+        }
+        fn offset_from_utc_date(&self, utc: &chrono::NaiveDate) -> chrono::FixedOffset {
+            self.offset_from_utc_datetime(&utc.and_hms_opt(0, 0, 0).unwrap())
+        }
+        fn offset_from_utc_datetime(&self, utc: &chrono::NaiveDateTime) -> chrono::FixedOffset {
+            if *utc >= Self::change(3, 13, Self::mst()) && *utc < Self::change(11, 6, Self::mdt()) {
+                Self::mdt()
+            } else {
+                Self::mst()
+            }
+        }
+    }
+    #[test]
+    fn test_passed() {
+        let tz = chrono::FixedOffset::west_opt(7 * 60 * 60).unwrap();
+        let at = |h, m| {
+            tz.from_local_datetime(
+                &chrono::NaiveDate::from_ymd_opt(2022, 1, 1)
+                    .unwrap()
+                    .and_hms_opt(h, m, 30)
+                    .unwrap(),
+            )
+            .unwrap()
+        };
+        assert!(!passed(18, 0, at(17, 59)));
+        assert!(passed(18, 0, at(18, 0)));
+        assert!(passed(18, 0, at(23, 59)));
+        // Midnight starts a new day.
+        assert!(!passed(18, 0, at(0, 0)));
+        assert!(passed(0, 0, at(0, 0)));
+    }
+    #[tokio::test]
+    async fn test_guard() {
+        let source = "
+            after 12:00PM print \"after\";
+            before 12:00PM print \"before\";
+    ";
+        let run = |clock: Clock| async move {
+            let te = TestEngine::new();
+            let code = Interpreter::from_source(source).unwrap();
+            let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+            VM::new(te.clone())
+                .with_clock(clock)
+                .run(code, shutdown_rx)
+                .await
+                .unwrap();
+            let printed = te.print_args.lock().unwrap().clone();
+            printed
+        };
+        fn at(h: u32) -> DateTime<Local> {
+            let today = Local::now().naive_local().date();
+            Local
+                .from_local_datetime(&today.and_hms_opt(h, 0, 0).unwrap())
+                .earliest()
+                .unwrap()
+        }
+        assert_eq!(vec!["after".to_string()], run(|| at(13)).await);
+        assert_eq!(vec!["before".to_string()], run(|| at(11)).await);
+    }
+    #[test]
+    fn test_until_dst() {
+        let at = |month, day, h, m| {
+            Mountain
+                .from_local_datetime(
+                    &chrono::NaiveDate::from_ymd_opt(2022, month, day)
+                        .unwrap()
+                        .and_hms_opt(h, m, 0)
+                        .unwrap(),
+                )
+                .earliest()
+                .unwrap()
+        };
+        const HOUR: u64 = 60 * 60;
+
+        // The day clocks spring forward is an hour shorter.
+        let now = at(3, 12, 7, 0);
+        assert_eq!(Duration::from_secs(23 * HOUR), until(7, 0, now));
+        // The day clocks fall back is an hour longer.
+        let now = at(11, 5, 7, 0);
+        assert_eq!(Duration::from_secs(25 * HOUR), until(7, 0, now));
+
+        // 2:30AM does not exist when clocks spring forward, it happens at 3:30AM instead.
+        let now = at(3, 13, 0, 0);
+        assert_eq!(Duration::from_secs(5 * HOUR / 2), until(2, 30, now));
+        let now = at(3, 13, 3, 30);
+        assert_eq!(Duration::from_secs(23 * HOUR), until(2, 30, now));
+
+        // 1:30AM happens twice when clocks fall back, only the first fires.
+        let now = at(11, 6, 0, 0);
+        assert_eq!(Duration::from_secs(3 * HOUR / 2), until(1, 30, now));
+        let first = at(11, 6, 1, 30);
+        let second = first + chrono::Duration::hours(1);
+        assert_eq!(Duration::from_secs(25 * HOUR), until(1, 30, first));
+        assert_eq!(Duration::from_secs(24 * HOUR), until(1, 30, second));
+
+        // Every day fires exactly once across both changes.
+        let mut now = at(3, 1, 7, 0);
+        let mut days = 0;
+        while now < at(11, 30, 7, 0) {
+            now = now + chrono::Duration::from_std(until(7, 0, now)).unwrap();
+            assert_eq!((7, 0), (now.hour(), now.minute()));
+            days += 1;
+        }
+        assert_eq!(274, days);
+    }
+    #[tokio::test]
+    async fn test_publish() {
+        let source = "
+            publish [dan/comfort] {temp: 21};
+    ";
+        let te = run_vm_to_end(source, TestEngine::new(), Output::Text).await;
+
+        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec![("dan/comfort".to_string(), r#"{"temp":21}"#.to_string())],
+            te.publish_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<(String, String)>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_quiet_hours() {
+        let source = "
+            set [porch/light] \"on\";
+            set urgent [alarm/siren] \"on\";
+    ";
+        let te = TestEngine::new();
+        let code = Interpreter::from_source(source).unwrap();
+        // Quiet hours cross midnight and it is 11:30PM.
+        let quiet = QuietHours::new((22, 0), (6, 0))
+            .with_clock(|| NaiveTime::from_hms_opt(23, 30, 0).unwrap());
+        assert!(quiet.active());
+        assert!(!quiet
+            .with_clock(|| NaiveTime::from_hms_opt(6, 0, 0).unwrap())
+            .active());
+        let vm = VM::new(te.clone()).with_quiet_hours(quiet);
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        vm.run(code, shutdown_rx).await.unwrap();
+
+        assert_eq!(
+            vec![("alarm/siren".to_string(), "on".to_string())],
+            te.set_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<(String, String)>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_publish_formatter() {
+        let source = "
+            publish [dan/mode] \"away\";
+            publish [dan/temp] 21;
+    ";
+        let te = TestEngine::new();
+        let code = Interpreter::from_source(source).unwrap();
+        // Always publish JSON, so the string is quoted.
+        let vm = VM::new(te.clone()).with_formatter(|v| Ok(serde_json::to_vec(&v)?));
+        let (_shutdown_tx, shutdown_rx) = broadcast::channel(1);
+        vm.run(code, shutdown_rx).await.unwrap();
+
+        assert_eq!(
+            vec![
+                ("dan/mode".to_string(), r#""away""#.to_string()),
+                ("dan/temp".to_string(), "21".to_string()),
+            ],
+            te.publish_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<(String, String)>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_clear() {
+        let source = "
+            clear [path/to/value];
+    ";
+        let te = run_vm_to_end(source, TestEngine::new(), Output::Text).await;
+
+        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec!["path/to/value".to_string()],
+            te.clear_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<String>>(),
+        );
+    }
+    #[tokio::test]
+    async fn test_many_threads() {
+        let source = "
+            wait 5s print \"a\";
+            wait 4s print \"b\";
+            wait 3s print \"c\";
+            wait 2s print \"d\";
+            wait 1s print \"e\";
+    ";
+        let (te, shutdown) = run_vm(source);
+        // TODO: remove this sleep
+        time::sleep(Duration::from_millis(100)).await;
+
+        assert_eq!(0, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
+        assert_eq!(5, te.wait_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec![
+                Duration::from_secs(5),
+                Duration::from_secs(4),
+                Duration::from_secs(3),
+                Duration::from_secs(2),
+                Duration::from_secs(1),
+            ],
+            te.wait_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<Duration>>(),
+        );
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_scene() {
+        let source = "
+        scene night { print \"x\"; };
+        start night;
+        stop night;
+    ";
+        let (te, shutdown) = run_vm(source);
+        // TODO: remove this sleep
+        time::sleep(Duration::from_millis(100)).await;
+
+        assert_eq!(0, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.set_count.load(Ordering::SeqCst));
+        assert_eq!(0, te.wait_count.load(Ordering::SeqCst));
+        let _ = shutdown.send(());
+    }
+    #[tokio::test]
+    async fn test_scene_arm() {
+        let source = "
+        scene night {
+            set [porch/light] \"on\";
+            when <door> set [hall/light] \"on\";
+        };
+        arm night;
+    ";
+        let (te, shutdown) = run_vm(source);
+        drained(&te).await;
+
+        assert_eq!(2, te.get_count.load(Ordering::SeqCst));
+        assert_eq!(
+            vec![("hall/light".to_string(), "on".to_string())],
+            te.set_args
+                .lock()
+                .unwrap()
+                .drain(..)
+                .collect::<Vec<(String, String)>>(),
+        );
         let _ = shutdown.send(());
     }
 }
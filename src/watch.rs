@@ -0,0 +1,113 @@
+use anyhow::Result;
+use futures::{stream, StreamExt};
+use tokio::sync::broadcast::{self, error::RecvError};
+
+use crate::{
+    mqtt_engine::{topic_matches, Change},
+    vm::Engine,
+};
+
+/// Prints the topic and value of every update of the path, which may have MQTT wildcards,
+/// i.e. +/temp for the temperature of every room, until the change feeds are closed.
+/// The path is subscribed once and the updates are read from the change feeds of the engines,
+/// so no update is missed between two gets.
+/// Unlike a when it does not stop the programs from finishing, it is meant for a terminal.
+pub async fn watch<E: Engine>(
+    engine: &E,
+    changes: Vec<broadcast::Receiver<Change>>,
+    path: &str,
+) -> Result<()> {
+    let mut changes = stream::select_all(changes.into_iter().map(|rx| {
+        Box::pin(stream::unfold(rx, |mut rx| async move {
+            loop {
+                match rx.recv().await {
+                    Ok(change) => return Some((change, rx)),
+                    // The engine counts the missed changes, see MQTTEngine::dropped.
+                    Err(RecvError::Lagged(_)) => continue,
+                    Err(RecvError::Closed) => return None,
+                }
+            }
+        }))
+    }));
+    engine.subscribe(path).await?;
+    while let Some(change) = changes.next().await {
+        // A cleared topic has no value to print.
+        if !topic_matches(path, &change.topic) || change.payload.is_empty() {
+            continue;
+        }
+        engine
+            .print(&format!(
+                "{} {}",
+                change.topic,
+                String::from_utf8_lossy(&change.payload)
+            ))
+            .await?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use async_trait::async_trait;
+    use std::sync::{Arc, Mutex};
+
+    use super::*;
+
+    #[derive(Debug, Clone, Default)]
+    struct TestEngine {
+        subscribed: Arc<Mutex<Vec<String>>>,
+        printed: Arc<Mutex<Vec<String>>>,
+    }
+
+    #[async_trait]
+    impl Engine for TestEngine {
+        async fn print(&self, msg: &str) -> Result<()> {
+            self.printed.lock().unwrap().push(msg.to_string());
+            Ok(())
+        }
+        async fn get(&self, _path: &str) -> Result<Vec<u8>> {
+            unreachable!("watch reads the change feeds")
+        }
+        async fn subscribe(&self, path: &str) -> Result<()> {
+            self.subscribed.lock().unwrap().push(path.to_string());
+            Ok(())
+        }
+        async fn set(&self, _path: &str, _value: Vec<u8>) -> Result<()> {
+            Ok(())
+        }
+    }
+
+    fn change(topic: &str, payload: &str) -> Change {
+        Change {
+            topic: topic.to_string(),
+            payload: payload.into(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_watch() {
+        let engine = TestEngine::default();
+        let (home, home_rx) = broadcast::channel(16);
+        let (cabin, cabin_rx) = broadcast::channel(16);
+        home.send(change("kitchen/temp", "21")).unwrap();
+        home.send(change("kitchen/light", "on")).unwrap();
+        home.send(change("bedroom/temp", "")).unwrap();
+        home.send(change("kitchen/temp", "22")).unwrap();
+        cabin.send(change("porch/temp", "12")).unwrap();
+        // The watch finishes once every feed is closed.
+        drop((home, cabin));
+
+        watch(&engine, vec![home_rx, cabin_rx], "+/temp")
+            .await
+            .unwrap();
+
+        assert_eq!(vec!["+/temp"], *engine.subscribed.lock().unwrap());
+        let mut printed = engine.printed.lock().unwrap().clone();
+        // The feeds are merged, so only the order within a feed is kept.
+        printed.sort();
+        assert_eq!(
+            vec!["kitchen/temp 21", "kitchen/temp 22", "porch/temp 12"],
+            printed
+        );
+    }
+}